@@ -0,0 +1,456 @@
+package admin
+
+//管理员接口：管理角色、权限、角色-权限关联和用户-角色关联
+//所有接口都挂在需要rbac:manage权限的路由组下
+//注意：权限是写在JWT里的，修改后要等用户刷新令牌(/token/refresh)或重新登录才会生效
+import (
+	"Project01/db"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// 内置角色不能删除和改名：注册时要分配user，admin_users配置要用admin
+var builtinRoles = map[string]bool{"user": true, "moderator": true, "admin": true}
+
+// 从路径参数中解析ID，失败时直接返回400
+func parseIdParam(c *gin.Context, name string) (uint64, bool) {
+	id, err := strconv.ParseUint(c.Param(name), 10, 64)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "参数" + name + "不合法"})
+		return 0, false
+	}
+	return id, true
+}
+
+// 查询失败时统一的错误响应：不存在返回404，其它返回500
+func respondQueryError(c *gin.Context, err error, what string) {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(404, gin.H{"error": what + "不存在"})
+	} else {
+		c.JSON(500, gin.H{"error": "查询" + what + "失败"})
+	}
+}
+
+/*角色*/
+
+// 返回给客户端的角色，带上它拥有的权限
+type roleReply struct {
+	db.Role
+	Permissions []db.Permission `json:"permissions"`
+}
+
+// 列出所有角色
+// GET /admin/roles
+func ListRolesHandler(c *gin.Context) {
+	database := db.GetDB()
+	var roles []db.Role
+	if err := database.Order("id").Find(&roles).Error; err != nil {
+		c.JSON(500, gin.H{"error": "查询角色失败"})
+		return
+	}
+	//一次查出所有角色-权限关联，避免每个角色查一次
+	var links []struct {
+		RoleId uint64
+		db.Permission
+	}
+	if err := database.Table("role_permissions").
+		Select("role_permissions.role_id, p.*").
+		Joins("JOIN permissions p ON p.id=role_permissions.permission_id").
+		Scan(&links).Error; err != nil {
+		c.JSON(500, gin.H{"error": "查询角色权限失败"})
+		return
+	}
+	rolePermissions := make(map[uint64][]db.Permission)
+	for _, link := range links {
+		rolePermissions[link.RoleId] = append(rolePermissions[link.RoleId], link.Permission)
+	}
+	reply := make([]roleReply, 0, len(roles))
+	for _, role := range roles {
+		reply = append(reply, roleReply{Role: role, Permissions: rolePermissions[role.ID]})
+	}
+	c.JSON(200, gin.H{"roles": reply})
+}
+
+// 创建/修改角色的请求
+type roleRequest struct {
+	Name        *string `json:"name"`
+	Description *string `json:"description"`
+}
+
+// 创建角色
+// POST /admin/roles
+func CreateRoleHandler(c *gin.Context) {
+	var req roleRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.Name == nil || strings.TrimSpace(*req.Name) == "" {
+		c.JSON(400, gin.H{"error": "参数错误，角色名不能为空"})
+		return
+	}
+	role := db.Role{Name: strings.TrimSpace(*req.Name)}
+	if req.Description != nil {
+		role.Description = *req.Description
+	}
+	if err := db.GetDB().Create(&role).Error; err != nil {
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			c.JSON(409, gin.H{"error": "角色已存在"})
+		} else {
+			c.JSON(500, gin.H{"error": "创建角色失败"})
+		}
+		return
+	}
+	c.JSON(201, role)
+}
+
+// 修改角色
+// PATCH /admin/roles/:id
+func UpdateRoleHandler(c *gin.Context) {
+	id, ok := parseIdParam(c, "id")
+	if !ok {
+		return
+	}
+	var req roleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "参数错误"})
+		return
+	}
+	database := db.GetDB()
+	var role db.Role
+	if err := database.First(&role, id).Error; err != nil {
+		respondQueryError(c, err, "角色")
+		return
+	}
+	updates := map[string]interface{}{}
+	if req.Name != nil && *req.Name != role.Name {
+		name := strings.TrimSpace(*req.Name)
+		if name == "" {
+			c.JSON(400, gin.H{"error": "角色名不能为空"})
+			return
+		}
+		if builtinRoles[role.Name] {
+			c.JSON(400, gin.H{"error": "内置角色不能改名"})
+			return
+		}
+		updates["name"] = name
+	}
+	if req.Description != nil {
+		updates["description"] = *req.Description
+	}
+	if len(updates) > 0 {
+		if err := database.Model(&role).Updates(updates).Error; err != nil {
+			if errors.Is(err, gorm.ErrDuplicatedKey) {
+				c.JSON(409, gin.H{"error": "角色名已存在"})
+			} else {
+				c.JSON(500, gin.H{"error": "修改角色失败"})
+			}
+			return
+		}
+	}
+	c.JSON(200, role)
+}
+
+// 删除角色，同时删除它的角色-权限关联和用户-角色关联
+// DELETE /admin/roles/:id
+func DeleteRoleHandler(c *gin.Context) {
+	id, ok := parseIdParam(c, "id")
+	if !ok {
+		return
+	}
+	database := db.GetDB()
+	var role db.Role
+	if err := database.First(&role, id).Error; err != nil {
+		respondQueryError(c, err, "角色")
+		return
+	}
+	if builtinRoles[role.Name] {
+		c.JSON(400, gin.H{"error": "内置角色不能删除"})
+		return
+	}
+	err := database.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("role_id=?", id).Delete(&db.RolePermission{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("role_id=?", id).Delete(&db.UserRole{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&role).Error
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"error": "删除角色失败"})
+		return
+	}
+	c.JSON(200, gin.H{"message": "删除角色成功"})
+}
+
+/*权限*/
+
+// 列出所有权限
+// GET /admin/permissions
+func ListPermissionsHandler(c *gin.Context) {
+	var permissions []db.Permission
+	if err := db.GetDB().Order("id").Find(&permissions).Error; err != nil {
+		c.JSON(500, gin.H{"error": "查询权限失败"})
+		return
+	}
+	c.JSON(200, gin.H{"permissions": permissions})
+}
+
+// 创建/修改权限的请求
+type permissionRequest struct {
+	Name        *string `json:"name"`
+	Resource    *string `json:"resource"`
+	Action      *string `json:"action"`
+	Description *string `json:"description"`
+}
+
+// 资源和操作不能为空，也不能包含冒号(权限在令牌里以 资源:操作 的形式存放)
+func validPermissionPart(s string) bool {
+	return s != "" && !strings.Contains(s, ":")
+}
+
+// 创建权限
+// POST /admin/permissions
+func CreatePermissionHandler(c *gin.Context) {
+	var req permissionRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.Name == nil || req.Resource == nil || req.Action == nil {
+		c.JSON(400, gin.H{"error": "参数错误，name、resource、action必填"})
+		return
+	}
+	perm := db.Permission{
+		Name:     strings.TrimSpace(*req.Name),
+		Resource: strings.TrimSpace(*req.Resource),
+		Action:   strings.TrimSpace(*req.Action),
+	}
+	if perm.Name == "" || !validPermissionPart(perm.Resource) || !validPermissionPart(perm.Action) {
+		c.JSON(400, gin.H{"error": "权限名、资源、操作不能为空，资源和操作不能包含冒号"})
+		return
+	}
+	if req.Description != nil {
+		perm.Description = *req.Description
+	}
+	if err := db.GetDB().Create(&perm).Error; err != nil {
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			c.JSON(409, gin.H{"error": "权限已存在"})
+		} else {
+			c.JSON(500, gin.H{"error": "创建权限失败"})
+		}
+		return
+	}
+	c.JSON(201, perm)
+}
+
+// 修改权限
+// PATCH /admin/permissions/:id
+func UpdatePermissionHandler(c *gin.Context) {
+	id, ok := parseIdParam(c, "id")
+	if !ok {
+		return
+	}
+	var req permissionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "参数错误"})
+		return
+	}
+	database := db.GetDB()
+	var perm db.Permission
+	if err := database.First(&perm, id).Error; err != nil {
+		respondQueryError(c, err, "权限")
+		return
+	}
+	updates := map[string]interface{}{}
+	if req.Name != nil {
+		if strings.TrimSpace(*req.Name) == "" {
+			c.JSON(400, gin.H{"error": "权限名不能为空"})
+			return
+		}
+		updates["name"] = strings.TrimSpace(*req.Name)
+	}
+	if req.Resource != nil {
+		if !validPermissionPart(strings.TrimSpace(*req.Resource)) {
+			c.JSON(400, gin.H{"error": "资源不能为空，也不能包含冒号"})
+			return
+		}
+		updates["resource"] = strings.TrimSpace(*req.Resource)
+	}
+	if req.Action != nil {
+		if !validPermissionPart(strings.TrimSpace(*req.Action)) {
+			c.JSON(400, gin.H{"error": "操作不能为空，也不能包含冒号"})
+			return
+		}
+		updates["action"] = strings.TrimSpace(*req.Action)
+	}
+	if req.Description != nil {
+		updates["description"] = *req.Description
+	}
+	if len(updates) > 0 {
+		if err := database.Model(&perm).Updates(updates).Error; err != nil {
+			if errors.Is(err, gorm.ErrDuplicatedKey) {
+				c.JSON(409, gin.H{"error": "权限名已存在"})
+			} else {
+				c.JSON(500, gin.H{"error": "修改权限失败"})
+			}
+			return
+		}
+	}
+	c.JSON(200, perm)
+}
+
+// 删除权限，同时删除它的角色-权限关联
+// DELETE /admin/permissions/:id
+func DeletePermissionHandler(c *gin.Context) {
+	id, ok := parseIdParam(c, "id")
+	if !ok {
+		return
+	}
+	database := db.GetDB()
+	var perm db.Permission
+	if err := database.First(&perm, id).Error; err != nil {
+		respondQueryError(c, err, "权限")
+		return
+	}
+	err := database.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("permission_id=?", id).Delete(&db.RolePermission{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&perm).Error
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"error": "删除权限失败"})
+		return
+	}
+	c.JSON(200, gin.H{"message": "删除权限成功"})
+}
+
+/*角色-权限*/
+
+// 给角色添加权限，重复添加不报错
+// PUT /admin/roles/:id/permissions/:permissionId
+func AttachPermissionHandler(c *gin.Context) {
+	roleId, ok := parseIdParam(c, "id")
+	if !ok {
+		return
+	}
+	permissionId, ok := parseIdParam(c, "permissionId")
+	if !ok {
+		return
+	}
+	database := db.GetDB()
+	if err := database.First(&db.Role{}, roleId).Error; err != nil {
+		respondQueryError(c, err, "角色")
+		return
+	}
+	if err := database.First(&db.Permission{}, permissionId).Error; err != nil {
+		respondQueryError(c, err, "权限")
+		return
+	}
+	link := db.RolePermission{RoleId: roleId, PermissionId: permissionId}
+	if err := database.Clauses(clause.OnConflict{DoNothing: true}).Create(&link).Error; err != nil {
+		c.JSON(500, gin.H{"error": "添加权限失败"})
+		return
+	}
+	c.JSON(200, gin.H{"message": "添加权限成功"})
+}
+
+// 移除角色的权限
+// DELETE /admin/roles/:id/permissions/:permissionId
+func DetachPermissionHandler(c *gin.Context) {
+	roleId, ok := parseIdParam(c, "id")
+	if !ok {
+		return
+	}
+	permissionId, ok := parseIdParam(c, "permissionId")
+	if !ok {
+		return
+	}
+	result := db.GetDB().Where("role_id=? AND permission_id=?", roleId, permissionId).Delete(&db.RolePermission{})
+	if result.Error != nil {
+		c.JSON(500, gin.H{"error": "移除权限失败"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(404, gin.H{"error": "该角色没有这个权限"})
+		return
+	}
+	c.JSON(200, gin.H{"message": "移除权限成功"})
+}
+
+/*用户-角色*/
+
+// 授予用户角色，重复授予不报错
+// PUT /admin/users/:userId/roles/:roleId
+func GrantRoleHandler(c *gin.Context) {
+	userId, ok := parseIdParam(c, "userId")
+	if !ok {
+		return
+	}
+	roleId, ok := parseIdParam(c, "roleId")
+	if !ok {
+		return
+	}
+	database := db.GetDB()
+	if err := database.First(&db.User{}, userId).Error; err != nil {
+		respondQueryError(c, err, "用户")
+		return
+	}
+	if err := database.First(&db.Role{}, roleId).Error; err != nil {
+		respondQueryError(c, err, "角色")
+		return
+	}
+	link := db.UserRole{UserId: userId, RoleId: roleId}
+	if err := database.Clauses(clause.OnConflict{DoNothing: true}).Create(&link).Error; err != nil {
+		c.JSON(500, gin.H{"error": "授予角色失败"})
+		return
+	}
+	c.JSON(200, gin.H{"message": "授予角色成功"})
+}
+
+// 收回用户的角色
+// DELETE /admin/users/:userId/roles/:roleId
+func RevokeRoleHandler(c *gin.Context) {
+	userId, ok := parseIdParam(c, "userId")
+	if !ok {
+		return
+	}
+	roleId, ok := parseIdParam(c, "roleId")
+	if !ok {
+		return
+	}
+	result := db.GetDB().Where("user_id=? AND role_id=?", userId, roleId).Delete(&db.UserRole{})
+	if result.Error != nil {
+		c.JSON(500, gin.H{"error": "收回角色失败"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(404, gin.H{"error": "该用户没有这个角色"})
+		return
+	}
+	c.JSON(200, gin.H{"message": "收回角色成功"})
+}
+
+// 查询用户的角色和最终生效的权限(所有角色权限的并集)
+// GET /admin/users/:userId/permissions
+func GetUserPermissionsHandler(c *gin.Context) {
+	userId, ok := parseIdParam(c, "userId")
+	if !ok {
+		return
+	}
+	var user db.User
+	if err := db.GetDB().First(&user, userId).Error; err != nil {
+		respondQueryError(c, err, "用户")
+		return
+	}
+	roles, permissions, err := db.GetUserRolesAndPermissions(userId)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "获取用户角色与权限失败"})
+		return
+	}
+	c.JSON(200, gin.H{
+		"user_id":     user.ID,
+		"username":    user.Name,
+		"roles":       roles,
+		"permissions": permissions,
+	})
+}
@@ -0,0 +1,154 @@
+package admin
+
+import (
+	"Project01/db"
+	"Project01/internal/dbtest"
+	"Project01/login"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 和main.go中的管理员路由组相同，用户身份直接放入上下文
+func adminRouter(p *login.Principal) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(func(c *gin.Context) { login.SetCurrentUser(c, p) })
+	g := r.Group("/admin", login.RequirePermission("rbac", "manage"))
+	g.GET("/roles", ListRolesHandler)
+	g.POST("/roles", CreateRoleHandler)
+	g.PATCH("/roles/:id", UpdateRoleHandler)
+	g.DELETE("/roles/:id", DeleteRoleHandler)
+	g.PUT("/roles/:id/permissions/:permissionId", AttachPermissionHandler)
+	g.DELETE("/roles/:id/permissions/:permissionId", DetachPermissionHandler)
+	g.GET("/permissions", ListPermissionsHandler)
+	g.POST("/permissions", CreatePermissionHandler)
+	g.PATCH("/permissions/:id", UpdatePermissionHandler)
+	g.DELETE("/permissions/:id", DeletePermissionHandler)
+	g.PUT("/users/:userId/roles/:roleId", GrantRoleHandler)
+	g.DELETE("/users/:userId/roles/:roleId", RevokeRoleHandler)
+	g.GET("/users/:userId/permissions", GetUserPermissionsHandler)
+	return r
+}
+
+type adminClient struct {
+	t *testing.T
+	r *gin.Engine
+}
+
+// 发送请求，检查状态码，返回解析后的响应体
+func (a adminClient) do(method, path, body string, code int) map[string]interface{} {
+	a.t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	a.r.ServeHTTP(w, req)
+	if w.Code != code {
+		a.t.Fatalf("%s %s：状态码 = %d, want %d, %s", method, path, w.Code, code, w.Body.String())
+	}
+	var reply map[string]interface{}
+	_ = json.Unmarshal(w.Body.Bytes(), &reply)
+	return reply
+}
+
+func TestAdminRequiresPermission(t *testing.T) {
+	dbtest.Open(t)
+	user := adminClient{t, adminRouter(&login.Principal{UserId: 1, Permissions: []string{"video:*", "comment:*"}})}
+	user.do("GET", "/admin/roles", "", 403)
+	user.do("POST", "/admin/roles", `{"name":"editor"}`, 403)
+}
+
+func TestAdminRBAC(t *testing.T) {
+	database := dbtest.Open(t)
+	bob := db.User{Name: "bob"}
+	if err := database.Create(&bob).Error; err != nil {
+		t.Fatal(err)
+	}
+	a := adminClient{t, adminRouter(&login.Principal{UserId: 99, Permissions: []string{"*:*"}})}
+
+	//角色
+	role := a.do("POST", "/admin/roles", `{"name":" editor ","description":"编辑"}`, 201)
+	if role["name"] != "editor" {
+		t.Errorf("角色名 = %v", role["name"])
+	}
+	roleId := uint64(role["id"].(float64))
+	a.do("POST", "/admin/roles", `{"name":"editor"}`, 409)
+	a.do("POST", "/admin/roles", `{"name":"  "}`, 400)
+	a.do("PATCH", fmt.Sprintf("/admin/roles/%d", roleId), `{"description":"编辑视频"}`, 200)
+	a.do("PATCH", "/admin/roles/999", `{"description":"x"}`, 404)
+
+	//权限
+	perm := a.do("POST", "/admin/permissions", `{"name":"edit_video","resource":"video","action":"edit"}`, 201)
+	permId := uint64(perm["id"].(float64))
+	a.do("POST", "/admin/permissions", `{"name":"bad","resource":"video:x","action":"edit"}`, 400)
+	a.do("POST", "/admin/permissions", `{"name":"edit_video","resource":"video","action":"edit"}`, 409)
+	a.do("PATCH", fmt.Sprintf("/admin/permissions/%d", permId), `{"action":"a:b"}`, 400)
+
+	//角色-权限，用户-角色
+	rolePerm := fmt.Sprintf("/admin/roles/%d/permissions/%d", roleId, permId)
+	a.do("PUT", rolePerm, "", 200)
+	a.do("PUT", rolePerm, "", 200) //重复添加不报错
+	a.do("PUT", fmt.Sprintf("/admin/roles/999/permissions/%d", permId), "", 404)
+	a.do("PUT", fmt.Sprintf("/admin/roles/%d/permissions/999", roleId), "", 404)
+	userRole := fmt.Sprintf("/admin/users/%d/roles/%d", bob.ID, roleId)
+	a.do("PUT", userRole, "", 200)
+	a.do("PUT", fmt.Sprintf("/admin/users/999/roles/%d", roleId), "", 404)
+	reply := a.do("GET", fmt.Sprintf("/admin/users/%d/permissions", bob.ID), "", 200)
+	if fmt.Sprint(reply["roles"]) != "[editor]" || fmt.Sprint(reply["permissions"]) != "[video:edit]" {
+		t.Errorf("bob的角色和权限 = %v %v", reply["roles"], reply["permissions"])
+	}
+
+	roles := a.do("GET", "/admin/roles", "", 200)["roles"].([]interface{})
+	found := false
+	for _, r := range roles {
+		r := r.(map[string]interface{})
+		if r["name"] == "editor" {
+			found = true
+			if perms := r["permissions"].([]interface{}); len(perms) != 1 {
+				t.Errorf("editor的权限 = %v", perms)
+			}
+		}
+	}
+	if !found {
+		t.Error("角色列表中没有editor")
+	}
+
+	a.do("DELETE", rolePerm, "", 200)
+	a.do("DELETE", rolePerm, "", 404)
+	a.do("DELETE", userRole, "", 200)
+	a.do("DELETE", userRole, "", 404)
+
+	//删除角色时删除它的关联
+	a.do("PUT", rolePerm, "", 200)
+	a.do("PUT", userRole, "", 200)
+	a.do("DELETE", fmt.Sprintf("/admin/roles/%d", roleId), "", 200)
+	var links int64
+	database.Model(&db.RolePermission{}).Where("role_id=?", roleId).Count(&links)
+	var grants int64
+	database.Model(&db.UserRole{}).Where("role_id=?", roleId).Count(&grants)
+	if links != 0 || grants != 0 {
+		t.Errorf("删除角色后还有%d个权限关联、%d个用户关联", links, grants)
+	}
+	a.do("DELETE", fmt.Sprintf("/admin/permissions/%d", permId), "", 200)
+	a.do("DELETE", fmt.Sprintf("/admin/permissions/%d", permId), "", 404)
+}
+
+// 内置角色不能改名和删除
+func TestAdminBuiltinRoles(t *testing.T) {
+	database := dbtest.Open(t)
+	a := adminClient{t, adminRouter(&login.Principal{UserId: 99, Permissions: []string{"rbac:manage"}})}
+	for name := range builtinRoles {
+		var role db.Role
+		if err := database.Where("name=?", name).First(&role).Error; err != nil {
+			t.Fatal(err)
+		}
+		path := fmt.Sprintf("/admin/roles/%d", role.ID)
+		a.do("PATCH", path, `{"name":"renamed"}`, 400)
+		a.do("DELETE", path, "", 400)
+		a.do("PATCH", path, `{"description":"可以改描述"}`, 200)
+	}
+}
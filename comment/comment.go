@@ -1,7 +1,9 @@
 package comment
 
 import (
+	"Project01/config"
 	"Project01/db"
+	"Project01/login"
 	"bufio"
 	"errors"
 	"os"
@@ -12,6 +14,14 @@ import (
 	"gorm.io/gorm"
 )
 
+// 敏感词文件路径，由Init从配置中设置
+var sensitiveWordsPath string
+
+// 初始化评论模块
+func Init(cfg config.CommentConfig) {
+	sensitiveWordsPath = cfg.SensitiveWordsPath
+}
+
 type PostCommentRequest struct {
 	//应该不需要手动写用户名或者用户id,应该从token中解析
 	//那视频id呢？能不能从上下文中获取？还是要自己定义？
@@ -32,34 +42,22 @@ type PostCommentReply struct {
 func PostCommentHandler(c *gin.Context) {
 	//1.解析客户端传过来的评论Json形式
 	var commentReq PostCommentRequest
-	userIdA, exists1 := c.Get("user_id") //"user_id"和"username"是从Claims来吗
-	usernameA, exists2 := c.Get("username")
-	if !exists1 || !exists2 {
-		c.JSON(500, gin.H{"error": "(评论模块)从jwt token中解析用户ID和用户名的过程失败，检查jwt中间件的逻辑"})
-		return
-	}
-	//类型断言和类型转换
-	userIdFloat64, ok := userIdA.(float64)
-	if !ok {
-		c.JSON(500, gin.H{"error": "(评论模块)userId类型转换失败"})
-		return
-	}
-	userId := uint64(userIdFloat64)
-
-	str, ok := usernameA.(string)
-	if !ok {
-		c.JSON(500, gin.H{"error": "(评论模块)username类型转换失败,username不是string"})
+	//用户ID和用户名从JWT中解析出来的用户身份中获取
+	user, err := login.CurrentUser(c)
+	if err != nil {
+		c.JSON(401, gin.H{"error": err.Error()})
 		return
 	}
-	username := str
-	//-------
-	commentReq.UserId = userId
-	commentReq.Username = username
-	err := c.ShouldBindJSON(&commentReq) //userId和username会被覆盖吗
+	userId := user.UserId
+	username := user.UserName
+	err = c.ShouldBindJSON(&commentReq)
 	if err != nil {
 		c.JSON(400, gin.H{"error": "参数错误"})
 		return
 	}
+	//绑定之后再赋值，防止被请求体里的同名字段覆盖
+	commentReq.UserId = userId
+	commentReq.Username = username
 	//敏感词过滤
 	commentReq.Content = replaceSenstiveWords(commentReq.Content)
 
@@ -99,19 +97,7 @@ func DeleteCommentHandler(c *gin.Context) {
 		c.JSON(400, gin.H{"error": "评论ID的string->uint64转换失败,客户端传的ID不合法"})
 		return
 	}
-	//2.校验当前客户端身份：只有评论的发布者和管理员才能删除
-	//获取当前用户id
-	rawUserId, exists := c.Get("user_id") //获取的是any类型的
-	if !exists {
-		c.JSON(500, gin.H{"error": "用户ID获取失败"})
-		return
-	}
-	userIdFloat64, ok := rawUserId.(float64)
-	if !ok {
-		c.JSON(500, gin.H{"error": "用户ID类型转换失败"})
-		return
-	}
-	userId := uint64(userIdFloat64)
+	//2.只有评论的发布者和有comment:delete权限的用户(管理员)才能删除，已经由路由上的RequirePermission校验过了
 	database := db.GetDB() //获取数据库句柄
 	var comment db.Comment //定义结构体变量，稍后查询结果会被填入这里
 	//先检查评论是否存在
@@ -124,14 +110,6 @@ func DeleteCommentHandler(c *gin.Context) {
 		}
 		return
 	}
-	//再检查角色
-	role, _ := c.Get("role")
-	userRole := role.(string)
-	//如果当前用户不是该评论发布者或者管理员角色，没有权限删除该评论
-	if comment.CommenterId != userId && userRole != "admin" && userRole != "moderator" {
-		c.JSON(403, gin.H{"error": "您无权限删除该评论"})
-		return
-	}
 
 	//3.删除评论
 	// result := database.Where("id=?", commentId).Delete(&db.Comment{}) //删除comments表上的commentId对应的一行
@@ -143,6 +121,24 @@ func DeleteCommentHandler(c *gin.Context) {
 	c.JSON(200, gin.H{"message": "删除评论成功"})
 }
 
+// 所有权判断：当前用户是不是路径参数:id对应评论的发布者，配合login.RequirePermission使用
+// 评论不存在时返回login.ErrResourceNotFound，由RequirePermission返回404
+func IsCommentOwner(c *gin.Context, p *login.Principal) (bool, error) {
+	commentId, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return false, nil
+	}
+	var comment db.Comment
+	err = db.GetDB().Select("commenter_id").Where("id=?", commentId).First(&comment).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return false, login.ErrResourceNotFound
+		}
+		return false, err
+	}
+	return comment.CommenterId == p.UserId, nil
+}
+
 // 敏感词替换
 func replaceSenstiveWords(comment string) string {
 	//文件中读取敏感词
@@ -174,7 +170,7 @@ func replaceSenstiveWords(comment string) string {
 }
 func readSensitiveWordsFromFile() ([]string, error) {
 	//1.打开文件，逐行扫描
-	file, err := os.Open("comment/senstiveWords.txt")
+	file, err := os.Open(sensitiveWordsPath)
 	if err != nil {
 		return nil, err
 	}
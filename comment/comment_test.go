@@ -0,0 +1,63 @@
+package comment
+
+import (
+	"Project01/db"
+	"Project01/internal/dbtest"
+	"Project01/login"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 和main.go中删除评论的路由相同，用户身份直接放入上下文
+func deleteRouter(p *login.Principal) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(func(c *gin.Context) { login.SetCurrentUser(c, p) })
+	r.DELETE("/comment/:id", login.RequirePermission("comment", "delete", IsCommentOwner), DeleteCommentHandler)
+	return r
+}
+
+func TestDeleteComment(t *testing.T) {
+	author := &login.Principal{UserId: 1, Permissions: []string{"comment:create"}}
+	other := &login.Principal{UserId: 2, Permissions: []string{"comment:create"}}
+	moderator := &login.Principal{UserId: 3, Permissions: []string{"comment:delete"}}
+	tests := []struct {
+		name string
+		user *login.Principal
+		id   string
+		code int
+	}{
+		{"发布者", author, "", 200},
+		{"其他用户", other, "", 403},
+		{"有comment:delete权限", moderator, "", 200},
+		{"评论不存在", other, "999", 404},
+		{"有权限时评论不存在", moderator, "999", 404},
+		{"ID不合法", moderator, "abc", 400},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dbtest.Open(t)
+			comment := db.Comment{VideoId: 1, CommenterId: author.UserId, Content: "hello"}
+			if err := db.GetDB().Create(&comment).Error; err != nil {
+				t.Fatal(err)
+			}
+			id := tt.id
+			if id == "" {
+				id = strconv.FormatUint(comment.ID, 10)
+			}
+			w := httptest.NewRecorder()
+			deleteRouter(tt.user).ServeHTTP(w, httptest.NewRequest("DELETE", "/comment/"+id, nil))
+			if w.Code != tt.code {
+				t.Fatalf("状态码 = %d, want %d, %s", w.Code, tt.code, w.Body.String())
+			}
+			var count int64
+			db.GetDB().Model(&db.Comment{}).Count(&count)
+			if deleted := count == 0; deleted != (tt.code == 200) {
+				t.Errorf("剩下%d条评论", count)
+			}
+		})
+	}
+}
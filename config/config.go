@@ -0,0 +1,493 @@
+package config
+
+//统一管理整个项目的配置，取代原来散落在各个包里的硬编码(DSN,MinIO账号,JWT密钥,监听地址等)
+//优先级(从低到高)：默认值 < 配置文件(YAML) < 环境变量 < 命令行参数
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// 整个项目的配置
+type Config struct {
+	Server    ServerConfig    `yaml:"server"`
+	Database  DatabaseConfig  `yaml:"database"`
+	Storage   StorageConfig   `yaml:"storage"`
+	JWT       JWTConfig       `yaml:"jwt"`
+	Comment   CommentConfig   `yaml:"comment"`
+	Upload    UploadConfig    `yaml:"upload"`
+	Streaming StreamingConfig `yaml:"streaming"`
+	Jobs      JobsConfig      `yaml:"jobs"`
+	Transcode TranscodeConfig `yaml:"transcode"`
+}
+
+// HTTP服务配置
+type ServerConfig struct {
+	Addr string `yaml:"addr"` //监听地址，如0.0.0.0:8080
+}
+
+// 数据库配置
+type DatabaseConfig struct {
+	//用户名：密码@tcp(主机：端口)/数据库名？charset=utf8mb4&parseTime=True&loc=Local
+	DSN string `yaml:"dsn"`
+	//启动时授予admin角色的用户名(用户需已注册)，用于初始化第一个管理员
+	AdminUsers []string `yaml:"admin_users"`
+}
+
+// 对象存储配置
+type StorageConfig struct {
+	Backend string `yaml:"backend"` //minio或local(本地磁盘，开发/CI用)
+	//local后端：对象存放的根目录
+	LocalRoot string `yaml:"local_root"`
+	//minio后端
+	Endpoint        string `yaml:"endpoint"`
+	AccessKeyID     string `yaml:"access_key_id"`
+	SecretAccessKey string `yaml:"secret_access_key"`
+	UseSSL          bool   `yaml:"use_ssl"`
+	Bucket          string `yaml:"bucket"` //存放视频的桶名
+	//预签名URL的有效期，客户端拿着URL直接上传分片/播放视频(只有minio后端支持)
+	PresignTTL time.Duration `yaml:"presign_ttl"`
+}
+
+// JWT配置
+type JWTConfig struct {
+	Secret          string        `yaml:"secret"`            //签名密钥
+	AccessTokenTTL  time.Duration `yaml:"access_token_ttl"`  //访问令牌有效期，如2h
+	RefreshTokenTTL time.Duration `yaml:"refresh_token_ttl"` //刷新令牌有效期，如720h
+}
+
+// 评论模块配置
+type CommentConfig struct {
+	SensitiveWordsPath string `yaml:"sensitive_words_path"` //敏感词文件路径
+}
+
+// 上传配置
+type UploadConfig struct {
+	ChunkSize uint64 `yaml:"chunk_size"` //分片上传时默认的分片大小(字节)，客户端可以在初始化时提议其他大小
+	//建议客户端同时上传的分片数
+	Concurrency uint64 `yaml:"concurrency"`
+	//允许上传的视频容器格式：mp4,mov,webm,mkv,avi
+	AllowedContainers []string `yaml:"allowed_containers"`
+	MaxSize           uint64   `yaml:"max_size"` //单个视频的默认大小上限(字节)
+	//按角色设置的大小上限，用户有多个角色时取最大值，没有配置的角色用max_size
+	RoleMaxSizes map[string]uint64 `yaml:"role_max_sizes"`
+	//上传会话超过这个时间没有进度就视为过期，由后台任务每隔JanitorInterval清理一次
+	SessionTTL      time.Duration `yaml:"session_ttl"`
+	JanitorInterval time.Duration `yaml:"janitor_interval"`
+}
+
+// 自适应码率播放配置：上传完成后把MP4/MOV打包成HLS分段
+type StreamingConfig struct {
+	Enabled         bool          `yaml:"enabled"`          //关闭后只能播放原始文件
+	SegmentDuration time.Duration `yaml:"segment_duration"` //目标分段时长，实际在关键帧处切分
+}
+
+// 后台任务(打包、转码)配置，任务保存在任务表里，服务重启后继续执行
+type JobsConfig struct {
+	Workers      uint64        `yaml:"workers"`       //同时执行的任务数
+	PollInterval time.Duration `yaml:"poll_interval"` //没有任务时多久查一次任务表
+	//单个任务的最长执行时间，超过这个时间仍是running的任务(如服务重启时中断的)会被重新排队
+	Timeout     time.Duration `yaml:"timeout"`
+	MaxAttempts uint64        `yaml:"max_attempts"` //最多执行几次，之后标记为failed
+}
+
+// 转码配置：上传完成后把视频转成多个分辨率的MP4
+type TranscodeConfig struct {
+	Enabled    bool              `yaml:"enabled"`
+	Transcoder string            `yaml:"transcoder"`  //ffmpeg，或noop(不转码，直接复制原文件，测试用)
+	FFmpegPath string            `yaml:"ffmpeg_path"` //ffmpeg可执行文件，不是绝对路径时从PATH中查找
+	Renditions []RenditionConfig `yaml:"renditions"`
+}
+
+// 一种转码规格
+type RenditionConfig struct {
+	Name         string `yaml:"name"`          //如720p，也是播放时选择规格用的名字
+	Height       int    `yaml:"height"`        //输出高度，宽度按比例缩放；原视频不够高时跳过
+	VideoBitrate string `yaml:"video_bitrate"` //ffmpeg的码率写法，如2800k
+	AudioBitrate string `yaml:"audio_bitrate"` //如128k
+}
+
+// S3协议规定除最后一片外，每个分片最小5MB，最大5GB，一次multipart upload最多10000个分片
+const (
+	MinChunkSize = 5 * 1024 * 1024
+	MaxChunkSize = 5 * 1024 * 1024 * 1024
+	MaxParts     = 10000
+)
+
+// 支持识别的视频容器格式
+var KnownContainers = map[string]bool{"mp4": true, "mov": true, "webm": true, "mkv": true, "avi": true}
+
+// 原来代码里写死的JWT密钥，已经公开在仓库历史里，不能再使用
+const devJWTSecret = "kirakira_dokidoki"
+
+// 默认配置。数据库DSN、MinIO账号和JWT密钥没有默认值，必须在配置文件或环境变量中给出
+// 本地开发用的值见config.example.yaml
+func Default() *Config {
+	return &Config{
+		Server: ServerConfig{Addr: "0.0.0.0:8080"},
+		Storage: StorageConfig{
+			Backend:    "minio",
+			LocalRoot:  "data/objects",
+			Endpoint:   "localhost:9000",
+			UseSSL:     false,
+			Bucket:     "videos",
+			PresignTTL: 15 * time.Minute,
+		},
+		JWT: JWTConfig{
+			AccessTokenTTL:  2 * time.Hour,
+			RefreshTokenTTL: 30 * 24 * time.Hour,
+		},
+		Comment: CommentConfig{SensitiveWordsPath: "comment/senstiveWords.txt"},
+		Upload: UploadConfig{
+			ChunkSize:         MinChunkSize,
+			Concurrency:       4,
+			AllowedContainers: []string{"mp4", "mov", "webm", "mkv", "avi"},
+			MaxSize:           2 * 1024 * 1024 * 1024,                              //2GB
+			RoleMaxSizes:      map[string]uint64{"admin": 20 * 1024 * 1024 * 1024}, //20GB
+			SessionTTL:        24 * time.Hour,
+			JanitorInterval:   10 * time.Minute,
+		},
+		Streaming: StreamingConfig{
+			Enabled:         true,
+			SegmentDuration: 6 * time.Second,
+		},
+		Jobs: JobsConfig{
+			Workers:      2,
+			PollInterval: 5 * time.Second,
+			Timeout:      2 * time.Hour,
+			MaxAttempts:  3,
+		},
+		Transcode: TranscodeConfig{
+			Enabled:    true,
+			Transcoder: "ffmpeg",
+			FFmpegPath: "ffmpeg",
+			Renditions: []RenditionConfig{
+				{Name: "1080p", Height: 1080, VideoBitrate: "5000k", AudioBitrate: "192k"},
+				{Name: "720p", Height: 720, VideoBitrate: "2800k", AudioBitrate: "128k"},
+				{Name: "480p", Height: 480, VideoBitrate: "1400k", AudioBitrate: "128k"},
+			},
+		},
+	}
+}
+
+// 加载配置：默认值 -> 配置文件 -> 环境变量 -> 命令行参数，最后校验
+// args一般传os.Args[1:]
+func Load(args []string) (*Config, error) {
+	cfg := Default()
+
+	//命令行参数。先解析出来，因为配置文件路径本身也可以由命令行指定
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	configPath := fs.String("config", "", "配置文件路径(YAML)，默认读取当前目录的config.yaml(不存在则忽略)")
+	addr := fs.String("addr", "", "HTTP监听地址")
+	dsn := fs.String("dsn", "", "MySQL DSN")
+	backend := fs.String("storage-backend", "", "存储后端：minio或local")
+	endpoint := fs.String("storage-endpoint", "", "MinIO地址")
+	bucket := fs.String("storage-bucket", "", "MinIO桶名")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	//1.配置文件
+	path := *configPath
+	if path == "" {
+		path = os.Getenv("VP_CONFIG")
+	}
+	explicit := path != "" //显式指定的配置文件必须存在
+	if path == "" {
+		path = "config.yaml"
+	}
+	if err := loadFile(cfg, path, explicit); err != nil {
+		return nil, err
+	}
+
+	//2.环境变量
+	if err := applyEnv(cfg); err != nil {
+		return nil, err
+	}
+
+	//3.命令行参数(只覆盖显式给出的)
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "addr":
+			cfg.Server.Addr = *addr
+		case "dsn":
+			cfg.Database.DSN = *dsn
+		case "storage-backend":
+			cfg.Storage.Backend = *backend
+		case "storage-endpoint":
+			cfg.Storage.Endpoint = *endpoint
+		case "storage-bucket":
+			cfg.Storage.Bucket = *bucket
+		}
+	})
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// 读取YAML配置文件，覆盖到cfg上(文件中没写的字段保留原值)
+func loadFile(cfg *Config, path string, mustExist bool) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) && !mustExist {
+			return nil
+		}
+		return fmt.Errorf("读取配置文件%s失败：%w", path, err)
+	}
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return fmt.Errorf("解析配置文件%s失败：%w", path, err)
+	}
+	return nil
+}
+
+// 环境变量覆盖，统一以VP_开头
+func applyEnv(cfg *Config) error {
+	strVars := map[string]*string{
+		"VP_SERVER_ADDR":                  &cfg.Server.Addr,
+		"VP_DATABASE_DSN":                 &cfg.Database.DSN,
+		"VP_STORAGE_BACKEND":              &cfg.Storage.Backend,
+		"VP_STORAGE_LOCAL_ROOT":           &cfg.Storage.LocalRoot,
+		"VP_STORAGE_ENDPOINT":             &cfg.Storage.Endpoint,
+		"VP_STORAGE_ACCESS_KEY_ID":        &cfg.Storage.AccessKeyID,
+		"VP_STORAGE_SECRET_ACCESS_KEY":    &cfg.Storage.SecretAccessKey,
+		"VP_STORAGE_BUCKET":               &cfg.Storage.Bucket,
+		"VP_JWT_SECRET":                   &cfg.JWT.Secret,
+		"VP_COMMENT_SENSITIVE_WORDS_PATH": &cfg.Comment.SensitiveWordsPath,
+		"VP_TRANSCODE_TRANSCODER":         &cfg.Transcode.Transcoder,
+		"VP_TRANSCODE_FFMPEG_PATH":        &cfg.Transcode.FFmpegPath,
+	}
+	for name, field := range strVars {
+		if v, ok := os.LookupEnv(name); ok {
+			*field = v
+		}
+	}
+	//逗号分隔的用户名列表
+	if v, ok := os.LookupEnv("VP_DATABASE_ADMIN_USERS"); ok {
+		cfg.Database.AdminUsers = nil
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				cfg.Database.AdminUsers = append(cfg.Database.AdminUsers, name)
+			}
+		}
+	}
+	boolVars := map[string]*bool{
+		"VP_STORAGE_USE_SSL":   &cfg.Storage.UseSSL,
+		"VP_STREAMING_ENABLED": &cfg.Streaming.Enabled,
+		"VP_TRANSCODE_ENABLED": &cfg.Transcode.Enabled,
+	}
+	for name, field := range boolVars {
+		if v, ok := os.LookupEnv(name); ok {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return fmt.Errorf("环境变量%s不是合法的布尔值：%w", name, err)
+			}
+			*field = b
+		}
+	}
+	durVars := map[string]*time.Duration{
+		"VP_JWT_ACCESS_TOKEN_TTL":       &cfg.JWT.AccessTokenTTL,
+		"VP_JWT_REFRESH_TOKEN_TTL":      &cfg.JWT.RefreshTokenTTL,
+		"VP_UPLOAD_SESSION_TTL":         &cfg.Upload.SessionTTL,
+		"VP_STORAGE_PRESIGN_TTL":        &cfg.Storage.PresignTTL,
+		"VP_STREAMING_SEGMENT_DURATION": &cfg.Streaming.SegmentDuration,
+		"VP_JOBS_POLL_INTERVAL":         &cfg.Jobs.PollInterval,
+		"VP_JOBS_TIMEOUT":               &cfg.Jobs.Timeout,
+	}
+	for name, field := range durVars {
+		if v, ok := os.LookupEnv(name); ok {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return fmt.Errorf("环境变量%s不是合法的时长：%w", name, err)
+			}
+			*field = d
+		}
+	}
+	uintVars := map[string]*uint64{
+		"VP_UPLOAD_CHUNK_SIZE":  &cfg.Upload.ChunkSize,
+		"VP_UPLOAD_MAX_SIZE":    &cfg.Upload.MaxSize,
+		"VP_UPLOAD_CONCURRENCY": &cfg.Upload.Concurrency,
+		"VP_JOBS_WORKERS":       &cfg.Jobs.Workers,
+		"VP_JOBS_MAX_ATTEMPTS":  &cfg.Jobs.MaxAttempts,
+	}
+	for name, field := range uintVars {
+		if v, ok := os.LookupEnv(name); ok {
+			n, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				return fmt.Errorf("环境变量%s不是合法的整数：%w", name, err)
+			}
+			*field = n
+		}
+	}
+	return nil
+}
+
+// 启动时校验配置，把所有问题一次性报出来
+func (cfg *Config) Validate() error {
+	var errs []error
+	if cfg.Server.Addr == "" {
+		errs = append(errs, errors.New("server.addr不能为空"))
+	}
+	if cfg.Database.DSN == "" {
+		errs = append(errs, errors.New("database.dsn不能为空"))
+	}
+	switch cfg.Storage.Backend {
+	case "minio":
+		if cfg.Storage.Endpoint == "" {
+			errs = append(errs, errors.New("storage.endpoint不能为空"))
+		}
+		if cfg.Storage.AccessKeyID == "" || cfg.Storage.SecretAccessKey == "" {
+			errs = append(errs, errors.New("storage.access_key_id和storage.secret_access_key不能为空"))
+		}
+		//S3桶名规则：3~63个字符
+		if n := len(cfg.Storage.Bucket); n < 3 || n > 63 {
+			errs = append(errs, errors.New("storage.bucket长度必须在3~63之间"))
+		}
+	case "local":
+		if cfg.Storage.LocalRoot == "" {
+			errs = append(errs, errors.New("storage.local_root不能为空"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("storage.backend只能是minio或local，当前为%q", cfg.Storage.Backend))
+	}
+	//S3预签名URL最长有效7天
+	if cfg.Storage.PresignTTL <= 0 || cfg.Storage.PresignTTL > 7*24*time.Hour {
+		errs = append(errs, errors.New("storage.presign_ttl必须在0~168h之间"))
+	}
+	switch {
+	case cfg.JWT.Secret == "":
+		errs = append(errs, errors.New("jwt.secret不能为空(可以用VP_JWT_SECRET设置)"))
+	case cfg.JWT.Secret == devJWTSecret:
+		errs = append(errs, errors.New("jwt.secret不能使用公开过的默认密钥，请换成随机生成的密钥"))
+	case len(cfg.JWT.Secret) < 16:
+		errs = append(errs, errors.New("jwt.secret长度不能少于16"))
+	}
+	if cfg.JWT.AccessTokenTTL <= 0 {
+		errs = append(errs, errors.New("jwt.access_token_ttl必须大于0"))
+	}
+	if cfg.JWT.RefreshTokenTTL <= cfg.JWT.AccessTokenTTL {
+		errs = append(errs, errors.New("jwt.refresh_token_ttl必须大于jwt.access_token_ttl"))
+	}
+	if cfg.Comment.SensitiveWordsPath == "" {
+		errs = append(errs, errors.New("comment.sensitive_words_path不能为空"))
+	}
+	if cfg.Upload.ChunkSize < MinChunkSize || cfg.Upload.ChunkSize > MaxChunkSize {
+		errs = append(errs, fmt.Errorf("upload.chunk_size必须在%d~%d字节之间", MinChunkSize, uint64(MaxChunkSize)))
+	}
+	if cfg.Upload.Concurrency < 1 || cfg.Upload.Concurrency > 64 {
+		errs = append(errs, errors.New("upload.concurrency必须在1~64之间"))
+	}
+	if len(cfg.Upload.AllowedContainers) == 0 {
+		errs = append(errs, errors.New("upload.allowed_containers不能为空"))
+	}
+	for _, container := range cfg.Upload.AllowedContainers {
+		if !KnownContainers[container] {
+			errs = append(errs, fmt.Errorf("upload.allowed_containers中的%q不是支持的格式", container))
+		}
+	}
+	if cfg.Upload.SessionTTL <= 0 || cfg.Upload.JanitorInterval <= 0 {
+		errs = append(errs, errors.New("upload.session_ttl和upload.janitor_interval必须大于0"))
+	}
+	if cfg.Upload.MaxSize == 0 {
+		errs = append(errs, errors.New("upload.max_size必须大于0"))
+	}
+	if cfg.Streaming.SegmentDuration < time.Second || cfg.Streaming.SegmentDuration > time.Minute {
+		errs = append(errs, errors.New("streaming.segment_duration必须在1s~60s之间"))
+	}
+	if cfg.Jobs.Workers < 1 || cfg.Jobs.Workers > 32 {
+		errs = append(errs, errors.New("jobs.workers必须在1~32之间"))
+	}
+	if cfg.Jobs.PollInterval <= 0 || cfg.Jobs.Timeout <= 0 {
+		errs = append(errs, errors.New("jobs.poll_interval和jobs.timeout必须大于0"))
+	}
+	if cfg.Jobs.MaxAttempts < 1 {
+		errs = append(errs, errors.New("jobs.max_attempts必须大于0"))
+	}
+	errs = append(errs, cfg.Transcode.validate()...)
+	if len(errs) > 0 {
+		return fmt.Errorf("配置校验失败：%w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// 规格名会出现在对象名和URL参数里，只允许小写字母和数字
+var renditionNamePattern = regexp.MustCompile(`^[a-z0-9]{1,20}$`)
+
+// ffmpeg的码率写法：数字加可选的k/M
+var bitratePattern = regexp.MustCompile(`^[0-9]+[kM]?$`)
+
+// 转码配置的校验，关闭转码时不检查
+func (t *TranscodeConfig) validate() []error {
+	if !t.Enabled {
+		return nil
+	}
+	var errs []error
+	switch t.Transcoder {
+	case "ffmpeg":
+		if t.FFmpegPath == "" {
+			errs = append(errs, errors.New("transcode.ffmpeg_path不能为空"))
+		}
+	case "noop":
+	default:
+		errs = append(errs, fmt.Errorf("transcode.transcoder只能是ffmpeg或noop，当前为%q", t.Transcoder))
+	}
+	names := map[string]bool{}
+	for _, r := range t.Renditions {
+		if !renditionNamePattern.MatchString(r.Name) {
+			errs = append(errs, fmt.Errorf("transcode.renditions的名字%q只能包含小写字母和数字", r.Name))
+		}
+		if names[r.Name] {
+			errs = append(errs, fmt.Errorf("transcode.renditions的名字%q重复", r.Name))
+		}
+		names[r.Name] = true
+		//H.264要求宽高是偶数
+		if r.Height < 144 || r.Height > 4320 || r.Height%2 != 0 {
+			errs = append(errs, fmt.Errorf("transcode.renditions中%s的height必须是144~4320之间的偶数", r.Name))
+		}
+		if !bitratePattern.MatchString(r.VideoBitrate) || !bitratePattern.MatchString(r.AudioBitrate) {
+			errs = append(errs, fmt.Errorf("transcode.renditions中%s的码率格式错误，应当形如2800k", r.Name))
+		}
+	}
+	return errs
+}
+
+// 返回隐藏了密钥的配置(YAML格式)，用于启动时打印生效的配置
+func (cfg *Config) Redacted() string {
+	c := *cfg //拷贝一份，不改原配置
+	c.Database.DSN = redactDSN(c.Database.DSN)
+	c.Storage.SecretAccessKey = redact(c.Storage.SecretAccessKey)
+	c.JWT.Secret = redact(c.JWT.Secret)
+	out, err := yaml.Marshal(&c)
+	if err != nil {
+		return fmt.Sprintf("<配置序列化失败：%v>", err)
+	}
+	return string(out)
+}
+
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return "******"
+}
+
+// 隐藏DSN中的密码部分 user:password@tcp(...) -> user:******@tcp(...)
+func redactDSN(dsn string) string {
+	at := strings.LastIndex(dsn, "@")
+	if at < 0 {
+		return dsn
+	}
+	colon := strings.Index(dsn[:at], ":")
+	if colon < 0 {
+		return dsn
+	}
+	return dsn[:colon+1] + "******" + dsn[at:]
+}
@@ -0,0 +1,84 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+// 本地开发可以通过校验的配置
+func validConfig() *Config {
+	cfg := Default()
+	cfg.Database.DSN = "user:pass@tcp(127.0.0.1:3306)/test"
+	cfg.Storage.AccessKeyID = "access"
+	cfg.Storage.SecretAccessKey = "secret"
+	cfg.JWT.Secret = "0123456789abcdef0123456789abcdef"
+	return cfg
+}
+
+func TestValidateSecrets(t *testing.T) {
+	if err := validConfig().Validate(); err != nil {
+		t.Fatalf("validConfig：%v", err)
+	}
+	tests := []struct {
+		name   string
+		modify func(cfg *Config)
+		want   string
+	}{
+		{"JWT密钥为空", func(cfg *Config) { cfg.JWT.Secret = "" }, "jwt.secret不能为空"},
+		{"原来的默认密钥", func(cfg *Config) { cfg.JWT.Secret = devJWTSecret }, "公开过的默认密钥"},
+		{"JWT密钥太短", func(cfg *Config) { cfg.JWT.Secret = "short" }, "jwt.secret长度"},
+		{"没有DSN", func(cfg *Config) { cfg.Database.DSN = "" }, "database.dsn"},
+		{"没有MinIO账号", func(cfg *Config) { cfg.Storage.AccessKeyID = "" }, "storage.access_key_id"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := validConfig()
+			tt.modify(cfg)
+			err := cfg.Validate()
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Validate = %v, want包含%q", err, tt.want)
+			}
+		})
+	}
+	//本地存储不需要MinIO账号
+	cfg := validConfig()
+	cfg.Storage.Backend = "local"
+	cfg.Storage.AccessKeyID, cfg.Storage.SecretAccessKey = "", ""
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("local后端：%v", err)
+	}
+}
+
+// 默认配置里没有任何密钥，不写配置时启动失败
+func TestLoadRequiresSecrets(t *testing.T) {
+	t.Setenv("VP_CONFIG", "")
+	if _, err := Load(nil); err == nil || !strings.Contains(err.Error(), "jwt.secret不能为空") {
+		t.Fatalf("Load = %v", err)
+	}
+	t.Setenv("VP_DATABASE_DSN", "user:pass@tcp(127.0.0.1:3306)/test")
+	t.Setenv("VP_STORAGE_ACCESS_KEY_ID", "access")
+	t.Setenv("VP_STORAGE_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("VP_JWT_SECRET", "0123456789abcdef0123456789abcdef")
+	cfg, err := Load(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(cfg.Redacted(), "0123456789abcdef") {
+		t.Error("Redacted中出现了密钥")
+	}
+}
+
+// 示例配置可以解析，填上JWT密钥后通过校验
+func TestExampleConfig(t *testing.T) {
+	cfg := Default()
+	if err := loadFile(cfg, "../config.example.yaml", true); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.JWT.Secret != "" {
+		t.Error("示例配置不能带JWT密钥")
+	}
+	cfg.JWT.Secret = "0123456789abcdef0123456789abcdef"
+	if err := cfg.Validate(); err != nil {
+		t.Error(err)
+	}
+}
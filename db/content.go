@@ -0,0 +1,97 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// 视频内容表：按整个文件的SHA-256去重(秒传)
+// 内容相同的视频记录共享同一个存储对象，RefCount记录有多少条VideoInfo引用它，
+// 降到0时才能删除存储中的对象
+type VideoContent struct {
+	ID          uint64    `gorm:"primaryKey;autoIncrement"`
+	Sha256      string    `gorm:"uniqueIndex;size:64"`  //整个文件的SHA-256(十六进制)
+	ObjectKey   string    `gorm:"uniqueIndex;size:255"` //存储中的对象名
+	Size        int64     //字节为单位
+	ContentType string    `gorm:"size:100"` //上传时识别出的MIME类型
+	RefCount    int64     `gorm:"not null;default:0"`
+	CreatedTime time.Time `gorm:"autoCreateTime"`
+}
+
+// 等待删除的存储对象：删除视频时在同一个事务里登记，事务提交之后再删除存储中的对象和派生文件
+// 删除成功后去掉记录；失败(或者进程在中间退出)时留在表里，由后台清理任务重试
+type PendingDelete struct {
+	ID          uint64    `gorm:"primaryKey;autoIncrement"`
+	ObjectKey   string    `gorm:"size:255"`
+	CreatedTime time.Time `gorm:"autoCreateTime;index"`
+}
+
+// 查找内容并加行锁，找不到返回gorm.ErrRecordNotFound
+// 必须在事务中调用，锁一直持有到事务结束，防止和ReleaseContent并发时引用到正在删除的对象
+func lockContent(tx *gorm.DB, query string, args ...interface{}) (*VideoContent, error) {
+	var content VideoContent
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where(query, args...).First(&content).Error
+	if err != nil {
+		return nil, err
+	}
+	return &content, nil
+}
+
+// 秒传：按SHA-256和大小查找已有的内容，找到则引用计数加1
+// 找不到返回gorm.ErrRecordNotFound，需要正常上传
+func ReuseContent(tx *gorm.DB, sha256 string, size int64) (*VideoContent, error) {
+	content, err := lockContent(tx, "sha256=? AND size=?", sha256, size)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Model(content).Update("ref_count", gorm.Expr("ref_count+1")).Error; err != nil {
+		return nil, err
+	}
+	content.RefCount++
+	return content, nil
+}
+
+// 上传完成后登记内容，引用计数加1
+// 如果相同SHA-256的内容已经存在(两个人同时上传了同一个文件)，返回已有的内容，
+// 调用方应改为引用已有对象，并删除自己刚上传的对象
+func AcquireContent(tx *gorm.DB, content *VideoContent) (*VideoContent, error) {
+	//第一次查找+插入并发时，后插入的一方会违反唯一索引，再查一次即可
+	for attempt := 0; attempt < 2; attempt++ {
+		existing, err := ReuseContent(tx, content.Sha256, content.Size)
+		if err == nil {
+			return existing, nil
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, err
+		}
+		content.RefCount = 1
+		err = tx.Create(content).Error
+		if err == nil {
+			return content, nil
+		}
+		if !errors.Is(err, gorm.ErrDuplicatedKey) {
+			return nil, err
+		}
+	}
+	return nil, gorm.ErrDuplicatedKey
+}
+
+// 视频记录删除时释放对象的引用，返回存储中的对象是否可以删除
+// 没有登记过内容的对象(去重之前上传的)只被一条视频记录引用，直接可以删除
+func ReleaseContent(tx *gorm.DB, objectKey string) (bool, error) {
+	content, err := lockContent(tx, "object_key=?", objectKey)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return true, nil
+		}
+		return false, err
+	}
+	if content.RefCount > 1 {
+		return false, tx.Model(content).Update("ref_count", gorm.Expr("ref_count-1")).Error
+	}
+	return true, tx.Delete(content).Error
+}
@@ -0,0 +1,47 @@
+package db_test
+
+import (
+	"Project01/db"
+	"Project01/internal/dbtest"
+	"errors"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+// 同一内容每次登记引用计数加1，释放到0才可以删除对象
+func TestContentRefCount(t *testing.T) {
+	database := dbtest.Open(t)
+	first, err := db.AcquireContent(database, &db.VideoContent{Sha256: "aa", ObjectKey: "videos/1/a.mp4", Size: 10})
+	if err != nil || first.RefCount != 1 {
+		t.Fatalf("第一次登记 = %+v %v", first, err)
+	}
+	//另一个人上传了同样的文件：返回已有的内容
+	second, err := db.AcquireContent(database, &db.VideoContent{Sha256: "aa", ObjectKey: "videos/2/b.mp4", Size: 10})
+	if err != nil || second.ObjectKey != "videos/1/a.mp4" || second.RefCount != 2 {
+		t.Fatalf("第二次登记 = %+v %v", second, err)
+	}
+	//秒传要求大小也一致
+	if _, err := db.ReuseContent(database, "aa", 11); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("大小不同：err = %v", err)
+	}
+	if content, err := db.ReuseContent(database, "aa", 10); err != nil || content.RefCount != 3 {
+		t.Fatalf("秒传 = %+v %v", content, err)
+	}
+
+	for i, want := range []bool{false, false, true} {
+		release, err := db.ReleaseContent(database, "videos/1/a.mp4")
+		if err != nil || release != want {
+			t.Errorf("第%d次释放 = %v %v", i+1, release, err)
+		}
+	}
+	var count int64
+	database.Model(&db.VideoContent{}).Count(&count)
+	if count != 0 {
+		t.Error("引用计数为0的内容没有删除")
+	}
+	//没有登记过的对象(去重之前上传的)直接可以删除
+	if release, err := db.ReleaseContent(database, "videos/3/old.mp4"); err != nil || !release {
+		t.Errorf("没有登记的对象 = %v %v", release, err)
+	}
+}
@@ -2,6 +2,8 @@ package db
 
 //单独拆分出来，解决login.go和video.go循环引用的问题
 import (
+	"Project01/config"
+	"fmt"
 	"time"
 
 	"gorm.io/driver/mysql"
@@ -18,21 +20,89 @@ func GetDB() *gorm.DB {
 }
 
 // 连接mysql数据库
-func InitDB() {
-	//用户名：密码@tcp(主机：端口)/数据库名？charset=utf8mb4&parseTime=True&loc=Local"
-	dsn := "root:1234@tcp(127.0.0.1:3306)/go_project?charset=utf8mb4&parseTime=True&loc=Local" //DSN（data source name）
+func InitDB(cfg config.DatabaseConfig) {
+	//连接数据库 DSN（data source name）来自配置
+	if err := Open(mysql.Open(cfg.DSN), cfg.AdminUsers); err != nil {
+		panic(err.Error())
+	}
+}
+
+// 用指定的驱动打开数据库，完成迁移和默认角色权限的初始化
+// 正式环境是MySQL，测试用SQLite(见internal/dbtest)
+func Open(dialector gorm.Dialector, adminUsers []string) error {
 	var err error
-	//连接数据库
-	db, err = gorm.Open(mysql.Open(dsn), &gorm.Config{})
+	//TranslateError:把MySQL的唯一键冲突等错误转换成gorm.ErrDuplicatedKey，方便用errors.Is判断
+	db, err = gorm.Open(dialector, &gorm.Config{TranslateError: true})
 	if err != nil {
-		panic("数据库连接失败: " + err.Error())
+		return fmt.Errorf("数据库连接失败: %w", err)
 	}
 	//自动迁移，检查有没有名为users,videoInfos,comments的表(默认表名为结构体小写加复数)
 	//如果没有表，自动创建表。如果表已经存在，检查字段是否缺失，如果缺失则补上
 	//不会删除已有字段，不会修改字段类型
 	db.AutoMigrate(&User{}, &VideoInfo{}, &Comment{},
 		&Role{}, &Permission{}, &UserRole{}, &RolePermission{},
-		&UploadSession{}, &ChunkRecord{})
+		&UploadSession{}, &ChunkRecord{}, &VideoContent{},
+		&Job{}, &Rendition{}, &PendingDelete{},
+		&RefreshToken{}, &RevokedToken{}, &SeedRecord{})
+	if err := migrateVideoObjectKey(); err != nil {
+		return fmt.Errorf("迁移视频对象名失败: %w", err)
+	}
+	if err := migrateVideoStatus(); err != nil {
+		return fmt.Errorf("迁移视频处理状态失败: %w", err)
+	}
+	if err := migrateVideoProbe(); err != nil {
+		return fmt.Errorf("添加媒体信息探测任务失败: %w", err)
+	}
+	if err := migrateTusPartialKey(); err != nil {
+		return fmt.Errorf("迁移tus尾部对象名失败: %w", err)
+	}
+	//初始化默认的角色和权限
+	if err := SeedRBAC(adminUsers); err != nil {
+		return fmt.Errorf("初始化角色权限失败: %w", err)
+	}
+	return nil
+}
+
+// 以前视频直接以上传的文件名存放在存储中，file_name上有唯一索引
+// 现在对象名改为服务端生成的object_key：删除旧的唯一索引(AutoMigrate不会删除索引)，旧数据的object_key就是原来的文件名
+func migrateVideoObjectKey() error {
+	migrator := db.Migrator()
+	if migrator.HasIndex(&VideoInfo{}, "idx_video_infos_file_name") {
+		if err := migrator.DropIndex(&VideoInfo{}, "idx_video_infos_file_name"); err != nil {
+			return err
+		}
+	}
+	return db.Model(&VideoInfo{}).Where("object_key=''").
+		Update("object_key", gorm.Expr("file_name")).Error
+}
+
+// 有处理状态之前上传的视频都可以直接播放
+func migrateVideoStatus() error {
+	return db.Model(&VideoInfo{}).Where("status=''").Update("status", "ready").Error
+}
+
+// 有媒体信息之前上传的视频补一个探测任务，已经有探测任务的视频不再添加
+func migrateVideoProbe() error {
+	now := time.Now()
+	return db.Exec(`INSERT INTO jobs (video_id, type, rendition, status, attempts, error, run_after, created_time, updated_time)
+		SELECT v.id, 'probe', '', 'queued', 0, '', ?, ?, ? FROM video_infos v
+		WHERE NOT EXISTS (SELECT 1 FROM jobs j WHERE j.video_id=v.id AND j.type='probe')`, now, now, now).Error
+}
+
+// 以前tus上传的尾部对象名由分片编号和长度决定，没有记在会话里；进行中的tus上传补上原来的对象名
+func migrateTusPartialKey() error {
+	var sessions []UploadSession
+	if err := db.Where("protocol=? AND status=? AND tus_partial_key=? AND uploaded_size % chunk_size <> 0", "tus", "uploading", "").
+		Find(&sessions).Error; err != nil {
+		return err
+	}
+	for _, s := range sessions {
+		key := fmt.Sprintf("uploads/%s/tus_%d_%d", s.UploadId, s.UploadedSize/s.ChunkSize, s.UploadedSize%s.ChunkSize)
+		if err := db.Model(&UploadSession{}).Where("id=?", s.ID).Update("tus_partial_key", key).Error; err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // gorm自动创建对应sql语句
@@ -44,12 +114,31 @@ type User struct {
 }
 
 type VideoInfo struct {
-	ID         uint64    `gorm:"primaryKey;autoIncrement"`
-	FileName   string    `gorm:"uniqueIndex;size:150"` //存储在minIO中的名字 //建立唯一索引(非聚簇索引)
-	Title      string    `gorm:"size:150"`             //可修改的展示性的视频标题  150字符以内
-	Size       int64     //字节为单位
-	UploadTime time.Time `gorm:"autoCreateTime"`
-	UploaderId uint64    `gorm:"index"` //上传者的Id
+	ID          uint64    `gorm:"primaryKey;autoIncrement" json:"id"`
+	FileName    string    `gorm:"size:150" json:"file_name"`             //用户上传时的原始文件名，只用于展示
+	ObjectKey   string    `gorm:"index;size:255" json:"-"`               //存储中的对象名，由服务端生成，不对外暴露
+	Title       string    `gorm:"size:150" json:"title"`                 //可修改的展示性的视频标题  150字符以内
+	Description string    `gorm:"type:varchar(2000)" json:"description"` //可修改的视频简介 2000字符以内
+	Size        int64     `json:"size"`                                  //字节为单位
+	UploadTime  time.Time `gorm:"autoCreateTime" json:"upload_time"`
+	UploaderId  uint64    `gorm:"index" json:"uploader_id"` //上传者的Id
+	//HLS打包状态：空(没有打包)、processing、ready、failed、unsupported(不是MP4/MOV等)
+	HLSStatus string `gorm:"column:hls_status;size:20" json:"hls_status"`
+	//处理状态：uploaded(等待后台任务)、processing、ready(可以播放，打包和转码可能还没完成)、failed、blocked(被屏蔽)
+	Status                string     `gorm:"size:20;index" json:"status"`
+	StatusReason          string     `gorm:"type:varchar(2000)" json:"status_reason,omitempty"` //failed和blocked的原因
+	StatusUpdatedTime     *time.Time `json:"status_updated_time"`
+	ProcessingStartedTime *time.Time `json:"processing_started_time"` //读取媒体信息开始执行的时间
+	ProcessedTime         *time.Time `json:"processed_time"`          //读取媒体信息结束(ready或failed)的时间
+	//上传完成后由探测任务从文件中读出的媒体信息，不认识的格式为空
+	Container  string  `gorm:"size:20" json:"container"` //mp4、mov、webm、matroska
+	Duration   float64 `json:"duration"`                 //秒
+	Width      int     `json:"width"`
+	Height     int     `json:"height"`
+	VideoCodec string  `gorm:"size:50" json:"video_codec"` //如avc1.64001f、vp9
+	AudioCodec string  `gorm:"size:50" json:"audio_codec"` //如mp4a.40.2、opus
+	FrameRate  float64 `json:"frame_rate"`
+	Bitrate    int64   `json:"bitrate"` //平均码率，bit/s
 }
 
 type Comment struct {
@@ -64,71 +153,80 @@ type Comment struct {
 
 // 角色表
 type Role struct {
-	ID          uint64 `gorm:"primaryKey;autoIncrement"`
-	Name        string `gorm:"unique;size:50"` //1:user,2:admin,3:moderator
-	Description string `gorm:"size:200"`
+	ID          uint64 `gorm:"primaryKey;autoIncrement" json:"id"`
+	Name        string `gorm:"unique;size:50" json:"name"` //1:user,2:admin,3:moderator
+	Description string `gorm:"size:200" json:"description"`
 }
 
 // 权限表
 type Permission struct {
-	ID          uint64 `gorm:"primaryKey;autoIncrement"`
-	Name        string `gorm:"unique;size:50"` //1:delete_comment,2:delete_video,3:delete_account
-	Action      string `gorm:"size:50"`        //create,read,upload,delete
-	Description string `gorm:"size:200"`
-	Resource    string `gorm:"size:50"` //video,comment,account
+	ID          uint64 `gorm:"primaryKey;autoIncrement" json:"id"`
+	Name        string `gorm:"unique;size:50" json:"name"` //1:delete_comment,2:delete_video,3:delete_account
+	Action      string `gorm:"size:50" json:"action"`      //create,read,upload,delete,*(该资源的所有操作)
+	Description string `gorm:"size:200" json:"description"`
+	Resource    string `gorm:"size:50" json:"resource"` //video,comment,account,*(所有资源)
 }
 
 // 用户-角色关联表
+// (UserId,RoleId)联合唯一索引，同一个角色不会重复授予
 type UserRole struct {
 	ID     uint64 `gorm:"primaryKey;autoIncrement"`
-	UserId uint64 `gorm:"not null;index"`
-	RoleId uint64 `gorm:"not null;index"`
+	UserId uint64 `gorm:"not null;index;uniqueIndex:idx_user_role"`
+	RoleId uint64 `gorm:"not null;index;uniqueIndex:idx_user_role"`
 }
 
 // 角色-权限 关联表
+// (RoleId,PermissionId)联合唯一索引
 type RolePermission struct {
 	ID           uint64 `gorm:"primaryKey;autoIncrement"`
-	RoleId       uint64 `gorm:"not null;index"`
-	PermissionId uint64 `gorm:"not null;index"`
+	RoleId       uint64 `gorm:"not null;index;uniqueIndex:idx_role_permission"`
+	PermissionId uint64 `gorm:"not null;index;uniqueIndex:idx_role_permission"`
 }
 
-// 查询用户的 角色和权限 的函数
-func GetUserRolesAndPermissions(userId uint64) (string, []string, error) {
+// 查询用户的 角色和权限 的函数，一个用户可以有多个角色
+func GetUserRolesAndPermissions(userId uint64) ([]string, []string, error) {
 	//SELECT r.name from user_roles ur
 	// join roles r on r.id=ur.role_id
 	// WHERE ur.user_id=xxx;
-	var roleName string
+	var roleNames []string
 	err := db.Table("user_roles").
 		Select("r.name").
 		Joins("JOIN roles r ON r.id=user_roles.role_id").
 		Where("user_roles.user_id=?", userId).
-		Pluck("name", &roleName).Error
+		Pluck("name", &roleNames).Error
 	if err != nil {
-		return "", nil, err
+		return nil, nil, err
 	}
-	// SELECT DISTINCT p.name from user_roles ur
+	//权限以 资源:操作 的形式返回(如comment:delete)，由权限表的Resource和Action两列决定
+	//在Go里拼接，不用MySQL的CONCAT，测试用的SQLite也能执行
+	// SELECT DISTINCT p.resource,p.action from user_roles ur
 	// JOIN role_permissions rp ON ur.role_id=rp.role_id
 	// JOIN permissions p ON p.id=rp.permission_id
 	// WHERE ur.user_id=xxx;
-	var permissionNames []string
+	var rows []struct{ Resource, Action string }
 	err = db.Table("user_roles").
-		Select("DISTINCT p.name").
+		Distinct("p.resource", "p.action").
 		Joins("JOIN role_permissions rp ON user_roles.role_id=rp.role_id").
 		Joins("JOIN permissions p ON p.id=rp.permission_id").
 		Where("user_roles.user_id=?", userId).
-		Pluck("name", &permissionNames).Error
+		Scan(&rows).Error
 	if err != nil {
-		return "", nil, err
+		return nil, nil, err
+	}
+	permissionNames := make([]string, 0, len(rows))
+	for _, row := range rows {
+		permissionNames = append(permissionNames, row.Resource+":"+row.Action)
 	}
-	return roleName, permissionNames, nil
+	return roleNames, permissionNames, nil
 }
 
 // 给用户分配默认角色 user
-func AssignDefaultRole(userId uint64) error {
+// tx可以是事务，保证创建用户和分配角色同时成功或同时失败
+func AssignDefaultRole(tx *gorm.DB, userId uint64) error {
 	var userRoles Role //存放查找结果
 	//在角色表中查找名字为user的角色的那行数据 ,填充到userRoles这个结构体中
 	//SELECT * FROM roles WHERE name='user' LIMIT 1;
-	err := db.Where("name=?", "user").First(&userRoles).Error
+	err := tx.Where("name=?", "user").First(&userRoles).Error
 	if err != nil {
 		return err
 	}
@@ -138,22 +236,31 @@ func AssignDefaultRole(userId uint64) error {
 		RoleId: userRoles.ID,
 	}
 	//INSERT INTO user_roles (user_id,role_id) VALUES (?,?);
-	return db.Create(&userRoleAssignment).Error //插入这条新映射到用户-角色表中
+	return tx.Create(&userRoleAssignment).Error //插入这条新映射到用户-角色表中
 }
 
 // 实现上传时断点续传
 
 // 上传会话表
 type UploadSession struct {
-	ID           uint64 `gorm:"primaryKey;autoIncrement"`
-	UploadId     string `gorm:"uniqueIndex;size:100"` //UUID，标识一次上传任务（创建唯一索引）
-	UserId       uint64 `gorm:"index"`                //用户ID,创建索引
-	FileName     string `gorm:"size:255"`
-	TotalSize    uint64 //文件总大小
-	ChunkSize    uint64 `gorm:"default:5242880"` //分片大小默认5MB=5*1024*1024字节
-	TotalChunks  uint64 //总分片数
-	UploadedSize uint64 //已上传大小
-	Status       string `gorm:"size:20;default:'uploading'"` //uploading,completed,failed
+	ID        uint64 `gorm:"primaryKey;autoIncrement"`
+	UploadId  string `gorm:"uniqueIndex;size:100"` //UUID，标识一次上传任务（创建唯一索引）
+	UserId    uint64 `gorm:"index"`                //用户ID,创建索引
+	FileName  string `gorm:"size:255"`             //原始文件名
+	ObjectKey string `gorm:"size:255"`             //合并后的最终对象名，初始化时由服务端生成
+	//存储上的multipart upload的ID，初始化时创建，分片直接作为它的part上传
+	MultipartUploadId string `gorm:"size:255"`
+	TotalSize         uint64 //文件总大小
+	FileSha256        string `gorm:"size:64"`         //客户端提供的整个文件的SHA-256，为空表示不校验
+	ChunkSize         uint64 `gorm:"default:5242880"` //分片大小默认5MB=5*1024*1024字节
+	TotalChunks       uint64 //总分片数
+	UploadedSize      uint64 //已上传大小
+	Status            string `gorm:"size:20;default:'uploading'"` //uploading,merging(正在完成),completed,failed(过期或校验失败),cancelled(用户取消)
+	VideoId           uint64 //完成后创建的视频ID，重复调用完成接口时原样返回
+	//上传协议：chunk(按分片编号上传，/upload/*)或tus(按偏移量追加，/tus/*)，两种接口不能混用
+	Protocol string `gorm:"size:10;default:'chunk'"`
+	//tus上传不足一个分片的尾部暂存对象，和UploadedSize一起更新；为空表示偏移量正好在分片边界上
+	TusPartialKey string `gorm:"size:255"`
 	//创建时间，记录这个上传任务什么时候开始的
 	CreatedTime time.Time `gorm:"autoCreateTime"`
 	//更新时间：每次上传一个分片，都会更新UploadedSize,UpdatedTime会自动刷新，
@@ -169,11 +276,14 @@ type ChunkRecord struct {
 	UploadId   string `gorm:"index;uniqueIndex:idx_upload_chunk;size:100"` //UUID，上传会话的唯一标识，用来标明这个分片属于哪个会话
 	ChunkIndex uint64 `gorm:"index;uniqueIndex:idx_upload_chunk"`          //分片编号
 
-	Size        uint64    //分片大小
-	Status      string    `gorm:"default:pending"` //pending/uploading/completed/failed
-	S3Key       string    //分片在MinIO中的存储路径
-	StartByte   uint64    //分片起始字节
-	EndByte     uint64    //分片结束字节
-	Checksum    string    //校验和(MD5/SHA-256)
-	CreatedTime time.Time `gorm:"autoCreateTime"`
+	Size      uint64 //分片大小
+	Status    string `gorm:"default:pending"`      //pending/uploading/completed/failed
+	ETag      string `gorm:"column:etag;size:100"` //分片作为multipart upload的part上传后存储返回的ETag，完成上传时要用
+	StartByte uint64 //分片起始字节
+	EndByte   uint64 //分片结束字节
+	Checksum  string `gorm:"size:64"` //分片的SHA-256(十六进制)，上传时由服务端计算
+	//校验和不一致被服务端拒绝的part的ETag：损坏的数据仍然留在multipart upload里，
+	//同步客户端直传的分片时跳过这个ETag，直到分片重新上传
+	RejectedETag string    `gorm:"column:rejected_etag;size:100"`
+	CreatedTime  time.Time `gorm:"autoCreateTime"`
 }
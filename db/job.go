@@ -0,0 +1,110 @@
+package db
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// 后台任务表：读取媒体信息、打包HLS/DASH、转码等耗时操作在视频创建时入队，由video包的工作协程执行
+// 状态：queued -> running -> succeeded/failed，失败后还有重试次数时回到queued
+// 任务保存在数据库里，服务重启后没执行完的任务会继续执行
+type Job struct {
+	ID           uint64     `gorm:"primaryKey;autoIncrement" json:"id"`
+	VideoId      uint64     `gorm:"not null;index" json:"video_id"`
+	Type         string     `gorm:"size:20" json:"type"`      //probe(读取媒体信息)、package(打包HLS/DASH)、transcode(转码)
+	Rendition    string     `gorm:"size:20" json:"rendition"` //transcode任务的规格名，如720p
+	Status       string     `gorm:"size:20;index:idx_jobs_status_run_after" json:"status"`
+	Attempts     int        `gorm:"not null;default:0" json:"attempts"` //已经执行的次数
+	Error        string     `gorm:"type:varchar(2000)" json:"error"`    //最近一次失败的原因
+	RunAfter     time.Time  `gorm:"index:idx_jobs_status_run_after" json:"run_after"`
+	StartedTime  *time.Time `json:"started_time"`
+	FinishedTime *time.Time `json:"finished_time"`
+	CreatedTime  time.Time  `gorm:"autoCreateTime" json:"created_time"`
+	UpdatedTime  time.Time  `gorm:"autoUpdateTime" json:"updated_time"`
+}
+
+// 转码输出：视频的一种规格(分辨率/码率)
+// 相同内容的视频共享转码出来的对象，和原始对象一样在没有视频引用时才删除
+type Rendition struct {
+	ID          uint64    `gorm:"primaryKey;autoIncrement" json:"-"`
+	VideoId     uint64    `gorm:"not null;uniqueIndex:idx_video_rendition" json:"-"`
+	Name        string    `gorm:"size:20;uniqueIndex:idx_video_rendition" json:"name"`
+	ObjectKey   string    `gorm:"size:255" json:"-"`
+	Width       int       `json:"width"`
+	Height      int       `json:"height"`
+	Size        int64     `json:"size"`
+	CreatedTime time.Time `gorm:"autoCreateTime" json:"created_time"`
+}
+
+// 错误信息的长度限制，和Job.Error的列定义一致
+const maxJobError = 2000
+
+// 取出一个可以执行的任务并标记为running，没有任务时返回gorm.ErrRecordNotFound
+// SKIP LOCKED：多个工作协程(或多个服务实例)同时取任务时互不等待，也不会取到同一个任务
+func ClaimJob() (*Job, error) {
+	var job Job
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status=? AND run_after<=?", "queued", time.Now()).
+			Order("id").First(&job).Error
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		job.Status = "running"
+		job.Attempts++
+		job.StartedTime = &now
+		return tx.Model(&job).Updates(map[string]interface{}{
+			"status":       job.Status,
+			"attempts":     job.Attempts,
+			"started_time": now,
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// 记录任务的执行结果：成功；或者失败，次数没用完时延后retryDelay重新排队，否则标记为failed
+// 只更新仍是这次执行的任务，超时被重新排队(或者被删除)的任务不受影响
+func FinishJob(job *Job, runErr error, maxAttempts int, retryDelay time.Duration) error {
+	now := time.Now()
+	updates := map[string]interface{}{"status": "succeeded", "error": "", "finished_time": now}
+	if runErr != nil {
+		updates["error"] = truncateError(runErr.Error())
+		if job.Attempts < maxAttempts {
+			updates["status"] = "queued"
+			updates["run_after"] = now.Add(retryDelay)
+			updates["finished_time"] = nil
+		} else {
+			updates["status"] = "failed"
+		}
+	}
+	return db.Model(&Job{}).
+		Where("id=? AND status=? AND attempts=?", job.ID, "running", job.Attempts).
+		Updates(updates).Error
+}
+
+// 开始时间早于deadline仍是running的任务(执行它的进程可能已经退出)重新排队，次数用完的标记为failed
+func RequeueStaleJobs(deadline time.Time, maxAttempts int) (int64, error) {
+	result := db.Model(&Job{}).
+		Where("status=? AND started_time<?", "running", deadline).
+		Updates(map[string]interface{}{
+			"status":    gorm.Expr("CASE WHEN attempts>=? THEN ? ELSE ? END", maxAttempts, "failed", "queued"),
+			"error":     "任务执行超时",
+			"run_after": time.Now(),
+		})
+	return result.RowsAffected, result.Error
+}
+
+// 按字符截断，避免截断半个UTF-8字符
+func truncateError(s string) string {
+	runes := []rune(s)
+	if len(runes) > maxJobError {
+		return string(runes[:maxJobError])
+	}
+	return s
+}
@@ -0,0 +1,118 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// 默认权限，资源:操作
+// *表示通配，*:*即所有权限
+var defaultPermissions = []Permission{
+	{Name: "upload_video", Resource: "video", Action: "upload", Description: "上传视频"},
+	{Name: "read_video", Resource: "video", Action: "read", Description: "观看视频"},
+	{Name: "update_video", Resource: "video", Action: "update", Description: "修改任意视频信息"},
+	{Name: "delete_video", Resource: "video", Action: "delete", Description: "删除任意视频"},
+	{Name: "moderate_video", Resource: "video", Action: "moderate", Description: "屏蔽视频，查看未处理完成的视频"},
+	{Name: "create_comment", Resource: "comment", Action: "create", Description: "发布评论"},
+	{Name: "delete_comment", Resource: "comment", Action: "delete", Description: "删除任意评论"},
+	{Name: "delete_account", Resource: "account", Action: "delete", Description: "删除账号"},
+	{Name: "manage_rbac", Resource: "rbac", Action: "manage", Description: "管理角色和权限"},
+	{Name: "all", Resource: "*", Action: "*", Description: "所有权限"},
+}
+
+// 默认角色及其权限(按权限名)
+var defaultRoles = []struct {
+	Role        Role
+	Permissions []string
+}{
+	{
+		Role:        Role{Name: "user", Description: "普通用户"},
+		Permissions: []string{"upload_video", "read_video", "create_comment"},
+	},
+	{
+		Role: Role{Name: "moderator", Description: "版主，可以删除评论和视频"},
+		//能删除任意视频的角色也能修改任意视频的信息
+		Permissions: []string{"upload_video", "read_video", "create_comment", "delete_comment", "update_video", "delete_video", "moderate_video"},
+	},
+	{
+		Role:        Role{Name: "admin", Description: "管理员"},
+		Permissions: []string{"all"},
+	},
+}
+
+// 已经写入过的默认数据(角色的权限、初始管理员)，每一项只写入一次
+// 管理员之后通过RBAC管理接口去掉的权限或角色，重启时不会被恢复；代码里新增的默认权限仍然会写入
+type SeedRecord struct {
+	Name        string    `gorm:"primaryKey;size:191"` //如role_permission:moderator:delete_video、admin_user:alice
+	CreatedTime time.Time `gorm:"autoCreateTime"`
+}
+
+// name没有写入过时执行apply并记下name，已经写入过时什么都不做
+func seedOnce(tx *gorm.DB, name string, apply func() error) error {
+	result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&SeedRecord{Name: name})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil
+	}
+	return apply()
+}
+
+// 初始化默认的角色和权限，可以重复执行(已存在的不会重复创建，也不会覆盖管理员修改过的描述)
+// 角色的默认权限和初始管理员只在第一次写入(见SeedRecord)
+// adminUsers中的用户会被授予admin角色
+func SeedRBAC(adminUsers []string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		//1.权限
+		permissionIds := make(map[string]uint64)
+		for _, p := range defaultPermissions {
+			perm := p
+			//SELECT * FROM permissions WHERE name=? 找不到就INSERT
+			if err := tx.Where(Permission{Name: perm.Name}).Attrs(perm).FirstOrCreate(&perm).Error; err != nil {
+				return err
+			}
+			permissionIds[perm.Name] = perm.ID
+		}
+		//2.角色和角色-权限
+		roleIds := make(map[string]uint64)
+		for _, r := range defaultRoles {
+			role := r.Role
+			if err := tx.Where(Role{Name: role.Name}).Attrs(role).FirstOrCreate(&role).Error; err != nil {
+				return err
+			}
+			roleIds[role.Name] = role.ID
+			for _, name := range r.Permissions {
+				link := RolePermission{RoleId: role.ID, PermissionId: permissionIds[name]}
+				err := seedOnce(tx, "role_permission:"+role.Name+":"+name, func() error {
+					//INSERT IGNORE，依赖(RoleId,PermissionId)联合唯一索引
+					return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&link).Error
+				})
+				if err != nil {
+					return err
+				}
+			}
+		}
+		//3.初始管理员
+		for _, name := range adminUsers {
+			var user User
+			if err := tx.Where("name=?", name).First(&user).Error; err != nil {
+				if errors.Is(err, gorm.ErrRecordNotFound) {
+					continue //还没注册，下次启动再授予
+				}
+				return err
+			}
+			link := UserRole{UserId: user.ID, RoleId: roleIds["admin"]}
+			err := seedOnce(tx, "admin_user:"+name, func() error {
+				return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&link).Error
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,140 @@
+package db_test
+
+import (
+	"Project01/db"
+	"Project01/internal/dbtest"
+	"sort"
+	"strings"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+func roleId(t *testing.T, database *gorm.DB, name string) uint64 {
+	t.Helper()
+	var role db.Role
+	if err := database.Where("name=?", name).First(&role).Error; err != nil {
+		t.Fatal(err)
+	}
+	return role.ID
+}
+
+func countLinks(t *testing.T, database *gorm.DB, model any, query string, args ...any) int64 {
+	t.Helper()
+	var n int64
+	if err := database.Model(model).Where(query, args...).Count(&n).Error; err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// 管理员去掉的默认权限和撤销的初始管理员，重启(再次SeedRBAC)后不会被恢复
+func TestSeedRBACKeepsAdminChanges(t *testing.T) {
+	database := dbtest.Open(t, "alice")
+	alice := db.User{Name: "alice"}
+	if err := database.Create(&alice).Error; err != nil {
+		t.Fatal(err)
+	}
+	//注册之后再启动才会授予
+	if err := db.SeedRBAC([]string{"alice"}); err != nil {
+		t.Fatal(err)
+	}
+	moderator, admin := roleId(t, database, "moderator"), roleId(t, database, "admin")
+	var deleteVideo db.Permission
+	if err := database.Where("name=?", "delete_video").First(&deleteVideo).Error; err != nil {
+		t.Fatal(err)
+	}
+	if n := countLinks(t, database, &db.UserRole{}, "user_id=? AND role_id=?", alice.ID, admin); n != 1 {
+		t.Fatalf("alice的admin角色：%d", n)
+	}
+
+	//通过RBAC管理接口修改
+	if err := database.Where("role_id=? AND permission_id=?", moderator, deleteVideo.ID).Delete(&db.RolePermission{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := database.Where("user_id=? AND role_id=?", alice.ID, admin).Delete(&db.UserRole{}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.SeedRBAC([]string{"alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := countLinks(t, database, &db.RolePermission{}, "role_id=? AND permission_id=?", moderator, deleteVideo.ID); n != 0 {
+		t.Error("去掉的默认权限被恢复了")
+	}
+	if n := countLinks(t, database, &db.UserRole{}, "user_id=? AND role_id=?", alice.ID, admin); n != 0 {
+		t.Error("撤销的初始管理员被恢复了")
+	}
+	//其他默认权限不受影响
+	if n := countLinks(t, database, &db.RolePermission{}, "role_id=?", moderator); n != 6 {
+		t.Errorf("moderator的权限数 = %d", n)
+	}
+}
+
+// 默认角色中能删除视频的也能修改视频(PATCH /videos/:id需要video:update)
+func TestSeedRBACUpdateWithDelete(t *testing.T) {
+	database := dbtest.Open(t)
+	var roles []string
+	err := database.Model(&db.Role{}).
+		Joins("JOIN role_permissions ON role_permissions.role_id=roles.id").
+		Joins("JOIN permissions ON permissions.id=role_permissions.permission_id").
+		Where("permissions.name=?", "delete_video").Pluck("roles.name", &roles).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roles) == 0 {
+		t.Fatal("没有角色有delete_video")
+	}
+	for _, name := range roles {
+		n := countLinks(t, database, &db.RolePermission{},
+			"role_id=? AND permission_id=(SELECT id FROM permissions WHERE name=?)", roleId(t, database, name), "update_video")
+		if n != 1 {
+			t.Errorf("%s有delete_video但没有update_video", name)
+		}
+	}
+}
+
+// 代码里新增的默认权限(没有写入记录)在下次启动时写入
+func TestSeedRBACAddsNewDefaults(t *testing.T) {
+	database := dbtest.Open(t)
+	if err := database.Where("name LIKE ?", "role_permission:moderator:%").Delete(&db.SeedRecord{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	moderator := roleId(t, database, "moderator")
+	if err := database.Where("role_id=?", moderator).Delete(&db.RolePermission{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SeedRBAC(nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := countLinks(t, database, &db.RolePermission{}, "role_id=?", moderator); n != 7 {
+		t.Errorf("moderator的权限数 = %d", n)
+	}
+}
+
+// 用户的权限是所有角色权限的并集，去重后以 资源:操作 的形式返回
+func TestGetUserRolesAndPermissions(t *testing.T) {
+	database := dbtest.Open(t)
+	bob := db.User{Name: "bob"}
+	if err := database.Create(&bob).Error; err != nil {
+		t.Fatal(err)
+	}
+	for _, role := range []string{"user", "moderator"} {
+		if err := database.Create(&db.UserRole{UserId: bob.ID, RoleId: roleId(t, database, role)}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	roles, permissions, err := db.GetUserRolesAndPermissions(bob.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(roles)
+	sort.Strings(permissions)
+	if got := strings.Join(roles, ","); got != "moderator,user" {
+		t.Errorf("角色 = %s", got)
+	}
+	want := "comment:create,comment:delete,video:delete,video:moderate,video:read,video:update,video:upload"
+	if got := strings.Join(permissions, ","); got != want {
+		t.Errorf("权限 = %s, want %s", got, want)
+	}
+}
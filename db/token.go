@@ -0,0 +1,148 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// 刷新令牌表
+// 只保存令牌的SHA-256哈希，数据库泄露也拿不到可用的刷新令牌
+// 每次刷新都会作废旧令牌并签发新令牌(轮换)，同一次登录签发出来的所有令牌属于同一个家族(FamilyId)
+type RefreshToken struct {
+	ID        uint64     `gorm:"primaryKey;autoIncrement"`
+	UserId    uint64     `gorm:"not null;index"`
+	TokenHash string     `gorm:"uniqueIndex;size:64"` //刷新令牌的SHA-256(十六进制)
+	FamilyId  string     `gorm:"index;size:36"`       //UUID，登录时生成，轮换出来的令牌沿用
+	ExpiresAt time.Time  `gorm:"index"`
+	RevokedAt *time.Time //作废时间，为空表示仍然有效
+	//和这个刷新令牌一起签发的访问令牌，家族被作废时一并吊销
+	AccessJti       string `gorm:"size:36"`
+	AccessExpiresAt time.Time
+	//创建时间
+	CreatedTime time.Time `gorm:"autoCreateTime"`
+}
+
+// 已吊销的访问令牌(JWT)，按jti记录
+// 访问令牌本身无法作废，只能在鉴权中间件里查这张表
+type RevokedToken struct {
+	ID          uint64    `gorm:"primaryKey;autoIncrement"`
+	Jti         string    `gorm:"uniqueIndex;size:36"`
+	ExpiresAt   time.Time `gorm:"index"` //令牌原本的过期时间，过期之后这条记录由PurgeExpiredTokens清理
+	RevokedTime time.Time `gorm:"autoCreateTime"`
+}
+
+// 刷新令牌相关的错误
+var (
+	ErrRefreshTokenInvalid = errors.New("刷新令牌无效")
+	ErrRefreshTokenExpired = errors.New("刷新令牌已过期")
+	//已经被轮换掉的旧令牌又被拿来用了，说明令牌可能被盗，整个家族都会被作废
+	ErrRefreshTokenReused = errors.New("刷新令牌被重复使用")
+)
+
+// 保存新签发的刷新令牌
+func CreateRefreshToken(token *RefreshToken) error {
+	return db.Create(token).Error
+}
+
+// 轮换刷新令牌：校验旧令牌，作废它，并在同一个家族下保存新令牌
+// 整个过程在一个事务里，并对旧令牌加行锁，防止同一个令牌被并发刷新两次
+func RotateRefreshToken(oldHash string, next *RefreshToken) (*RefreshToken, error) {
+	var old RefreshToken
+	reused := false
+	err := db.Transaction(func(tx *gorm.DB) error {
+		//SELECT ... FOR UPDATE
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("token_hash=?", oldHash).First(&old).Error
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrRefreshTokenInvalid
+			}
+			return err
+		}
+		now := time.Now()
+		if old.RevokedAt != nil {
+			//重复使用：作废整个家族(不能回滚，所以返回nil让事务提交，外面再返回错误)
+			reused = true
+			return revokeFamily(tx, old.FamilyId, now)
+		}
+		if now.After(old.ExpiresAt) {
+			return ErrRefreshTokenExpired
+		}
+		if err := tx.Model(&old).Update("revoked_at", now).Error; err != nil {
+			return err
+		}
+		next.UserId = old.UserId
+		next.FamilyId = old.FamilyId
+		return tx.Create(next).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	if reused {
+		return nil, ErrRefreshTokenReused
+	}
+	return &old, nil
+}
+
+// 作废刷新令牌所在的整个家族(登出)，返回该令牌所属的用户ID
+func RevokeRefreshTokenFamily(tokenHash string) (uint64, error) {
+	var token RefreshToken
+	if err := db.Where("token_hash=?", tokenHash).First(&token).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return 0, ErrRefreshTokenInvalid
+		}
+		return 0, err
+	}
+	return token.UserId, revokeFamily(db, token.FamilyId, time.Now())
+}
+
+// 作废家族里的刷新令牌，并吊销和它们一起签发、还没过期的访问令牌
+func revokeFamily(tx *gorm.DB, familyId string, now time.Time) error {
+	if err := tx.Model(&RefreshToken{}).
+		Where("family_id=? AND revoked_at IS NULL", familyId).
+		Update("revoked_at", now).Error; err != nil {
+		return err
+	}
+	var tokens []RefreshToken
+	if err := tx.Select("access_jti", "access_expires_at").
+		Where("family_id=? AND access_jti<>'' AND access_expires_at>?", familyId, now).
+		Find(&tokens).Error; err != nil {
+		return err
+	}
+	if len(tokens) == 0 {
+		return nil
+	}
+	revoked := make([]RevokedToken, len(tokens))
+	for i, t := range tokens {
+		revoked[i] = RevokedToken{Jti: t.AccessJti, ExpiresAt: t.AccessExpiresAt}
+	}
+	return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&revoked).Error
+}
+
+// 删除已经过期的刷新令牌和访问令牌吊销记录，返回删除的条数
+// 刷新令牌要等一起签发的访问令牌也过期才删除，家族作废时还要靠它找到访问令牌
+func PurgeExpiredTokens(now time.Time) (int64, error) {
+	result := db.Where("expires_at<?", now).Delete(&RevokedToken{})
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	n := result.RowsAffected
+	result = db.Where("expires_at<? AND access_expires_at<?", now, now).Delete(&RefreshToken{})
+	return n + result.RowsAffected, result.Error
+}
+
+// 吊销访问令牌，重复吊销不报错
+func RevokeAccessToken(jti string, expiresAt time.Time) error {
+	return db.Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&RevokedToken{Jti: jti, ExpiresAt: expiresAt}).Error
+}
+
+// 查询访问令牌是否已被吊销
+func IsAccessTokenRevoked(jti string) (bool, error) {
+	var count int64
+	err := db.Model(&RevokedToken{}).Where("jti=?", jti).Count(&count).Error
+	return count > 0, err
+}
@@ -0,0 +1,103 @@
+package db_test
+
+import (
+	"Project01/db"
+	"Project01/internal/dbtest"
+	"errors"
+	"testing"
+	"time"
+)
+
+func newToken(hash, jti string, expiresAt time.Time) *db.RefreshToken {
+	return &db.RefreshToken{TokenHash: hash, ExpiresAt: expiresAt, AccessJti: jti, AccessExpiresAt: time.Now().Add(time.Hour)}
+}
+
+func TestRotateRefreshToken(t *testing.T) {
+	dbtest.Open(t)
+	future := time.Now().Add(time.Hour)
+	first := newToken("h1", "jti-1", future)
+	first.UserId, first.FamilyId = 7, "family-1"
+	if err := db.CreateRefreshToken(first); err != nil {
+		t.Fatal(err)
+	}
+	expired := newToken("expired", "jti-x", time.Now().Add(-time.Minute))
+	expired.UserId, expired.FamilyId = 7, "family-2"
+	if err := db.CreateRefreshToken(expired); err != nil {
+		t.Fatal(err)
+	}
+
+	//轮换：新令牌沿用用户和家族
+	old, err := db.RotateRefreshToken("h1", newToken("h2", "jti-2", future))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if old.UserId != 7 {
+		t.Errorf("UserId = %d", old.UserId)
+	}
+	var second db.RefreshToken
+	if err := db.GetDB().Where("token_hash=?", "h2").First(&second).Error; err != nil {
+		t.Fatal(err)
+	}
+	if second.UserId != 7 || second.FamilyId != "family-1" || second.RevokedAt != nil {
+		t.Errorf("新令牌 = %+v", second)
+	}
+
+	tests := []struct {
+		name string
+		hash string
+		err  error
+	}{
+		{"不存在", "unknown", db.ErrRefreshTokenInvalid},
+		{"已过期", "expired", db.ErrRefreshTokenExpired},
+		{"旧令牌被重复使用", "h1", db.ErrRefreshTokenReused},
+		{"家族作废后新令牌也不能用", "h2", db.ErrRefreshTokenReused},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := newToken("n"+string(rune('a'+i)), "", future)
+			if _, err := db.RotateRefreshToken(tt.hash, next); !errors.Is(err, tt.err) {
+				t.Errorf("err = %v, want %v", err, tt.err)
+			}
+		})
+	}
+
+	//重复使用时整个家族都被作废，一起签发的访问令牌被吊销；其他家族不受影响
+	var active int64
+	db.GetDB().Model(&db.RefreshToken{}).Where("family_id=? AND revoked_at IS NULL", "family-1").Count(&active)
+	if active != 0 {
+		t.Errorf("家族中还有%d个有效的刷新令牌", active)
+	}
+	for jti, want := range map[string]bool{"jti-1": true, "jti-2": true, "jti-x": false} {
+		if revoked, err := db.IsAccessTokenRevoked(jti); err != nil || revoked != want {
+			t.Errorf("IsAccessTokenRevoked(%s) = %v %v", jti, revoked, err)
+		}
+	}
+}
+
+func TestPurgeExpiredTokens(t *testing.T) {
+	dbtest.Open(t)
+	now := time.Now()
+	tokens := []*db.RefreshToken{
+		{TokenHash: "both-expired", ExpiresAt: now.Add(-time.Hour), AccessExpiresAt: now.Add(-time.Hour)},
+		{TokenHash: "access-alive", ExpiresAt: now.Add(-time.Hour), AccessExpiresAt: now.Add(time.Hour)},
+		{TokenHash: "alive", ExpiresAt: now.Add(time.Hour), AccessExpiresAt: now.Add(-time.Hour)},
+	}
+	for _, token := range tokens {
+		if err := db.CreateRefreshToken(token); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.RevokeAccessToken("old", now.Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.RevokeAccessToken("new", now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	n, err := db.PurgeExpiredTokens(now)
+	if err != nil || n != 2 {
+		t.Fatalf("PurgeExpiredTokens = %d %v", n, err)
+	}
+	if revoked, _ := db.IsAccessTokenRevoked("new"); !revoked {
+		t.Error("没过期的吊销记录被删除了")
+	}
+}
@@ -0,0 +1,30 @@
+package dbtest
+
+//测试用的数据库：每个测试一个临时目录里的SQLite文件，迁移和默认角色权限与正式环境相同
+//只在_test.go中引用，不会编译进服务端
+import (
+	"Project01/db"
+	"path/filepath"
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+)
+
+// 打开一个新的空数据库并设为db.GetDB()，adminUsers和配置database.admin_users相同
+// SQLite没有行锁，FOR UPDATE会被忽略；写操作之间由busy_timeout排队
+func Open(t testing.TB, adminUsers ...string) *gorm.DB {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.db")
+	dsn := "file:" + path + "?_pragma=busy_timeout(5000)&_pragma=foreign_keys(1)"
+	if err := db.Open(sqlite.Open(dsn), adminUsers); err != nil {
+		t.Fatal(err)
+	}
+	database := db.GetDB()
+	t.Cleanup(func() {
+		if sqlDB, err := database.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return database
+}
@@ -0,0 +1,92 @@
+package login
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// JWT的payload
+// 用结构体代替jwt.MapClaims：user_id直接解析成uint64，不会再经过float64丢失精度
+type Claims struct {
+	UserId      uint64   `json:"user_id"`
+	UserName    string   `json:"username"`
+	Roles       []string `json:"roles"`
+	Permissions []string `json:"permissions"`
+	//标准字段：exp过期时间，iat签发时间，jti令牌ID
+	jwt.RegisteredClaims
+}
+
+// 当前请求的用户身份，由AuthMiddleware解析令牌后放入上下文
+type Principal struct {
+	UserId      uint64
+	UserName    string
+	Roles       []string
+	Permissions []string //资源:操作，如comment:delete
+	IssuedAt    time.Time
+	ExpiresAt   time.Time
+	TokenId     string //jti
+}
+
+// Principal在gin上下文中的键
+const principalKey = "principal"
+
+// 上下文中没有用户身份(路由没有挂AuthMiddleware)
+var ErrNoPrincipal = errors.New("未登录")
+
+// 获取当前请求的用户身份，所有包都通过它拿用户ID、角色等信息
+func CurrentUser(c *gin.Context) (*Principal, error) {
+	v, exists := c.Get(principalKey)
+	if !exists {
+		return nil, ErrNoPrincipal
+	}
+	principal, ok := v.(*Principal)
+	if !ok {
+		return nil, ErrNoPrincipal
+	}
+	return principal, nil
+}
+
+// 把用户身份放入上下文，由AuthMiddleware在校验令牌之后调用；测试中可以直接设置
+func SetCurrentUser(c *gin.Context, p *Principal) {
+	c.Set(principalKey, p)
+}
+
+// 解析并校验令牌(签名、过期时间、签名算法)
+func parseToken(tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	//函数：输入token,输出密钥
+	keyFunction := func(token *jwt.Token) (interface{}, error) {
+		return jwtKey, nil
+	}
+	//只接受HS256，防止算法替换攻击
+	token, err := jwt.ParseWithClaims(tokenString, claims, keyFunction,
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, errors.New("无效的Token")
+	}
+	return claims, nil
+}
+
+// 由claims构造Principal
+func newPrincipal(claims *Claims) *Principal {
+	p := &Principal{
+		UserId:      claims.UserId,
+		UserName:    claims.UserName,
+		Roles:       claims.Roles,
+		Permissions: claims.Permissions,
+		TokenId:     claims.ID,
+	}
+	if claims.IssuedAt != nil {
+		p.IssuedAt = claims.IssuedAt.Time
+	}
+	if claims.ExpiresAt != nil {
+		p.ExpiresAt = claims.ExpiresAt.Time
+	}
+	return p
+}
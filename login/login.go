@@ -1,6 +1,7 @@
 package login
 
 import (
+	"Project01/config"
 	"Project01/db"
 	"errors"
 	"strings"
@@ -8,6 +9,7 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
 )
@@ -24,30 +26,53 @@ type Reply struct {
 	UserId    uint64 `json:"user_id"`
 	Token     string `json:"token"`      //JWT令牌
 	ExpiresAt int64  `json:"expires_at"` //令牌过期时间-UNIX时间戳
-	Message   string `json:"message"`    //响应信息
+	//刷新令牌，访问令牌过期后用它调用/token/refresh换取新令牌，不用再保存密码
+	RefreshToken     string `json:"refresh_token"`
+	RefreshExpiresAt int64  `json:"refresh_expires_at"` //刷新令牌过期时间-UNIX时间戳
+	Message          string `json:"message"`            //响应信息
 }
 
-// 定义JWT密钥
-var jwtKey = []byte("kirakira_dokidoki")
+// JWT密钥和令牌有效期，由Init从配置中设置
+var (
+	jwtKey          []byte
+	accessTokenTTL  time.Duration
+	refreshTokenTTL time.Duration
+)
+
+// 初始化登录模块
+func Init(cfg config.JWTConfig) {
+	jwtKey = []byte(cfg.Secret)
+	accessTokenTTL = cfg.AccessTokenTTL
+	refreshTokenTTL = cfg.RefreshTokenTTL
+}
+
+// 新访问令牌的jti和过期时间，先生成出来和刷新令牌一起保存
+func newAccessTokenId() (string, time.Time) {
+	return uuid.New().String(), time.Now().Add(accessTokenTTL)
+}
 
-// 生成JWT token
-func generateToken(user db.User, role string, permissions []string) (string, int64, error) {
-	expirationTime := time.Now().Add(time.Hour * 2).Unix()
+// 生成JWT token，jti和过期时间由newAccessTokenId生成
+func generateToken(user db.User, roles []string, permissions []string, jti string, expirationTime time.Time) (string, error) {
+	now := time.Now()
 	//创建claims
-	claims := jwt.MapClaims{
-		"user_id":     user.ID,
-		"username":    user.Name,
-		"role":        role,
-		"permissions": permissions,
-		"exp":         expirationTime,
+	claims := Claims{
+		UserId:      user.ID,
+		UserName:    user.Name,
+		Roles:       roles,
+		Permissions: permissions,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(expirationTime),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ID:        jti, //令牌ID(jti)，登出时按它吊销
+		},
 	}
 	//创建token
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	signedToken, err := token.SignedString(jwtKey)
 	//header为{"alg":"HS256","typ":"JWT"}
-	//payload为我写的claims(包含user_id,username,exp)
+	//payload为我写的claims(包含user_id,username,exp,jti等)
 	//signature为对前两段用密钥加密后生成的哈希值
-	return signedToken, expirationTime, err
+	return signedToken, err
 }
 
 // 登录处理函数
@@ -64,36 +89,15 @@ func LoginHandler(c *gin.Context) {
 	//获取数据库连接句柄
 	database := db.GetDB()
 	//查询用户是否存在，并且把数据库中对应的信息填到user结构体变量里面
+	//用户不存在时不再自动创建账号(需要先调用/register注册)
+	//用户不存在和密码错误返回同样的信息，避免被用来探测用户名
 	if err := database.Where("name=?", req.UserName).First(&user).Error; err != nil {
-
-		//如果用户不存在，就创建它
 		if errors.Is(err, gorm.ErrRecordNotFound) {
-			hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
-			if err != nil {
-				c.JSON(500, gin.H{"error": "密码加密失败"})
-				return
-			}
-			//创建新用户
-			user = db.User{
-				Name:     req.UserName,
-				Password: string(hashedPassword),
-			}
-			if err := database.Create(&user).Error; err != nil {
-				c.JSON(500, gin.H{"error": "创建用户失败"})
-				return
-			}
-			//【RBAC新增】给新用户分配默认角色user
-			if err := db.AssignDefaultRole(user.ID); err != nil {
-				c.JSON(500, gin.H{"error": "分配用户默认角色失败"})
-				return
-			}
-
+			c.JSON(401, gin.H{"error": "用户名或密码错误"})
 		} else {
-			//其他查询错误
 			c.JSON(500, gin.H{"error": "数据库查询错误"})
-			return
-
 		}
+		return
 	}
 	//相当于
 	//执行SQL查询 SELECT * FROM users WHERE name = req.UserName LIMIT 1,把结果填到user变量里面
@@ -106,29 +110,50 @@ func LoginHandler(c *gin.Context) {
 
 	//比较密码
 	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password)); err != nil {
-		c.JSON(401, gin.H{"error": "密码错误"})
+		c.JSON(401, gin.H{"error": "用户名或密码错误"})
 		return
 	}
 	//【RBAC新增】查询用户角色和权限
-	roleName, permissionNames, err := db.GetUserRolesAndPermissions(user.ID)
+	roleNames, permissionNames, err := db.GetUserRolesAndPermissions(user.ID)
 	if err != nil {
 		c.JSON(500, gin.H{"error": "获取用户角色与权限失败"})
 		return
 	}
 
 	//生成token
-	token, expiresAt, err := generateToken(user, roleName, permissionNames)
+	jti, accessExpiresAt := newAccessTokenId()
+	token, err := generateToken(user, roleNames, permissionNames, jti, accessExpiresAt)
 	if err != nil {
 		c.JSON(500, gin.H{"error": "生成令牌失效"})
 		return
 	}
+	//生成刷新令牌(新的令牌家族)
+	refreshToken, refreshExpiresAt, err := newRefreshToken()
+	if err != nil {
+		c.JSON(500, gin.H{"error": "生成刷新令牌失败"})
+		return
+	}
+	if err := db.CreateRefreshToken(&db.RefreshToken{
+		UserId:    user.ID,
+		TokenHash: hashToken(refreshToken),
+		FamilyId:  uuid.New().String(),
+		ExpiresAt: refreshExpiresAt,
+		//家族作废时一并吊销这个访问令牌
+		AccessJti:       jti,
+		AccessExpiresAt: accessExpiresAt,
+	}); err != nil {
+		c.JSON(500, gin.H{"error": "保存刷新令牌失败"})
+		return
+	}
 	//返回给客户端
 	c.JSON(200, Reply{
-		UserName:  user.Name,
-		UserId:    user.ID,
-		Token:     token,
-		ExpiresAt: expiresAt,
-		Message:   "登录成功",
+		UserName:         user.Name,
+		UserId:           user.ID,
+		Token:            token,
+		ExpiresAt:        accessExpiresAt.Unix(),
+		RefreshToken:     refreshToken,
+		RefreshExpiresAt: refreshExpiresAt.Unix(),
+		Message:          "登录成功",
 	})
 
 }
@@ -146,15 +171,9 @@ func AuthMiddleware() gin.HandlerFunc {
 			return
 		}
 		tokenString = strings.TrimPrefix(tokenString, "Bearer ")
-		claims := jwt.MapClaims{}
-		//函数：输入token,输出密钥
-		keyFunction := func(token *jwt.Token) (interface{}, error) {
-			//interface{}为任意类型
-			return jwtKey, nil
-		}
 		//验证
-		token, err := jwt.ParseWithClaims(tokenString, claims, keyFunction)
-		if err != nil || !token.Valid {
+		claims, err := parseToken(tokenString)
+		if err != nil {
 			if errors.Is(err, jwt.ErrTokenExpired) {
 				c.JSON(401, gin.H{"error": "Token已过期"})
 			} else {
@@ -163,12 +182,26 @@ func AuthMiddleware() gin.HandlerFunc {
 			c.Abort()
 			return
 		}
-		//把解析出来的用户名和用户id放到上下文中
-		c.Set("username", claims["username"])
-		c.Set("user_id", claims["user_id"])
-		//把角色和权限也放入
-		c.Set("role", claims["role"])
-		c.Set("permissions", claims["permissions"])
+		//检查令牌是否已被吊销(登出)
+		jti := claims.ID
+		if jti == "" || claims.UserId == 0 {
+			c.JSON(401, gin.H{"error": "无效的Token"})
+			c.Abort()
+			return
+		}
+		revoked, err := db.IsAccessTokenRevoked(jti)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "查询令牌状态失败"})
+			c.Abort()
+			return
+		}
+		if revoked {
+			c.JSON(401, gin.H{"error": "Token已失效"})
+			c.Abort()
+			return
+		}
+		//把解析出来的用户身份(用户id,用户名,角色,权限等)放到上下文中，通过CurrentUser获取
+		SetCurrentUser(c, newPrincipal(claims))
 		c.Next()
 	}
 }
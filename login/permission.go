@@ -0,0 +1,67 @@
+package login
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 所有权判断：当前用户是不是请求所操作的资源的所有者(比如评论的发布者)
+// 由各个业务包提供，只有在用户没有对应权限时才会调用；资源不存在时返回ErrResourceNotFound
+type OwnerFunc func(c *gin.Context, p *Principal) (bool, error)
+
+// 所有权判断时发现资源不存在，RequirePermission返回404而不是403
+var ErrResourceNotFound = errors.New("资源不存在")
+
+// 判断当前用户能否对资源执行某个操作
+// 权限的格式为 资源:操作，支持通配符：comment:* 表示评论的所有操作，*:* 表示所有权限
+func (p *Principal) Can(resource, action string) bool {
+	for _, perm := range p.Permissions {
+		res, act, ok := strings.Cut(perm, ":")
+		if !ok {
+			continue
+		}
+		if (res == resource || res == "*") && (act == action || act == "*") {
+			return true
+		}
+	}
+	return false
+}
+
+// 权限校验中间件，需要挂在AuthMiddleware之后
+// 用户拥有 resource:action 权限，或者owner判断出用户是资源的所有者，才放行；否则统一返回403
+func RequirePermission(resource, action string, owner ...OwnerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		principal, err := CurrentUser(c)
+		if err != nil {
+			c.JSON(401, gin.H{"error": err.Error()})
+			c.Abort()
+			return
+		}
+		if principal.Can(resource, action) {
+			c.Next()
+			return
+		}
+		//没有权限，再看是不是资源的所有者
+		for _, isOwner := range owner {
+			ok, err := isOwner(c, principal)
+			if errors.Is(err, ErrResourceNotFound) {
+				c.JSON(404, gin.H{"error": err.Error()})
+				c.Abort()
+				return
+			}
+			if err != nil {
+				c.JSON(500, gin.H{"error": "权限校验失败"})
+				c.Abort()
+				return
+			}
+			if ok {
+				c.Next()
+				return
+			}
+		}
+		c.JSON(403, gin.H{"error": "权限不足", "required": resource + ":" + action})
+		c.Abort()
+	}
+}
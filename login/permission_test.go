@@ -0,0 +1,79 @@
+package login
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCan(t *testing.T) {
+	tests := []struct {
+		name        string
+		permissions []string
+		resource    string
+		action      string
+		want        bool
+	}{
+		{"完全匹配", []string{"comment:delete"}, "comment", "delete", true},
+		{"操作不同", []string{"comment:create"}, "comment", "delete", false},
+		{"资源不同", []string{"video:delete"}, "comment", "delete", false},
+		{"操作通配", []string{"comment:*"}, "comment", "delete", true},
+		{"操作通配不跨资源", []string{"comment:*"}, "video", "delete", false},
+		{"资源通配", []string{"*:read"}, "video", "read", true},
+		{"资源通配不跨操作", []string{"*:read"}, "video", "delete", false},
+		{"全部通配", []string{"*:*"}, "rbac", "manage", true},
+		{"多个权限中有一个匹配", []string{"video:read", "comment:delete"}, "comment", "delete", true},
+		{"格式错误的权限被忽略", []string{"*", "comment"}, "comment", "delete", false},
+		{"没有权限", nil, "video", "read", false},
+		{"不做前缀匹配", []string{"video:up"}, "video", "upload", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Principal{Permissions: tt.permissions}
+			if got := p.Can(tt.resource, tt.action); got != tt.want {
+				t.Errorf("Can(%s, %s) = %v, want %v", tt.resource, tt.action, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequirePermission(t *testing.T) {
+	errBroken := errors.New("数据库错误")
+	owner := func(ok bool, err error) OwnerFunc {
+		return func(c *gin.Context, p *Principal) (bool, error) { return ok, err }
+	}
+	user := &Principal{UserId: 1, Permissions: []string{"comment:create"}}
+	tests := []struct {
+		name  string
+		user  *Principal
+		owner []OwnerFunc
+		code  int
+	}{
+		{"未登录", nil, nil, 401},
+		{"有权限", &Principal{Permissions: []string{"comment:*"}}, nil, 204},
+		{"没有权限", user, nil, 403},
+		{"是所有者", user, []OwnerFunc{owner(true, nil)}, 204},
+		{"不是所有者", user, []OwnerFunc{owner(false, nil)}, 403},
+		{"第二个判断是所有者", user, []OwnerFunc{owner(false, nil), owner(true, nil)}, 204},
+		{"资源不存在", user, []OwnerFunc{owner(false, ErrResourceNotFound)}, 404},
+		{"所有权判断失败", user, []OwnerFunc{owner(false, errBroken)}, 500},
+		{"有权限时不做所有权判断", &Principal{Permissions: []string{"*:*"}}, []OwnerFunc{owner(false, errBroken)}, 204},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gin.SetMode(gin.TestMode)
+			r := gin.New()
+			if tt.user != nil {
+				r.Use(func(c *gin.Context) { SetCurrentUser(c, tt.user) })
+			}
+			r.DELETE("/", RequirePermission("comment", "delete", tt.owner...), func(c *gin.Context) { c.Status(204) })
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("DELETE", "/", nil))
+			if w.Code != tt.code {
+				t.Errorf("状态码 = %d, want %d", w.Code, tt.code)
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package login
+
+import (
+	"Project01/db"
+	"errors"
+	"strings"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// 用于接受客户端的注册请求
+type RegisterRequest struct {
+	UserName string `json:"username" binding:"required"` //用户名：必填
+	Password string `json:"password" binding:"required"` //密码：必填
+}
+
+// 用户名和密码的长度限制
+// bcrypt最多只处理72字节，密码上限取64
+const (
+	minUserNameLen = 3
+	maxUserNameLen = 32
+	minPasswordLen = 8
+	maxPasswordLen = 64
+)
+
+// 保留用户名，不允许注册(比较时忽略大小写)
+var reservedUserNames = map[string]bool{
+	"admin":         true,
+	"administrator": true,
+	"root":          true,
+	"system":        true,
+	"moderator":     true,
+	"support":       true,
+	"null":          true,
+	"anonymous":     true,
+}
+
+// 用户已存在
+var errUserExists = errors.New("用户名已存在")
+
+// 校验用户名：3~32位，只能包含字母、数字和下划线，必须以字母开头，不能是保留名
+func validateUserName(name string) error {
+	if len(name) < minUserNameLen || len(name) > maxUserNameLen {
+		return errors.New("用户名长度必须在3~32之间")
+	}
+	for i, r := range name {
+		isLetter := r < unicode.MaxASCII && unicode.IsLetter(r)
+		isDigit := r >= '0' && r <= '9'
+		if i == 0 && !isLetter {
+			return errors.New("用户名必须以字母开头")
+		}
+		if !isLetter && !isDigit && r != '_' {
+			return errors.New("用户名只能包含字母、数字和下划线")
+		}
+	}
+	if reservedUserNames[strings.ToLower(name)] {
+		return errors.New("该用户名为保留名，不能注册")
+	}
+	return nil
+}
+
+// 校验密码：8~64位，至少包含字母和数字，不能和用户名相同
+func validatePassword(password, userName string) error {
+	if len(password) < minPasswordLen || len(password) > maxPasswordLen {
+		return errors.New("密码长度必须在8~64之间")
+	}
+	var hasLetter, hasDigit bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLetter(r):
+			hasLetter = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		case unicode.IsSpace(r):
+			return errors.New("密码不能包含空白字符")
+		}
+	}
+	if !hasLetter || !hasDigit {
+		return errors.New("密码必须同时包含字母和数字")
+	}
+	if strings.EqualFold(password, userName) {
+		return errors.New("密码不能和用户名相同")
+	}
+	return nil
+}
+
+// 注册处理函数
+// POST /register
+func RegisterHandler(c *gin.Context) {
+	var req RegisterRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "参数错误"})
+		return
+	}
+	//1.校验用户名和密码
+	if err := validateUserName(req.UserName); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validatePassword(req.Password, req.UserName); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "密码加密失败"})
+		return
+	}
+
+	//2.在一个事务里创建用户并分配默认角色，任何一步失败都会回滚，不会留下没有角色的用户
+	user := db.User{
+		Name:     req.UserName,
+		Password: string(hashedPassword),
+	}
+	err = db.GetDB().Transaction(func(tx *gorm.DB) error {
+		//先查一次重名，给出明确的409
+		var count int64
+		if err := tx.Model(&db.User{}).Where("name=?", req.UserName).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return errUserExists
+		}
+		if err := tx.Create(&user).Error; err != nil {
+			//并发注册同名用户时，由唯一索引兜底
+			if errors.Is(err, gorm.ErrDuplicatedKey) {
+				return errUserExists
+			}
+			return err
+		}
+		return db.AssignDefaultRole(tx, user.ID)
+	})
+	if err != nil {
+		if errors.Is(err, errUserExists) {
+			c.JSON(409, gin.H{"error": "用户名已存在"})
+		} else {
+			c.JSON(500, gin.H{"error": "注册失败"})
+		}
+		return
+	}
+
+	c.JSON(201, gin.H{
+		"message":  "注册成功",
+		"username": user.Name,
+		"user_id":  user.ID,
+	})
+}
@@ -0,0 +1,114 @@
+package login
+
+import (
+	"Project01/db"
+	"Project01/internal/dbtest"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func postJSON(handler gin.HandlerFunc, body string) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/", handler)
+	req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestValidateUserName(t *testing.T) {
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"alice", true},
+		{"Bob_2024", true},
+		{"abc", true},
+		{strings.Repeat("a", 32), true},
+		{"ab", false},
+		{strings.Repeat("a", 33), false},
+		{"1alice", false},
+		{"_alice", false},
+		{"ali ce", false},
+		{"ali-ce", false},
+		{"张三abc", false},
+		{"Admin", false}, //保留名不区分大小写
+		{"root", false},
+	}
+	for _, tt := range tests {
+		if err := validateUserName(tt.name); (err == nil) != tt.ok {
+			t.Errorf("validateUserName(%q) = %v", tt.name, err)
+		}
+	}
+}
+
+func TestValidatePassword(t *testing.T) {
+	tests := []struct {
+		password, user string
+		ok             bool
+	}{
+		{"passw0rd", "alice", true},
+		{"密码密码密码12", "alice", true},
+		{"pass0", "alice", false},
+		{strings.Repeat("a1", 33), "alice", false},
+		{"password", "alice", false},
+		{"12345678", "alice", false},
+		{"pass w0rd", "alice", false},
+		{"Alice123", "alice123", false}, //和用户名相同(忽略大小写)
+	}
+	for _, tt := range tests {
+		if err := validatePassword(tt.password, tt.user); (err == nil) != tt.ok {
+			t.Errorf("validatePassword(%q, %q) = %v", tt.password, tt.user, err)
+		}
+	}
+}
+
+func TestRegisterHandler(t *testing.T) {
+	dbtest.Open(t)
+	tests := []struct {
+		name string
+		body string
+		code int
+	}{
+		{"注册成功", `{"username":"alice","password":"passw0rd"}`, 201},
+		{"重名", `{"username":"alice","password":"passw0rd2"}`, 409},
+		{"缺少密码", `{"username":"bob"}`, 400},
+		{"不是JSON", `username=bob`, 400},
+		{"用户名不合法", `{"username":"b","password":"passw0rd"}`, 400},
+		{"密码太弱", `{"username":"bob","password":"password"}`, 400},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := postJSON(RegisterHandler, tt.body); w.Code != tt.code {
+				t.Errorf("状态码 = %d, want %d, %s", w.Code, tt.code, w.Body.String())
+			}
+		})
+	}
+
+	//密码只保存bcrypt哈希，新用户有默认的user角色
+	var user db.User
+	if err := db.GetDB().Where("name=?", "alice").First(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte("passw0rd")) != nil {
+		t.Error("保存的密码不是bcrypt哈希")
+	}
+	roles, _, err := db.GetUserRolesAndPermissions(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roles) != 1 || roles[0] != "user" {
+		t.Errorf("角色 = %v", roles)
+	}
+	var count int64
+	db.GetDB().Model(&db.User{}).Count(&count)
+	if count != 1 {
+		t.Errorf("用户数 = %d", count)
+	}
+}
@@ -0,0 +1,156 @@
+package login
+
+import (
+	"Project01/db"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 过期令牌的清理间隔
+const tokenPurgeInterval = time.Hour
+
+// 启动后台清理任务：定期删除已经过期的刷新令牌和访问令牌吊销记录，避免两张表一直增长
+func StartTokenJanitor(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(tokenPurgeInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if n, err := db.PurgeExpiredTokens(time.Now()); err != nil {
+					fmt.Printf("清理过期令牌失败：%v\n", err)
+				} else if n > 0 {
+					fmt.Printf("已清理%d条过期令牌记录\n", n)
+				}
+			}
+		}
+	}()
+}
+
+// 刷新令牌和登出请求
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+// 生成一个随机的刷新令牌(32字节随机数，base64url编码)，返回令牌和过期时间
+func newRefreshToken() (string, time.Time, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", time.Time{}, err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), time.Now().Add(refreshTokenTTL), nil
+}
+
+// 数据库里只存刷新令牌的SHA-256
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// 刷新令牌
+// POST /token/refresh
+// 用刷新令牌换一个新的访问令牌和一个新的刷新令牌，旧的刷新令牌随即作废
+func RefreshHandler(c *gin.Context) {
+	var req RefreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "参数错误"})
+		return
+	}
+	//1.生成新的刷新令牌，并轮换掉旧的
+	refreshToken, refreshExpiresAt, err := newRefreshToken()
+	if err != nil {
+		c.JSON(500, gin.H{"error": "生成刷新令牌失败"})
+		return
+	}
+	jti, accessExpiresAt := newAccessTokenId()
+	old, err := db.RotateRefreshToken(hashToken(req.RefreshToken), &db.RefreshToken{
+		TokenHash:       hashToken(refreshToken),
+		ExpiresAt:       refreshExpiresAt,
+		AccessJti:       jti,
+		AccessExpiresAt: accessExpiresAt,
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, db.ErrRefreshTokenExpired):
+			c.JSON(401, gin.H{"error": "刷新令牌已过期，请重新登录"})
+		case errors.Is(err, db.ErrRefreshTokenReused):
+			c.JSON(401, gin.H{"error": "刷新令牌已失效，请重新登录"})
+		case errors.Is(err, db.ErrRefreshTokenInvalid):
+			c.JSON(401, gin.H{"error": "无效的刷新令牌"})
+		default:
+			c.JSON(500, gin.H{"error": "刷新令牌失败"})
+		}
+		return
+	}
+
+	//2.重新查询用户和角色权限(可能已经变化)，签发新的访问令牌
+	var user db.User
+	if err := db.GetDB().Where("id=?", old.UserId).First(&user).Error; err != nil {
+		c.JSON(401, gin.H{"error": "用户不存在"})
+		return
+	}
+	roleNames, permissionNames, err := db.GetUserRolesAndPermissions(user.ID)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "获取用户角色与权限失败"})
+		return
+	}
+	token, err := generateToken(user, roleNames, permissionNames, jti, accessExpiresAt)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "生成令牌失效"})
+		return
+	}
+	c.JSON(200, Reply{
+		UserName:         user.Name,
+		UserId:           user.ID,
+		Token:            token,
+		ExpiresAt:        accessExpiresAt.Unix(),
+		RefreshToken:     refreshToken,
+		RefreshExpiresAt: refreshExpiresAt.Unix(),
+		Message:          "刷新成功",
+	})
+}
+
+// 登出
+// POST /logout
+// 作废刷新令牌所在的整个家族；如果请求头里带了访问令牌，把它也吊销
+func LogoutHandler(c *gin.Context) {
+	var req RefreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "参数错误"})
+		return
+	}
+	userId, err := db.RevokeRefreshTokenFamily(hashToken(req.RefreshToken))
+	if err != nil {
+		if errors.Is(err, db.ErrRefreshTokenInvalid) {
+			c.JSON(401, gin.H{"error": "无效的刷新令牌"})
+		} else {
+			c.JSON(500, gin.H{"error": "登出失败"})
+		}
+		return
+	}
+
+	//访问令牌是可选的：已过期的令牌本来就不能用了，不需要吊销
+	if tokenString, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok {
+		if claims, err := parseToken(tokenString); err == nil {
+			//只能吊销属于同一个用户的访问令牌
+			if claims.ID != "" && claims.ExpiresAt != nil && claims.UserId == userId {
+				if err := db.RevokeAccessToken(claims.ID, claims.ExpiresAt.Time); err != nil {
+					c.JSON(500, gin.H{"error": "吊销访问令牌失败"})
+					return
+				}
+			}
+		}
+	}
+	c.JSON(200, gin.H{"message": "登出成功"})
+}
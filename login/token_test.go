@@ -0,0 +1,115 @@
+package login
+
+import (
+	"Project01/config"
+	"Project01/db"
+	"Project01/internal/dbtest"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 注册一个用户并登录，返回登录结果
+func loginTestUser(t *testing.T) Reply {
+	t.Helper()
+	Init(config.JWTConfig{Secret: "0123456789abcdef0123456789abcdef", AccessTokenTTL: time.Hour, RefreshTokenTTL: 24 * time.Hour})
+	if w := postJSON(RegisterHandler, `{"username":"alice","password":"passw0rd"}`); w.Code != 201 {
+		t.Fatalf("注册：%d %s", w.Code, w.Body.String())
+	}
+	return decodeReply(t, postJSON(LoginHandler, `{"username":"alice","password":"passw0rd"}`))
+}
+
+func decodeReply(t *testing.T, w *httptest.ResponseRecorder) Reply {
+	t.Helper()
+	if w.Code != 200 {
+		t.Fatalf("状态码 = %d, %s", w.Code, w.Body.String())
+	}
+	var reply Reply
+	if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil {
+		t.Fatal(err)
+	}
+	return reply
+}
+
+func refresh(token string) *httptest.ResponseRecorder {
+	return postJSON(RefreshHandler, `{"refresh_token":"`+token+`"}`)
+}
+
+// 用访问令牌请求一个挂了AuthMiddleware的接口
+func authorized(token string) int {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/", AuthMiddleware(), func(c *gin.Context) { c.Status(204) })
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w.Code
+}
+
+// 刷新令牌只能用一次；旧令牌再被使用时整个登录会话失效，包括已经签发的访问令牌
+func TestRefreshReuse(t *testing.T) {
+	dbtest.Open(t)
+	login := loginTestUser(t)
+	if code := authorized(login.Token); code != 204 {
+		t.Fatalf("登录的访问令牌：%d", code)
+	}
+
+	rotated := decodeReply(t, refresh(login.RefreshToken))
+	if rotated.RefreshToken == login.RefreshToken || rotated.Token == login.Token {
+		t.Fatal("刷新后令牌没有变化")
+	}
+	if code := authorized(rotated.Token); code != 204 {
+		t.Fatalf("刷新后的访问令牌：%d", code)
+	}
+
+	//旧的刷新令牌被重复使用
+	if w := refresh(login.RefreshToken); w.Code != 401 {
+		t.Fatalf("重复使用：%d %s", w.Code, w.Body.String())
+	}
+	if w := refresh(rotated.RefreshToken); w.Code != 401 {
+		t.Errorf("家族作废后的新刷新令牌：%d", w.Code)
+	}
+	for name, token := range map[string]string{"登录": login.Token, "刷新": rotated.Token} {
+		if code := authorized(token); code != 401 {
+			t.Errorf("%s时签发的访问令牌：%d", name, code)
+		}
+	}
+
+	//重新登录不受影响
+	again := decodeReply(t, postJSON(LoginHandler, `{"username":"alice","password":"passw0rd"}`))
+	if w := refresh(again.RefreshToken); w.Code != 200 {
+		t.Errorf("重新登录后刷新：%d", w.Code)
+	}
+}
+
+func TestLogout(t *testing.T) {
+	dbtest.Open(t)
+	login := loginTestUser(t)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/logout", LogoutHandler)
+	req := httptest.NewRequest("POST", "/logout", strings.NewReader(`{"refresh_token":"`+login.RefreshToken+`"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+login.Token)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatalf("登出：%d %s", w.Code, w.Body.String())
+	}
+	if code := authorized(login.Token); code != 401 {
+		t.Errorf("登出后的访问令牌：%d", code)
+	}
+	if w := refresh(login.RefreshToken); w.Code != 401 {
+		t.Errorf("登出后的刷新令牌：%d", w.Code)
+	}
+	var count int64
+	db.GetDB().Model(&db.RevokedToken{}).Count(&count)
+	if count != 1 {
+		t.Errorf("吊销记录%d条", count)
+	}
+}
@@ -1,20 +1,56 @@
 package main
 
 import (
+	"Project01/admin"
 	"Project01/comment"
+	"Project01/config"
 	"Project01/db"
 	"Project01/login"
+	"Project01/storage"
+	"Project01/transcode"
 	"Project01/video"
+	"context"
+	"fmt"
+	"os"
 
 	"github.com/gin-gonic/gin"
 )
 
 func main() {
+	//加载配置(配置文件+环境变量+命令行参数)
+	cfg, err := config.Load(os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	//打印生效的配置(隐藏密钥)
+	fmt.Printf("生效的配置：\n%s", cfg.Redacted())
+
 	//初始化数据库连接(全局变量db会在此处被赋值)
-	db.InitDB()
+	db.InitDB(cfg.Database)
 
-	//初始化MinIO
-	video.InitMinio()
+	//初始化对象存储(MinIO或本地磁盘)
+	store, err := storage.New(cfg.Storage)
+	if err != nil {
+		panic("对象存储初始化失败: " + err.Error())
+	}
+	video.Init(store, cfg.Upload, cfg.Storage, cfg.Streaming)
+	//后台清理过期的上传会话
+	video.StartSessionJanitor(context.Background())
+	//后台任务(打包、转码)，找不到ffmpeg时只打包不转码
+	var transcoder transcode.Transcoder
+	if cfg.Transcode.Enabled {
+		if transcoder, err = transcode.New(cfg.Transcode); err != nil {
+			fmt.Printf("转码不可用，上传的视频不会转码：%v\n", err)
+		}
+	}
+	video.InitJobs(cfg.Jobs, cfg.Transcode, transcoder)
+	video.StartJobWorkers(context.Background())
+
+	//初始化登录模块(JWT密钥)和评论模块(敏感词文件)
+	login.Init(cfg.JWT)
+	login.StartTokenJanitor(context.Background())
+	comment.Init(cfg.Comment)
 
 	//启动Gin引擎
 	r := gin.Default()
@@ -24,29 +60,84 @@ func main() {
 		ctx.JSON(200, gin.H{"message": "pong"})
 	})
 
+	//注册
+	r.POST("/register", login.RegisterHandler)
 	//登录
 	r.POST("/login", login.LoginHandler)
+	//刷新令牌
+	r.POST("/token/refresh", login.RefreshHandler)
+	//登出
+	r.POST("/logout", login.LogoutHandler)
+	//tus协议的能力查询，不需要鉴权
+	r.OPTIONS("/jwt/tus/files", video.TusOptionsHandler)
+	r.OPTIONS("/jwt/tus/files/:uploadId", video.TusOptionsHandler)
 
 	//鉴权
 	auth := r.Group("/jwt", login.AuthMiddleware())
-	{ //需要鉴权的操作
+	{ //需要鉴权的操作，每个路由都通过RequirePermission(资源,操作)按权限表校验
 		//上传视频
-		auth.POST("/upload", video.UploadVideoHandler)
+		auth.POST("/upload", login.RequirePermission("video", "upload"), video.UploadVideoHandler)
 
 		//上传时断点续传相关
-		auth.POST("/upload/init", video.InitUploadHandler)                     //初始化上传
-		auth.POST("/upload/:uploadId/chunk/:index", video.UploadChunkHandler)  //分片上传
-		auth.GET("/upload/:uploadId/progress", video.GetUploadProgressHandler) //查询进度
-		auth.POST("/upload/:uploadId/complete", video.CompleteUploadHandler)   //完成上传
+		upload := auth.Group("/upload", login.RequirePermission("video", "upload"))
+		upload.POST("/init", video.InitUploadHandler)            //初始化上传
+		upload.GET("/sessions", video.ListUploadSessionsHandler) //当前用户的上传会话列表
+		//以下路由只有会话的创建者才能操作
+		upload.POST("/:uploadId/chunk/:index", video.RequireUploadSession(true), video.UploadChunkHandler)          //分片上传
+		upload.POST("/:uploadId/chunk/:index/presign", video.RequireUploadSession(true), video.PresignChunkHandler) //获取直传分片的预签名URL
+		upload.GET("/:uploadId/progress", video.RequireUploadSession(false), video.GetUploadProgressHandler)        //查询进度
+		upload.POST("/:uploadId/complete", video.RequireUploadSession(false), video.CompleteUploadHandler)          //完成上传
+		upload.DELETE("/:uploadId", video.RequireUploadSession(false), video.CancelUploadHandler)                   //取消上传
+
+		//tus 1.0可续传上传协议，和上面的分片接口共用上传会话
+		tus := auth.Group("/tus/files", login.RequirePermission("video", "upload"), video.TusMiddleware())
+		tus.POST("", video.TusCreateHandler)                                                   //创建上传
+		tus.HEAD("/:uploadId", video.RequireUploadSession(false), video.TusHeadHandler)        //查询偏移量
+		tus.PATCH("/:uploadId", video.RequireUploadSession(true), video.TusPatchHandler)       //追加数据
+		tus.DELETE("/:uploadId", video.RequireUploadSession(false), video.TusTerminateHandler) //终止上传
 
-		//播放视频 动态定义参数filename
-		auth.GET("/video/:filename", video.PlayVideoHandler)
+		//视频信息：列表、详情、修改、删除
+		auth.GET("/videos", login.RequirePermission("video", "read"), video.ListVideosHandler)
+		auth.GET("/videos/:id", login.RequirePermission("video", "read"), video.GetVideoHandler)
+		//播放视频，按视频ID查找
+		auth.GET("/videos/:id/play", login.RequirePermission("video", "read"), video.PlayVideoHandler)
+		auth.HEAD("/videos/:id/play", login.RequirePermission("video", "read"), video.PlayVideoHandler)
+		//获取播放视频的预签名URL，直接从存储读取
+		auth.GET("/videos/:id/play/url", login.RequirePermission("video", "read"), video.PlayURLHandler)
+		//转码出来的规格
+		auth.GET("/videos/:id/renditions", login.RequirePermission("video", "read"), video.ListRenditionsHandler)
+		//HLS播放列表和分段，从/videos/:id/hls/master.m3u8开始
+		auth.GET("/videos/:id/hls/:file", login.RequirePermission("video", "read"), video.HLSHandler)
+		//DASH清单和分段，从/videos/:id/dash/manifest.mpd开始
+		auth.GET("/videos/:id/dash/:file", login.RequirePermission("video", "read"), video.DASHHandler)
+		//处理状态和进度，上传者的页面轮询
+		auth.GET("/videos/:id/status", login.RequirePermission("video", "moderate", video.IsVideoOwner), video.VideoStatusHandler)
+		auth.POST("/videos/:id/block", login.RequirePermission("video", "moderate"), video.BlockVideoHandler)
+		auth.POST("/videos/:id/unblock", login.RequirePermission("video", "moderate"), video.UnblockVideoHandler)
+		auth.PATCH("/videos/:id", login.RequirePermission("video", "update", video.IsVideoOwner), video.UpdateVideoHandler)
+		auth.DELETE("/videos/:id", login.RequirePermission("video", "delete", video.IsVideoOwner), video.DeleteVideoHandler)
 		//发布评论
-		auth.POST("/comment", comment.PostCommentHandler)
-		//删除评论
-		auth.DELETE("/comment/:id", comment.DeleteCommentHandler)
+		auth.POST("/comment", login.RequirePermission("comment", "create"), comment.PostCommentHandler)
+		//删除评论：有comment:delete权限，或者是评论的发布者
+		auth.DELETE("/comment/:id", login.RequirePermission("comment", "delete", comment.IsCommentOwner), comment.DeleteCommentHandler)
+
+		//管理员：角色、权限管理
+		adminGroup := auth.Group("/admin", login.RequirePermission("rbac", "manage"))
+		adminGroup.GET("/roles", admin.ListRolesHandler)
+		adminGroup.POST("/roles", admin.CreateRoleHandler)
+		adminGroup.PATCH("/roles/:id", admin.UpdateRoleHandler)
+		adminGroup.DELETE("/roles/:id", admin.DeleteRoleHandler)
+		adminGroup.PUT("/roles/:id/permissions/:permissionId", admin.AttachPermissionHandler)
+		adminGroup.DELETE("/roles/:id/permissions/:permissionId", admin.DetachPermissionHandler)
+		adminGroup.GET("/permissions", admin.ListPermissionsHandler)
+		adminGroup.POST("/permissions", admin.CreatePermissionHandler)
+		adminGroup.PATCH("/permissions/:id", admin.UpdatePermissionHandler)
+		adminGroup.DELETE("/permissions/:id", admin.DeletePermissionHandler)
+		adminGroup.PUT("/users/:userId/roles/:roleId", admin.GrantRoleHandler)
+		adminGroup.DELETE("/users/:userId/roles/:roleId", admin.RevokeRoleHandler)
+		adminGroup.GET("/users/:userId/permissions", admin.GetUserPermissionsHandler)
 	}
 
 	//启动HTTP服务
-	r.Run("0.0.0.0:8080")
+	r.Run(cfg.Server.Addr)
 }
@@ -0,0 +1,162 @@
+package media
+
+//ISO-BMFF(MP4/MOV)的box读写
+//box结构：4字节大小 + 4字节类型 + 内容；大小为1时后面跟8字节的真实大小，为0表示一直到文件末尾
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var errBoxTruncated = errors.New("box数据不完整")
+
+// 解析出来的一个box，data是去掉头部之后的内容
+type box struct {
+	typ  string
+	data []byte
+}
+
+// 把一段数据拆成连续的box
+func parseBoxes(b []byte) ([]box, error) {
+	var boxes []box
+	for len(b) > 0 {
+		if len(b) < 8 {
+			return nil, errBoxTruncated
+		}
+		size := uint64(binary.BigEndian.Uint32(b))
+		typ := string(b[4:8])
+		header := uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(b))
+		case 1:
+			if len(b) < 16 {
+				return nil, errBoxTruncated
+			}
+			size = binary.BigEndian.Uint64(b[8:16])
+			header = 16
+		}
+		if size < header || size > uint64(len(b)) {
+			return nil, errBoxTruncated
+		}
+		boxes = append(boxes, box{typ: typ, data: b[header:size]})
+		b = b[size:]
+	}
+	return boxes, nil
+}
+
+// 找第一个指定类型的子box，找不到返回nil
+func childBox(b []byte, typ string) []byte {
+	boxes, err := parseBoxes(b)
+	if err != nil {
+		return nil
+	}
+	for _, bx := range boxes {
+		if bx.typ == typ {
+			return bx.data
+		}
+	}
+	return nil
+}
+
+// 按路径逐层查找，如findBox(moov, "mdia", "minf", "stbl")
+func findBox(b []byte, path ...string) []byte {
+	for _, typ := range path {
+		b = childBox(b, typ)
+		if b == nil {
+			return nil
+		}
+	}
+	return b
+}
+
+// 大端序读取，越界时返回0，调用方通过长度检查保证数据完整
+type reader struct {
+	b   []byte
+	pos int
+	err bool
+}
+
+func (r *reader) need(n int) bool {
+	if r.err || r.pos+n > len(r.b) {
+		r.err = true
+		return false
+	}
+	return true
+}
+
+func (r *reader) skip(n int) {
+	if r.need(n) {
+		r.pos += n
+	}
+}
+
+func (r *reader) u8() uint8 {
+	if !r.need(1) {
+		return 0
+	}
+	v := r.b[r.pos]
+	r.pos++
+	return v
+}
+
+func (r *reader) u16() uint16 {
+	if !r.need(2) {
+		return 0
+	}
+	v := binary.BigEndian.Uint16(r.b[r.pos:])
+	r.pos += 2
+	return v
+}
+
+func (r *reader) u32() uint32 {
+	if !r.need(4) {
+		return 0
+	}
+	v := binary.BigEndian.Uint32(r.b[r.pos:])
+	r.pos += 4
+	return v
+}
+
+func (r *reader) u64() uint64 {
+	if !r.need(8) {
+		return 0
+	}
+	v := binary.BigEndian.Uint64(r.b[r.pos:])
+	r.pos += 8
+	return v
+}
+
+// box写入：先写占位的大小，内容写完后回填
+type writer struct {
+	b     []byte
+	stack []int
+}
+
+func (w *writer) start(typ string) {
+	w.stack = append(w.stack, len(w.b))
+	w.b = append(w.b, 0, 0, 0, 0)
+	w.b = append(w.b, typ...)
+}
+
+// full box：版本和flags
+func (w *writer) startFull(typ string, version uint8, flags uint32) {
+	w.start(typ)
+	w.u32(uint32(version)<<24 | flags&0xFFFFFF)
+}
+
+func (w *writer) end() {
+	begin := w.stack[len(w.stack)-1]
+	w.stack = w.stack[:len(w.stack)-1]
+	binary.BigEndian.PutUint32(w.b[begin:], uint32(len(w.b)-begin))
+}
+
+func (w *writer) u8(v uint8)   { w.b = append(w.b, v) }
+func (w *writer) u16(v uint16) { w.b = binary.BigEndian.AppendUint16(w.b, v) }
+func (w *writer) u32(v uint32) { w.b = binary.BigEndian.AppendUint32(w.b, v) }
+func (w *writer) u64(v uint64) { w.b = binary.BigEndian.AppendUint64(w.b, v) }
+func (w *writer) bytes(v []byte) {
+	w.b = append(w.b, v...)
+}
+func (w *writer) zeros(n int) {
+	w.b = append(w.b, make([]byte, n)...)
+}
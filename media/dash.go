@@ -0,0 +1,146 @@
+package media
+
+//MPEG-DASH清单(ISO/IEC 23009-1)：和HLS共用同一套fMP4分段，
+//每路流一个AdaptationSet，分段用SegmentTemplate+SegmentTimeline描述，时长来自容器解析的样本表
+import (
+	"encoding/xml"
+	"fmt"
+)
+
+// DASH清单的文件名
+const DASHManifest = "manifest.mpd"
+
+type mpd struct {
+	XMLName                   xml.Name `xml:"urn:mpeg:dash:schema:mpd:2011 MPD"`
+	Profiles                  string   `xml:"profiles,attr"`
+	Type                      string   `xml:"type,attr"`
+	MediaPresentationDuration string   `xml:"mediaPresentationDuration,attr"`
+	MinBufferTime             string   `xml:"minBufferTime,attr"`
+	Period                    mpdPeriod
+}
+
+type mpdPeriod struct {
+	XMLName        xml.Name `xml:"Period"`
+	ID             string   `xml:"id,attr"`
+	Start          string   `xml:"start,attr"`
+	AdaptationSets []mpdAdaptationSet
+}
+
+type mpdAdaptationSet struct {
+	XMLName          xml.Name `xml:"AdaptationSet"`
+	ID               int      `xml:"id,attr"`
+	ContentType      string   `xml:"contentType,attr"`
+	MimeType         string   `xml:"mimeType,attr"`
+	SegmentAlignment bool     `xml:"segmentAlignment,attr"`
+	StartWithSAP     int      `xml:"startWithSAP,attr"`
+	Lang             string   `xml:"lang,attr,omitempty"`
+	ChannelConfig    *mpdDescriptor
+	Representation   mpdRepresentation
+}
+
+type mpdDescriptor struct {
+	XMLName     xml.Name `xml:"AudioChannelConfiguration"`
+	SchemeIdUri string   `xml:"schemeIdUri,attr"`
+	Value       string   `xml:"value,attr"`
+}
+
+type mpdRepresentation struct {
+	XMLName           xml.Name `xml:"Representation"`
+	ID                string   `xml:"id,attr"`
+	Codecs            string   `xml:"codecs,attr,omitempty"`
+	Bandwidth         int64    `xml:"bandwidth,attr"`
+	Width             int      `xml:"width,attr,omitempty"`
+	Height            int      `xml:"height,attr,omitempty"`
+	AudioSamplingRate int      `xml:"audioSamplingRate,attr,omitempty"`
+	SegmentTemplate   mpdSegmentTemplate
+}
+
+type mpdSegmentTemplate struct {
+	XMLName         xml.Name `xml:"SegmentTemplate"`
+	Timescale       uint32   `xml:"timescale,attr"`
+	Initialization  string   `xml:"initialization,attr"`
+	Media           string   `xml:"media,attr"`
+	StartNumber     int      `xml:"startNumber,attr"`
+	SegmentTimeline []mpdS   `xml:"SegmentTimeline>S"`
+}
+
+// SegmentTimeline的一项：从t开始，r+1个时长为d的连续分段
+type mpdS struct {
+	T *uint64 `xml:"t,attr,omitempty"`
+	D uint64  `xml:"d,attr"`
+	R int     `xml:"r,attr,omitempty"`
+}
+
+// 生成DASH清单(静态点播)，分段文件名和打包时写出的一致：<流类型>_init.mp4、<流类型>_<编号>.m4s
+func (p *Package) DASHManifest() []byte {
+	doc := mpd{
+		Profiles:      "urn:mpeg:dash:profile:isoff-live:2011",
+		Type:          "static",
+		MinBufferTime: "PT2S",
+		Period:        mpdPeriod{ID: "0", Start: "PT0S"},
+	}
+	var duration float64
+	for i, s := range []*Stream{p.Video, p.Audio} {
+		if s == nil {
+			continue
+		}
+		duration = max(duration, s.Seconds())
+		set := mpdAdaptationSet{
+			ID:               i,
+			ContentType:      s.Kind,
+			MimeType:         s.Kind + "/mp4",
+			SegmentAlignment: true,
+			StartWithSAP:     1,
+			Representation: mpdRepresentation{
+				ID:              s.Kind,
+				Codecs:          s.Codec,
+				Bandwidth:       s.Bandwidth,
+				SegmentTemplate: segmentTemplate(s),
+			},
+		}
+		if s.Kind == KindVideo {
+			set.Representation.Width = s.Width
+			set.Representation.Height = s.Height
+		} else {
+			set.Lang = "und"
+			set.Representation.AudioSamplingRate = s.SampleRate
+			if s.Channels > 0 {
+				set.ChannelConfig = &mpdDescriptor{
+					SchemeIdUri: "urn:mpeg:dash:23003:3:audio_channel_configuration:2011",
+					Value:       fmt.Sprint(s.Channels),
+				}
+			}
+		}
+		doc.Period.AdaptationSets = append(doc.Period.AdaptationSets, set)
+	}
+	doc.MediaPresentationDuration = fmt.Sprintf("PT%.3fS", duration)
+	out, _ := xml.MarshalIndent(doc, "", "  ")
+	return append([]byte(xml.Header), append(out, '\n')...)
+}
+
+// 连续且时长相同的分段合并成一项(用r表示重复次数)
+func segmentTemplate(s *Stream) mpdSegmentTemplate {
+	tmpl := mpdSegmentTemplate{
+		Timescale:      s.Timescale,
+		Initialization: "$RepresentationID$_init.mp4",
+		Media:          "$RepresentationID$_$Number%05d$.m4s",
+		StartNumber:    0,
+	}
+	var next uint64
+	for i, seg := range s.Segments {
+		last := len(tmpl.SegmentTimeline) - 1
+		if i > 0 && seg.Start == next && tmpl.SegmentTimeline[last].D == seg.Duration {
+			tmpl.SegmentTimeline[last].R++
+		} else {
+			entry := mpdS{D: seg.Duration}
+			//第一项和不连续的地方需要写明开始时间
+			if i == 0 || seg.Start != next {
+				start := seg.Start
+				entry.T = &start
+			}
+			tmpl.SegmentTimeline = append(tmpl.SegmentTimeline, entry)
+		}
+		next = seg.Start + seg.Duration
+	}
+	return tmpl
+}
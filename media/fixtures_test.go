@@ -0,0 +1,416 @@
+package media
+
+//测试用的样例文件：由下面的函数生成，保存在testdata目录
+//修改生成函数后用 go test ./media -run TestFixtures -update 重新生成
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "重新生成testdata里的样例文件")
+
+// 样例MP4的参数
+const (
+	fixtureVideoSamples = 30 //30fps，1秒
+	fixtureVideoDelta   = 3000
+	fixtureAudioSamples = 44 //44.1kHz，每个样本1024，约1.02秒
+	fixtureAudioSize    = 20
+)
+
+// 视频第i个样本的大小，关键帧大一些
+func fixtureVideoSize(i int) int {
+	if i%15 == 0 {
+		return 400 + i
+	}
+	return 100 + i
+}
+
+type mp4Options struct {
+	quickTime bool   //ftyp的主品牌为"qt  "(MOV)
+	rotate90  bool   //tkhd的变换矩阵旋转90度(手机竖拍)
+	duration  uint64 //mvhd的时长(timescale为1000)，0时为1秒，超出32位时写version 1的mvhd
+}
+
+// 非分片的MP4：ftyp + mdat(先全部视频样本，再全部音频样本) + moov
+// 视频为H.264 1280x720，第0、15帧是关键帧；音频为AAC-LC立体声44.1kHz
+func buildMP4(opts mp4Options) []byte {
+	w := &writer{}
+	w.start("ftyp")
+	if opts.quickTime {
+		w.bytes([]byte("qt  "))
+		w.u32(0)
+		w.bytes([]byte("qt  "))
+	} else {
+		w.bytes([]byte("isom"))
+		w.u32(0x200)
+		w.bytes([]byte("isomiso2avc1mp41"))
+	}
+	w.end()
+
+	w.start("mdat")
+	videoOffset := len(w.b)
+	for i := 0; i < fixtureVideoSamples; i++ {
+		w.bytes(bytes.Repeat([]byte{byte(i)}, fixtureVideoSize(i)))
+	}
+	audioOffset := len(w.b)
+	for i := 0; i < fixtureAudioSamples; i++ {
+		w.bytes(bytes.Repeat([]byte{byte(0x80 + i)}, fixtureAudioSize))
+	}
+	w.end()
+
+	w.start("moov")
+	duration := opts.duration
+	if duration == 0 {
+		duration = 1000
+	}
+	if duration > math.MaxUint32 {
+		w.startFull("mvhd", 1, 0)
+		w.u64(0)
+		w.u64(0)
+		w.u32(1000)
+		w.u64(duration)
+	} else {
+		w.startFull("mvhd", 0, 0)
+		w.u32(0)
+		w.u32(0)
+		w.u32(1000)
+		w.u32(uint32(duration))
+	}
+	w.u32(0x00010000)
+	w.u16(0x0100)
+	w.zeros(10)
+	for _, v := range unityMatrix {
+		w.u32(v)
+	}
+	w.zeros(24)
+	w.u32(3)
+	w.end()
+
+	videoSizes := make([]uint32, fixtureVideoSamples)
+	for i := range videoSizes {
+		videoSizes[i] = uint32(fixtureVideoSize(i))
+	}
+	matrix := unityMatrix
+	if opts.rotate90 {
+		matrix = []uint32{0, 0x00010000, 0, 0xFFFF0000, 0, 0, 0, 0, 0x40000000}
+	}
+	writeTrak(w, fixtureTrak{
+		id: 1, handler: "vide", timescale: 90000, duration: fixtureVideoSamples * fixtureVideoDelta,
+		width: 1280, height: 720, matrix: matrix,
+		entry: avc1Entry(1280, 720), delta: fixtureVideoDelta, sizes: videoSizes,
+		offset: uint32(videoOffset), keyframes: []uint32{1, 16},
+	})
+	audioSizes := make([]uint32, fixtureAudioSamples)
+	for i := range audioSizes {
+		audioSizes[i] = fixtureAudioSize
+	}
+	writeTrak(w, fixtureTrak{
+		id: 2, handler: "soun", timescale: 44100, duration: fixtureAudioSamples * 1024, matrix: unityMatrix,
+		entry: mp4aEntry(), delta: 1024, sizes: audioSizes, offset: uint32(audioOffset),
+	})
+	w.end()
+	return w.b
+}
+
+type fixtureTrak struct {
+	id, timescale, duration uint32
+	handler                 string
+	width, height           uint32
+	matrix                  []uint32
+	entry                   []byte //样本描述(完整的box)
+	delta                   uint32 //每个样本的时长
+	sizes                   []uint32
+	offset                  uint32   //所有样本放在一个chunk里
+	keyframes               []uint32 //为空时不写stss(全部是关键帧)
+}
+
+func writeTrak(w *writer, t fixtureTrak) {
+	w.start("trak")
+	w.startFull("tkhd", 0, 3)
+	w.u32(0)
+	w.u32(0)
+	w.u32(t.id)
+	w.u32(0)
+	w.u32(0)
+	w.zeros(8)
+	w.u16(0)
+	w.u16(0)
+	w.u16(0)
+	w.u16(0)
+	for _, v := range t.matrix {
+		w.u32(v)
+	}
+	w.u32(t.width << 16)
+	w.u32(t.height << 16)
+	w.end()
+
+	w.start("mdia")
+	w.startFull("mdhd", 0, 0)
+	w.u32(0)
+	w.u32(0)
+	w.u32(t.timescale)
+	w.u32(t.duration)
+	w.u16(0x55C4)
+	w.u16(0)
+	w.end()
+	w.startFull("hdlr", 0, 0)
+	w.u32(0)
+	w.bytes([]byte(t.handler))
+	w.zeros(12)
+	w.u8(0)
+	w.end()
+	w.start("minf")
+	w.start("stbl")
+
+	w.startFull("stsd", 0, 0)
+	w.u32(1)
+	w.bytes(t.entry)
+	w.end()
+
+	w.startFull("stts", 0, 0)
+	w.u32(1)
+	w.u32(uint32(len(t.sizes)))
+	w.u32(t.delta)
+	w.end()
+
+	w.startFull("stsz", 0, 0)
+	w.u32(0)
+	w.u32(uint32(len(t.sizes)))
+	for _, s := range t.sizes {
+		w.u32(s)
+	}
+	w.end()
+
+	w.startFull("stsc", 0, 0)
+	w.u32(1)
+	w.u32(1)
+	w.u32(uint32(len(t.sizes)))
+	w.u32(1)
+	w.end()
+
+	w.startFull("stco", 0, 0)
+	w.u32(1)
+	w.u32(t.offset)
+	w.end()
+
+	if len(t.keyframes) > 0 {
+		w.startFull("stss", 0, 0)
+		w.u32(uint32(len(t.keyframes)))
+		for _, k := range t.keyframes {
+			w.u32(k)
+		}
+		w.end()
+	}
+
+	w.end() //stbl
+	w.end() //minf
+	w.end() //mdia
+	w.end() //trak
+}
+
+// H.264 High@3.1的样本描述
+func avc1Entry(width, height uint16) []byte {
+	w := &writer{}
+	w.start("avc1")
+	w.zeros(6)
+	w.u16(1)
+	w.zeros(16)
+	w.u16(width)
+	w.u16(height)
+	w.u32(0x00480000)
+	w.u32(0x00480000)
+	w.u32(0)
+	w.u16(1)
+	w.zeros(32)
+	w.u16(0x0018)
+	w.u16(0xFFFF)
+	w.start("avcC")
+	w.bytes([]byte{1, 0x64, 0x00, 0x1f, 0xff, 0xe0, 0x00})
+	w.end()
+	w.end()
+	return w.b
+}
+
+// AAC-LC立体声44.1kHz的样本描述
+func mp4aEntry() []byte {
+	w := &writer{}
+	w.start("mp4a")
+	w.zeros(6)
+	w.u16(1)
+	w.u16(0)
+	w.zeros(6)
+	w.u16(2)
+	w.u16(16)
+	w.zeros(4)
+	w.u32(44100 << 16)
+	w.startFull("esds", 0, 0)
+	w.bytes([]byte{
+		0x03, 25, 0x00, 0x02, 0x00, //ES_Descriptor
+		0x04, 17, 0x40, 0x15, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, //DecoderConfigDescriptor
+		0x05, 2, 0x12, 0x10, //AudioSpecificConfig：AAC-LC，44.1kHz，2声道
+		0x06, 1, 0x02, //SLConfigDescriptor
+	})
+	w.end()
+	w.end()
+	return w.b
+}
+
+// EBML元素：ID按原样写出，大小用最短的变长整数
+func ebml(id uint32, children ...[]byte) []byte {
+	data := bytes.Join(children, nil)
+	var b []byte
+	for shift := 24; shift >= 0; shift -= 8 {
+		if c := byte(id >> shift); c != 0 || len(b) > 0 {
+			b = append(b, c)
+		}
+	}
+	n := 1
+	for uint64(len(data)) >= 1<<(7*n)-1 {
+		n++
+	}
+	size := uint64(len(data)) | 1<<(7*n)
+	for i := n - 1; i >= 0; i-- {
+		b = append(b, byte(size>>(8*i)))
+	}
+	return append(b, data...)
+}
+
+// 无符号整数内容，width为字节数
+func ebmlUintData(v uint64, width int) []byte {
+	b := binary.BigEndian.AppendUint64(nil, v)
+	return b[8-width:]
+}
+
+func ebmlFloat64Data(v float64) []byte {
+	return binary.BigEndian.AppendUint64(nil, math.Float64bits(v))
+}
+
+func ebmlHeader(docType string) []byte {
+	return ebml(idEBML,
+		ebml(0x4286, []byte{1}), //EBMLVersion
+		ebml(0x42F7, []byte{1}), //EBMLReadVersion
+		ebml(idDocType, []byte(docType)),
+	)
+}
+
+// 只有一个Cluster的占位数据，probe不会读取
+func ebmlCluster() []byte {
+	return ebml(idCluster, ebml(0xE7, []byte{0}), ebml(0xA3, bytes.Repeat([]byte{0x55}, 64)))
+}
+
+// WebM：Info、Tracks在Cluster前面；VP9 1280x720 30fps + Opus
+// duration是Info里Duration元素的内容，nil时为1秒(1000毫秒的float64)
+func buildWebM(duration []byte) []byte {
+	if duration == nil {
+		duration = ebmlFloat64Data(1000)
+	}
+	segment := ebml(idSegment,
+		ebml(idInfo,
+			ebml(idTimestampScale, ebmlUintData(1000000, 3)),
+			ebml(idDuration, duration),
+		),
+		ebml(idTracks,
+			ebml(idTrackEntry,
+				ebml(0xD7, []byte{1}), //TrackNumber
+				ebml(idTrackType, []byte{1}),
+				ebml(idCodecID, []byte("V_VP9")),
+				ebml(idDefaultDuration, ebmlUintData(33333333, 4)),
+				ebml(idVideo,
+					ebml(idPixelWidth, ebmlUintData(1280, 2)),
+					ebml(idPixelHeight, ebmlUintData(720, 2)),
+				),
+			),
+			ebml(idTrackEntry,
+				ebml(0xD7, []byte{2}),
+				ebml(idTrackType, []byte{2}),
+				ebml(idCodecID, []byte("A_OPUS")),
+			),
+		),
+		ebmlCluster(),
+	)
+	return append(ebmlHeader("webm"), segment...)
+}
+
+// Matroska：Info、Tracks在Cluster后面，只能通过SeekHead找到；H.264 Main@4.0 1920x1080 + AAC-LC
+// 没有DefaultDuration(可变帧率)，Duration为2秒的float32
+func buildMKV() []byte {
+	info := ebml(idInfo,
+		ebml(idDuration, binary.BigEndian.AppendUint32(nil, math.Float32bits(2000))),
+	)
+	tracks := ebml(idTracks,
+		ebml(idTrackEntry,
+			ebml(0xD7, []byte{1}),
+			ebml(idTrackType, []byte{1}),
+			ebml(idCodecID, []byte("V_MPEG4/ISO/AVC")),
+			ebml(idCodecPrivate, []byte{1, 0x4d, 0x40, 0x28, 0xff, 0xe0, 0x00}),
+			ebml(idVideo,
+				ebml(idPixelWidth, ebmlUintData(1920, 2)),
+				ebml(idPixelHeight, ebmlUintData(1080, 2)),
+			),
+		),
+		ebml(idTrackEntry,
+			ebml(0xD7, []byte{2}),
+			ebml(idTrackType, []byte{2}),
+			ebml(idCodecID, []byte("A_AAC")),
+			ebml(idCodecPrivate, []byte{0x12, 0x10}),
+		),
+	)
+	cluster := ebmlCluster()
+	//SeekPosition固定8字节，SeekHead的长度不随位置变化
+	seekHead := func(infoPos, tracksPos uint64) []byte {
+		return ebml(idSeekHead,
+			ebml(idSeek, ebml(idSeekID, ebmlUintData(idInfo, 4)), ebml(idSeekPosition, ebmlUintData(infoPos, 8))),
+			ebml(idSeek, ebml(idSeekID, ebmlUintData(idTracks, 4)), ebml(idSeekPosition, ebmlUintData(tracksPos, 8))),
+		)
+	}
+	infoPos := uint64(len(seekHead(0, 0)) + len(cluster))
+	tracksPos := infoPos + uint64(len(info))
+	segment := ebml(idSegment, seekHead(infoPos, tracksPos), cluster, info, tracks)
+	return append(ebmlHeader("matroska"), segment...)
+}
+
+// 所有样例文件，文件名 -> 生成函数
+var fixtures = map[string]func() []byte{
+	"sample.mp4":         func() []byte { return buildMP4(mp4Options{}) },
+	"sample_rotated.mov": func() []byte { return buildMP4(mp4Options{quickTime: true, rotate90: true}) },
+	"sample.webm":        func() []byte { return buildWebM(nil) },
+	"sample.mkv":         buildMKV,
+}
+
+func readFixture(t testing.TB, name string) []byte {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// testdata里的文件要和生成函数一致
+func TestFixtures(t *testing.T) {
+	for name, build := range fixtures {
+		path := filepath.Join("testdata", name)
+		want := build()
+		if *update {
+			if err := os.MkdirAll("testdata", 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, want, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("%s：%v，用-update重新生成", name, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s和生成函数不一致，用-update重新生成", name)
+		}
+	}
+}
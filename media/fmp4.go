@@ -0,0 +1,185 @@
+package media
+
+//分片MP4(fMP4/CMAF)：一个初始化段(ftyp+moov)加若干媒体段(moof+mdat)
+//每条轨道单独打包，输出文件里轨道ID固定为1
+import "encoding/binary"
+
+const fragmentTrackID = 1
+
+// 单位矩阵
+var unityMatrix = []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000}
+
+// 初始化段：只有样本描述，没有样本，样本都在媒体段里
+func initSegment(t *Track) []byte {
+	w := &writer{}
+	w.start("ftyp")
+	w.bytes([]byte("iso6"))
+	w.u32(0)
+	w.bytes([]byte("iso6cmfcmp41"))
+	w.end()
+
+	w.start("moov")
+	w.startFull("mvhd", 0, 0)
+	w.u32(0) //creation_time
+	w.u32(0) //modification_time
+	w.u32(1000)
+	w.u32(0) //duration，分片MP4里为0
+	w.u32(0x00010000)
+	w.u16(0x0100)
+	w.zeros(10)
+	for _, v := range unityMatrix {
+		w.u32(v)
+	}
+	w.zeros(24)
+	w.u32(fragmentTrackID + 1)
+	w.end()
+
+	w.start("trak")
+	w.startFull("tkhd", 0, 0x000003) //track_enabled | track_in_movie
+	w.u32(0)
+	w.u32(0)
+	w.u32(fragmentTrackID)
+	w.u32(0)
+	w.u32(0) //duration
+	w.zeros(8)
+	w.u16(0) //layer
+	w.u16(0) //alternate_group
+	if t.Kind == KindAudio {
+		w.u16(0x0100)
+	} else {
+		w.u16(0)
+	}
+	w.u16(0)
+	for _, v := range unityMatrix {
+		w.u32(v)
+	}
+	w.u32(uint32(t.Width) << 16)
+	w.u32(uint32(t.Height) << 16)
+	w.end()
+
+	w.start("mdia")
+	w.startFull("mdhd", 0, 0)
+	w.u32(0)
+	w.u32(0)
+	w.u32(t.Timescale)
+	w.u32(0)
+	w.u16(0x55C4) //und
+	w.u16(0)
+	w.end()
+	w.startFull("hdlr", 0, 0)
+	w.u32(0)
+	if t.Kind == KindVideo {
+		w.bytes([]byte("vide"))
+	} else {
+		w.bytes([]byte("soun"))
+	}
+	w.zeros(12)
+	if t.Kind == KindVideo {
+		w.bytes([]byte("VideoHandler\x00"))
+	} else {
+		w.bytes([]byte("SoundHandler\x00"))
+	}
+	w.end()
+
+	w.start("minf")
+	if t.Kind == KindVideo {
+		w.startFull("vmhd", 0, 1)
+		w.zeros(8)
+		w.end()
+	} else {
+		w.startFull("smhd", 0, 0)
+		w.zeros(4)
+		w.end()
+	}
+	w.start("dinf")
+	w.startFull("dref", 0, 0)
+	w.u32(1)
+	w.startFull("url ", 0, 1) //数据在同一个文件里
+	w.end()
+	w.end()
+	w.end()
+	w.start("stbl")
+	w.bytes(t.stsd)
+	for _, typ := range []string{"stts", "stsc", "stco"} {
+		w.startFull(typ, 0, 0)
+		w.u32(0)
+		w.end()
+	}
+	w.startFull("stsz", 0, 0)
+	w.u32(0)
+	w.u32(0)
+	w.end()
+	w.end() //stbl
+	w.end() //minf
+	w.end() //mdia
+	w.end() //trak
+
+	w.start("mvex")
+	w.startFull("trex", 0, 0)
+	w.u32(fragmentTrackID)
+	w.u32(1) //default_sample_description_index
+	w.u32(0)
+	w.u32(0)
+	w.u32(0)
+	w.end()
+	w.end()
+	w.end() //moov
+	return w.b
+}
+
+// trun里每个样本都带时长、大小、flags和显示偏移
+const (
+	trunDataOffset  = 0x000001
+	trunDuration    = 0x000100
+	trunSize        = 0x000200
+	trunFlags       = 0x000400
+	trunCTO         = 0x000800
+	tfhdDefaultBase = 0x020000 //default-base-is-moof：data_offset从moof开头算
+)
+
+// 样本flags：关键帧不依赖其他帧，非关键帧依赖其他帧且不是同步样本
+const (
+	sampleFlagsKey    = 0x02000000
+	sampleFlagsNonKey = 0x01010000
+)
+
+// 媒体段：moof描述样本，mdat是样本数据，data按样本顺序拼接
+func mediaSegment(seq uint32, samples []Sample, data []byte) []byte {
+	w := &writer{}
+	w.start("moof")
+	w.startFull("mfhd", 0, 0)
+	w.u32(seq)
+	w.end()
+	w.start("traf")
+	w.startFull("tfhd", 0, tfhdDefaultBase)
+	w.u32(fragmentTrackID)
+	w.end()
+	w.startFull("tfdt", 1, 0)
+	w.u64(samples[0].DTS)
+	w.end()
+	w.startFull("trun", 1, trunDataOffset|trunDuration|trunSize|trunFlags|trunCTO)
+	w.u32(uint32(len(samples)))
+	dataOffsetPos := len(w.b)
+	w.u32(0) //回填
+	for _, s := range samples {
+		w.u32(s.Dur)
+		w.u32(s.Size)
+		if s.Key {
+			w.u32(sampleFlagsKey)
+		} else {
+			w.u32(sampleFlagsNonKey)
+		}
+		w.u32(uint32(s.CTO))
+	}
+	w.end() //trun
+	w.end() //traf
+	w.end() //moof
+	//样本数据在mdat头部(8字节)之后
+	moofSize := len(w.b)
+	binary.BigEndian.PutUint32(w.b[dataOffsetPos:], uint32(moofSize+8))
+
+	w.start("mdat")
+	w.bytes(data)
+	w.end()
+	return w.b
+}
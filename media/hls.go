@@ -0,0 +1,81 @@
+package media
+
+//HLS播放列表(RFC 8216)：master.m3u8列出可选的流，video.m3u8/audio.m3u8列出各自的分段
+//分段是fMP4，需要EXT-X-MAP指向初始化段，协议版本至少为7
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// 主播放列表的文件名，播放器从它开始
+const HLSMaster = "master.m3u8"
+
+// 生成HLS播放列表，返回文件名到内容
+// 有视频时音频作为EXT-X-MEDIA音频组，只有音频时主播放列表直接指向音频
+func (p *Package) HLSPlaylists() map[string][]byte {
+	files := map[string][]byte{}
+	var streams []*Stream
+	for _, s := range []*Stream{p.Video, p.Audio} {
+		if s != nil {
+			streams = append(streams, s)
+			files[s.Kind+".m3u8"] = mediaPlaylist(s)
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-INDEPENDENT-SEGMENTS\n")
+	var bandwidth, average int64
+	var codecs []string
+	for _, s := range streams {
+		bandwidth += s.Bandwidth
+		average += s.AverageBandwidth
+		codecs = append(codecs, s.Codec)
+	}
+	attrs := fmt.Sprintf("BANDWIDTH=%d,AVERAGE-BANDWIDTH=%d", bandwidth, average)
+	//有不认识的编码时不写CODECS，写错了播放器会直接拒绝播放
+	if !containsEmpty(codecs) {
+		attrs += fmt.Sprintf(`,CODECS="%s"`, strings.Join(codecs, ","))
+	}
+	uri := streams[0].Kind + ".m3u8"
+	if p.Video != nil {
+		if p.Video.Width > 0 && p.Video.Height > 0 {
+			attrs += fmt.Sprintf(",RESOLUTION=%dx%d", p.Video.Width, p.Video.Height)
+		}
+		if p.Audio != nil {
+			fmt.Fprintf(&b, `#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="audio",NAME="default",DEFAULT=YES,AUTOSELECT=YES,URI="%s"`+"\n", p.Audio.Kind+".m3u8")
+			attrs += `,AUDIO="audio"`
+		}
+	}
+	fmt.Fprintf(&b, "#EXT-X-STREAM-INF:%s\n%s\n", attrs, uri)
+	files[HLSMaster] = []byte(b.String())
+	return files
+}
+
+func containsEmpty(list []string) bool {
+	for _, s := range list {
+		if s == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// 一路流的媒体播放列表(点播，带EXT-X-ENDLIST)
+// EXT-X-TARGETDURATION是分段时长四舍五入后的最大值(RFC 8216 4.3.3.1)
+func mediaPlaylist(s *Stream) []byte {
+	target := 1
+	for _, seg := range s.Segments {
+		target = max(target, int(math.Round(float64(seg.Duration)/float64(s.Timescale))))
+	}
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:7\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", target)
+	b.WriteString("#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXT-X-INDEPENDENT-SEGMENTS\n")
+	fmt.Fprintf(&b, "#EXT-X-MAP:URI=\"%s\"\n", s.Init)
+	for _, seg := range s.Segments {
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n%s\n", float64(seg.Duration)/float64(s.Timescale), seg.Name)
+	}
+	b.WriteString("#EXT-X-ENDLIST\n")
+	return []byte(b.String())
+}
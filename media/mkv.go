@@ -0,0 +1,385 @@
+package media
+
+//Matroska/WebM(EBML)的元信息：只读Segment里的Info和Tracks，不解复用
+//EBML元素：变长ID + 变长大小 + 内容；大小的数值位全为1表示未知(边录边写的Segment/Cluster)
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"strings"
+	"time"
+)
+
+// 用到的EBML元素ID
+const (
+	idEBML            = 0x1A45DFA3
+	idDocType         = 0x4282
+	idSegment         = 0x18538067
+	idSeekHead        = 0x114D9B74
+	idSeek            = 0x4DBB
+	idSeekID          = 0x53AB
+	idSeekPosition    = 0x53AC
+	idInfo            = 0x1549A966
+	idTimestampScale  = 0x2AD7B1
+	idDuration        = 0x4489
+	idTracks          = 0x1654AE6B
+	idTrackEntry      = 0xAE
+	idTrackType       = 0x83
+	idCodecID         = 0x86
+	idCodecPrivate    = 0x63A2
+	idDefaultDuration = 0x23E383
+	idVideo           = 0xE0
+	idPixelWidth      = 0xB0
+	idPixelHeight     = 0xBA
+	idCluster         = 0x1F43B675
+)
+
+// Info、Tracks等需要整个读进来的元素的大小限制，CodecPrivate一般只有几十字节
+const maxEBMLElement = 16 << 20
+
+// 大小未知
+const unknownSize = -1
+
+// 视频宽高的上限，超过时按文件损坏处理
+const maxPixelSize = 1 << 16
+
+// 解析出来的一个元素，data是去掉头部之后的内容
+type element struct {
+	id   uint32
+	data []byte
+}
+
+// 变长整数：第一个字节前导0的个数+1为长度；ID保留长度标记位，大小去掉标记位
+func readVint(b []byte, keepMarker bool) (uint64, int, bool) {
+	if len(b) == 0 || b[0] == 0 {
+		return 0, 0, false
+	}
+	n := bits.LeadingZeros8(b[0]) + 1
+	if len(b) < n {
+		return 0, 0, false
+	}
+	v := uint64(b[0])
+	if !keepMarker {
+		v &= 0xFF >> n
+	}
+	for i := 1; i < n; i++ {
+		v = v<<8 | uint64(b[i])
+	}
+	return v, n, true
+}
+
+// 元素头部：ID、内容大小(可能是unknownSize)、头部长度
+func elementHeader(b []byte) (uint32, int64, int, bool) {
+	id, n, ok := readVint(b, true)
+	if !ok || n > 4 {
+		return 0, 0, 0, false
+	}
+	size, m, ok := readVint(b[n:], false)
+	if !ok {
+		return 0, 0, 0, false
+	}
+	if size == 1<<(7*m)-1 {
+		return uint32(id), unknownSize, n + m, true
+	}
+	return uint32(id), int64(size), n + m, true
+}
+
+// 把一段数据拆成连续的元素，内存中的元素大小必须已知
+func parseElements(b []byte) ([]element, error) {
+	var elements []element
+	for len(b) > 0 {
+		id, size, n, ok := elementHeader(b)
+		if !ok || size == unknownSize || size > int64(len(b)-n) {
+			return nil, fmt.Errorf("%w: EBML元素错误", ErrUnsupported)
+		}
+		elements = append(elements, element{id: id, data: b[n : n+int(size)]})
+		b = b[n+int(size):]
+	}
+	return elements, nil
+}
+
+// 找第一个指定ID的子元素，找不到返回nil
+func childElement(b []byte, id uint32) []byte {
+	elements, err := parseElements(b)
+	if err != nil {
+		return nil
+	}
+	for _, e := range elements {
+		if e.id == id {
+			return e.data
+		}
+	}
+	return nil
+}
+
+func ebmlUint(b []byte) uint64 {
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+func ebmlFloat(b []byte) float64 {
+	switch len(b) {
+	case 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b)))
+	case 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+// 读取offset处元素的头部，end为所在父元素的结尾
+func readElementHeader(r io.ReaderAt, offset, end int64) (uint32, int64, int, error) {
+	if offset >= end {
+		return 0, 0, 0, fmt.Errorf("%w: 文件不完整", ErrUnsupported)
+	}
+	buf := make([]byte, 12)
+	n, err := r.ReadAt(buf[:min(int64(len(buf)), end-offset)], offset)
+	if n == 0 && err != nil && err != io.EOF {
+		return 0, 0, 0, err
+	}
+	id, size, headerLen, ok := elementHeader(buf[:n])
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("%w: EBML元素错误", ErrUnsupported)
+	}
+	return id, size, headerLen, nil
+}
+
+// 读取整个元素的内容
+func readElementData(r io.ReaderAt, offset, size, end int64) ([]byte, error) {
+	if size == unknownSize || size > maxEBMLElement || offset+size > end {
+		return nil, fmt.Errorf("%w: EBML元素大小错误", ErrUnsupported)
+	}
+	data := make([]byte, size)
+	if _, err := r.ReadAt(data, offset); err != nil {
+		if err == io.EOF {
+			return nil, fmt.Errorf("%w: 文件不完整", ErrUnsupported)
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+// Matroska/WebM：EBML头部的DocType区分两者
+// Info和Tracks一般在第一个Cluster之前，在后面时通过SeekHead找到
+func probeMatroska(r io.ReaderAt, size int64) (*Info, error) {
+	id, headerSize, headerLen, err := readElementHeader(r, 0, size)
+	if err != nil {
+		return nil, err
+	}
+	if id != idEBML || headerSize > 4096 {
+		return nil, fmt.Errorf("%w: 不是Matroska文件", ErrUnsupported)
+	}
+	header, err := readElementData(r, int64(headerLen), headerSize, size)
+	if err != nil {
+		return nil, err
+	}
+	info := &Info{}
+	switch docType := string(childElement(header, idDocType)); docType {
+	case "webm", "matroska":
+		info.Container = docType
+	default:
+		return nil, fmt.Errorf("%w: 不支持的DocType %q", ErrUnsupported, docType)
+	}
+
+	//跳过EBML头部后面的Void等元素，找到Segment
+	offset := int64(headerLen) + headerSize
+	var segStart, segEnd int64
+	for {
+		id, elemSize, n, err := readElementHeader(r, offset, size)
+		if err != nil {
+			return nil, err
+		}
+		if id == idSegment {
+			segStart, segEnd = offset+int64(n), size
+			if elemSize != unknownSize && segStart+elemSize < size {
+				segEnd = segStart + elemSize
+			}
+			break
+		}
+		if elemSize == unknownSize {
+			return nil, fmt.Errorf("%w: 没有Segment", ErrUnsupported)
+		}
+		offset += int64(n) + elemSize
+	}
+
+	var infoData, tracksData []byte
+	seeks := map[uint32]int64{}
+	for pos := segStart; pos < segEnd && (infoData == nil || tracksData == nil); {
+		id, elemSize, n, err := readElementHeader(r, pos, segEnd)
+		if err != nil {
+			return nil, err
+		}
+		if id == idCluster || elemSize == unknownSize {
+			break
+		}
+		switch id {
+		case idInfo, idTracks, idSeekHead:
+			data, err := readElementData(r, pos+int64(n), elemSize, segEnd)
+			if err != nil {
+				return nil, err
+			}
+			switch id {
+			case idInfo:
+				infoData = data
+			case idTracks:
+				tracksData = data
+			case idSeekHead:
+				parseSeekHead(data, seeks)
+			}
+		}
+		pos += int64(n) + elemSize
+	}
+	if infoData == nil {
+		infoData, err = seekElement(r, seeks, idInfo, segStart, segEnd)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if tracksData == nil {
+		tracksData, err = seekElement(r, seeks, idTracks, segStart, segEnd)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if tracksData == nil {
+		return nil, fmt.Errorf("%w: 没有Tracks", ErrUnsupported)
+	}
+	if err := parseMatroskaInfo(info, infoData); err != nil {
+		return nil, err
+	}
+	if err := parseMatroskaTracks(info, tracksData); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// SeekHead：元素ID -> 相对Segment内容开头的位置
+func parseSeekHead(b []byte, seeks map[uint32]int64) {
+	elements, err := parseElements(b)
+	if err != nil {
+		return
+	}
+	for _, e := range elements {
+		if e.id != idSeek {
+			continue
+		}
+		id := uint32(ebmlUint(childElement(e.data, idSeekID)))
+		pos := childElement(e.data, idSeekPosition)
+		if id != 0 && pos != nil {
+			seeks[id] = int64(ebmlUint(pos))
+		}
+	}
+}
+
+// 按SeekHead里记录的位置读取元素，没有记录时返回nil
+func seekElement(r io.ReaderAt, seeks map[uint32]int64, want uint32, segStart, segEnd int64) ([]byte, error) {
+	pos, ok := seeks[want]
+	if !ok || pos < 0 || segStart+pos >= segEnd {
+		return nil, nil
+	}
+	id, size, n, err := readElementHeader(r, segStart+pos, segEnd)
+	if err != nil {
+		return nil, err
+	}
+	if id != want {
+		return nil, fmt.Errorf("%w: SeekHead位置错误", ErrUnsupported)
+	}
+	return readElementData(r, segStart+pos+int64(n), size, segEnd)
+}
+
+// Info：Duration的单位是TimestampScale纳秒(默认1毫秒)；边录边写的文件没有Duration
+// Duration是浮点数，NaN、无穷大和负数按文件损坏处理
+func parseMatroskaInfo(info *Info, b []byte) error {
+	scale := uint64(1000000)
+	if v := childElement(b, idTimestampScale); v != nil {
+		scale = ebmlUint(v)
+	}
+	if v := childElement(b, idDuration); v != nil {
+		d, ok := secondsToDuration(ebmlFloat(v) * float64(scale) / float64(time.Second))
+		if !ok {
+			return fmt.Errorf("%w: Duration错误", ErrUnsupported)
+		}
+		info.Duration = d
+	}
+	return nil
+}
+
+// Tracks：取第一条视频轨道(TrackType为1)和第一条音频轨道(TrackType为2)
+func parseMatroskaTracks(info *Info, b []byte) error {
+	entries, err := parseElements(b)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.id != idTrackEntry {
+			continue
+		}
+		codec := matroskaCodec(string(childElement(e.data, idCodecID)), childElement(e.data, idCodecPrivate))
+		switch ebmlUint(childElement(e.data, idTrackType)) {
+		case 1:
+			if info.VideoCodec != "" {
+				continue
+			}
+			info.VideoCodec = codec
+			video := childElement(e.data, idVideo)
+			width, height := ebmlUint(childElement(video, idPixelWidth)), ebmlUint(childElement(video, idPixelHeight))
+			if width > maxPixelSize || height > maxPixelSize {
+				return fmt.Errorf("%w: 视频宽高错误", ErrUnsupported)
+			}
+			info.Width, info.Height = int(width), int(height)
+			//DefaultDuration是每帧的纳秒数，可变帧率的文件没有
+			if d := ebmlUint(childElement(e.data, idDefaultDuration)); d > 0 {
+				info.FrameRate = float64(time.Second) / float64(d)
+			}
+		case 2:
+			if info.AudioCodec == "" {
+				info.AudioCodec = codec
+			}
+		}
+	}
+	return nil
+}
+
+// Matroska的CodecID转成和MP4一致的编码名，H.264和AAC从CodecPrivate取出参数
+func matroskaCodec(id string, private []byte) string {
+	switch {
+	case id == "V_MPEG4/ISO/AVC":
+		//CodecPrivate是avcC的内容
+		if len(private) >= 4 {
+			return fmt.Sprintf("avc1.%02x%02x%02x", private[1], private[2], private[3])
+		}
+		return "avc1"
+	case id == "V_MPEGH/ISO/HEVC":
+		return "hvc1"
+	case id == "V_VP8":
+		return "vp8"
+	case id == "V_VP9":
+		return "vp9"
+	case id == "V_AV1":
+		return "av01"
+	case strings.HasPrefix(id, "A_AAC"):
+		//CodecPrivate是AudioSpecificConfig；老的文件用A_AAC/MPEG4/LC这样的CodecID
+		if len(private) >= 2 {
+			return fmt.Sprintf("mp4a.40.%d", aacObjectType(private[0], private[1]))
+		}
+		return "mp4a.40.2"
+	case id == "A_OPUS":
+		return "opus"
+	case id == "A_VORBIS":
+		return "vorbis"
+	case id == "A_FLAC":
+		return "flac"
+	case id == "A_MPEG/L3":
+		return "mp3"
+	case id == "A_AC3":
+		return "ac-3"
+	case id == "A_EAC3":
+		return "ec-3"
+	}
+	return id
+}
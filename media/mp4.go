@@ -0,0 +1,564 @@
+package media
+
+//MP4/MOV解复用：读取moov里的样本表(stbl)，得到每个样本在文件中的位置、大小和时间戳
+//只处理视频和音频轨道，每种只取第一条；不支持已经分片(fragmented)的MP4
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// 不是可以打包的MP4/MOV文件(格式不对、没有音视频轨道、已经分片等)
+var ErrUnsupported = errors.New("不支持的媒体文件")
+
+// moov最大允许的大小，样本表几十MB已经是几十个小时的视频
+const maxMoovSize = 256 << 20
+
+// 一条轨道最多的样本数，60fps的视频约77小时，避免伪造的样本表占用大量内存
+const maxSamples = 1 << 24
+
+// 单个样本的最大字节数，4K的关键帧一般也只有几MB
+const maxSampleSize = 64 << 20
+
+// 轨道类型
+const (
+	KindVideo = "video"
+	KindAudio = "audio"
+)
+
+// 一个样本(一帧视频或一个音频包)
+type Sample struct {
+	Offset int64  //在文件中的位置
+	Size   uint32 //字节数
+	DTS    uint64 //解码时间，单位是轨道的timescale
+	CTO    int32  //显示时间相对解码时间的偏移(B帧)
+	Dur    uint32 //时长
+	Key    bool   //关键帧
+}
+
+// 一条轨道
+type Track struct {
+	Kind       string
+	Timescale  uint32
+	Duration   uint64 //单位是Timescale
+	Codec      string //RFC 6381格式的codecs，如avc1.64001f、mp4a.40.2，不认识的编码为空
+	Format     string //样本描述里的四字符编码，如avc1、hvc1、mp4a
+	Width      int
+	Height     int
+	Channels   int
+	SampleRate int
+	Samples    []Sample
+
+	stsd []byte //原样的stsd box(含头部)，写入分片MP4的初始化段
+}
+
+// 解析后的影片
+type Movie struct {
+	Video *Track
+	Audio *Track
+
+	r io.ReaderAt
+}
+
+// 读取MP4/MOV文件的moov并展开样本表
+func Open(r io.ReaderAt, size int64) (*Movie, error) {
+	moov, err := readMoov(r, size)
+	if err != nil {
+		return nil, err
+	}
+	if findBox(moov, "mvex") != nil {
+		return nil, fmt.Errorf("%w: 已经是分片MP4", ErrUnsupported)
+	}
+	boxes, err := parseBoxes(moov)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnsupported, err)
+	}
+	movie := &Movie{r: r}
+	for _, bx := range boxes {
+		if bx.typ != "trak" {
+			continue
+		}
+		track, err := parseTrak(bx.data, size)
+		if err != nil {
+			return nil, err
+		}
+		if track == nil || len(track.Samples) == 0 {
+			continue
+		}
+		switch {
+		case track.Kind == KindVideo && movie.Video == nil:
+			movie.Video = track
+		case track.Kind == KindAudio && movie.Audio == nil:
+			movie.Audio = track
+		}
+	}
+	if movie.Video == nil && movie.Audio == nil {
+		return nil, fmt.Errorf("%w: 没有音视频轨道", ErrUnsupported)
+	}
+	return movie, nil
+}
+
+// 顺着顶层box找到moov，faststart的文件在开头，否则一般在mdat后面
+func readMoov(r io.ReaderAt, size int64) ([]byte, error) {
+	var offset int64
+	header := make([]byte, 16)
+	for offset+8 <= size {
+		n, err := r.ReadAt(header, offset)
+		if n < 8 {
+			if err == nil || err == io.EOF {
+				err = fmt.Errorf("%w: 文件不完整", ErrUnsupported)
+			}
+			return nil, err
+		}
+		boxSize := int64(binary.BigEndian.Uint32(header))
+		typ := string(header[4:8])
+		headerLen := int64(8)
+		switch boxSize {
+		case 0:
+			boxSize = size - offset
+		case 1:
+			if n < 16 {
+				return nil, fmt.Errorf("%w: 文件不完整", ErrUnsupported)
+			}
+			boxSize = int64(binary.BigEndian.Uint64(header[8:]))
+			headerLen = 16
+		}
+		//第一个box必须是ftyp(MOV也可能是wide/moov/mdat等)，否则不是ISO-BMFF
+		if offset == 0 && !knownTopLevel(typ) {
+			return nil, fmt.Errorf("%w: 不是MP4/MOV文件", ErrUnsupported)
+		}
+		if boxSize < headerLen || offset+boxSize > size {
+			return nil, fmt.Errorf("%w: box大小错误", ErrUnsupported)
+		}
+		if typ == "moov" {
+			if boxSize-headerLen > maxMoovSize {
+				return nil, fmt.Errorf("%w: moov过大", ErrUnsupported)
+			}
+			moov := make([]byte, boxSize-headerLen)
+			if _, err := r.ReadAt(moov, offset+headerLen); err != nil && err != io.EOF {
+				return nil, err
+			}
+			return moov, nil
+		}
+		offset += boxSize
+	}
+	return nil, fmt.Errorf("%w: 没有moov", ErrUnsupported)
+}
+
+func knownTopLevel(typ string) bool {
+	switch typ {
+	case "ftyp", "moov", "mdat", "free", "skip", "wide", "pnot":
+		return true
+	}
+	return false
+}
+
+// 解析一条轨道，不是音视频轨道时返回nil；size是文件大小，用来检查样本位置
+func parseTrak(trak []byte, size int64) (*Track, error) {
+	track, err := trackHeader(trak)
+	if track == nil || err != nil {
+		return nil, err
+	}
+	stbl := findBox(trak, "mdia", "minf", "stbl")
+	if stbl == nil {
+		return nil, fmt.Errorf("%w: 没有stbl", ErrUnsupported)
+	}
+	if err := parseStsd(track, stbl); err != nil {
+		return nil, err
+	}
+	samples, err := parseSampleTable(stbl, size)
+	if err != nil {
+		return nil, err
+	}
+	track.Samples = samples
+	if track.Duration == 0 && len(samples) > 0 {
+		last := samples[len(samples)-1]
+		track.Duration = last.DTS + uint64(last.Dur)
+	}
+	return track, nil
+}
+
+// 轨道类型(hdlr)和时间(mdhd)，不是音视频轨道时返回nil
+func trackHeader(trak []byte) (*Track, error) {
+	mdia := childBox(trak, "mdia")
+	hdlr := childBox(mdia, "hdlr")
+	if hdlr == nil || len(hdlr) < 12 {
+		return nil, nil
+	}
+	track := &Track{}
+	switch string(hdlr[8:12]) {
+	case "vide":
+		track.Kind = KindVideo
+	case "soun":
+		track.Kind = KindAudio
+	default:
+		return nil, nil
+	}
+	mdhd := &reader{b: childBox(mdia, "mdhd")}
+	if mdhd.u8() == 1 {
+		mdhd.skip(3 + 16)
+		track.Timescale = mdhd.u32()
+		track.Duration = mdhd.u64()
+	} else {
+		mdhd.skip(3 + 8)
+		track.Timescale = mdhd.u32()
+		track.Duration = uint64(mdhd.u32())
+	}
+	if mdhd.err || track.Timescale == 0 {
+		return nil, fmt.Errorf("%w: mdhd错误", ErrUnsupported)
+	}
+	return track, nil
+}
+
+// 样本描述：编码格式、分辨率/声道，保留原始stsd供初始化段使用
+func parseStsd(track *Track, stbl []byte) error {
+	boxes, err := parseBoxes(stbl)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUnsupported, err)
+	}
+	var stsd []byte
+	for _, bx := range boxes {
+		if bx.typ == "stsd" {
+			stsd = bx.data
+		}
+	}
+	if len(stsd) < 8 {
+		return fmt.Errorf("%w: 没有stsd", ErrUnsupported)
+	}
+	w := &writer{}
+	w.start("stsd")
+	w.bytes(stsd)
+	w.end()
+	track.stsd = w.b
+
+	entries, err := parseBoxes(stsd[8:])
+	if err != nil || len(entries) == 0 {
+		return fmt.Errorf("%w: 样本描述错误", ErrUnsupported)
+	}
+	entry := entries[0]
+	track.Format = entry.typ
+	r := &reader{b: entry.data}
+	r.skip(8) //reserved + data_reference_index
+	var children []byte
+	switch track.Kind {
+	case KindVideo:
+		r.skip(16)
+		track.Width = int(r.u16())
+		track.Height = int(r.u16())
+		if len(entry.data) > 78 {
+			children = entry.data[78:]
+		}
+	case KindAudio:
+		version := r.u16()
+		r.skip(6)
+		track.Channels = int(r.u16())
+		r.skip(6)
+		track.SampleRate = int(r.u32() >> 16)
+		//QuickTime的声音描述v1/v2后面还有额外字段
+		skip := 28
+		switch version {
+		case 1:
+			skip += 16
+		case 2:
+			skip += 36
+		}
+		if len(entry.data) > skip {
+			children = entry.data[skip:]
+		}
+	}
+	if r.err {
+		return fmt.Errorf("%w: 样本描述错误", ErrUnsupported)
+	}
+	track.Codec = codecString(entry.typ, children)
+	return nil
+}
+
+// 展开样本表：stsz样本大小、stsc+stco样本位置、stts解码时间、ctts显示偏移、stss关键帧
+// 样本数、样本大小和位置都要在文件范围内，数量在分配内存之前按box的内容长度检查
+func parseSampleTable(stbl []byte, size int64) ([]Sample, error) {
+	sizes, err := sampleSizes(stbl, size)
+	if err != nil {
+		return nil, err
+	}
+	samples := make([]Sample, len(sizes))
+	for i, s := range sizes {
+		samples[i].Size = s
+	}
+	if err := sampleOffsets(stbl, samples, size); err != nil {
+		return nil, err
+	}
+	if err := sampleTimes(stbl, samples); err != nil {
+		return nil, err
+	}
+	if err := sampleKeyframes(stbl, samples); err != nil {
+		return nil, err
+	}
+	return samples, nil
+}
+
+func sampleSizes(stbl []byte, size int64) ([]uint32, error) {
+	if stsz := childBox(stbl, "stsz"); stsz != nil {
+		r := &reader{b: stsz}
+		r.skip(4)
+		fixed := r.u32()
+		count := r.u32()
+		if r.err || count > maxSamples || fixed > maxSampleSize {
+			return nil, fmt.Errorf("%w: stsz错误", ErrUnsupported)
+		}
+		//固定大小时没有逐个样本的表，所有样本加起来不能超过文件大小
+		if (fixed == 0 && uint64(count)*4 > uint64(len(stsz)-r.pos)) || uint64(count)*uint64(fixed) > uint64(size) {
+			return nil, fmt.Errorf("%w: stsz错误", ErrUnsupported)
+		}
+		sizes := make([]uint32, count)
+		for i := range sizes {
+			if fixed != 0 {
+				sizes[i] = fixed
+			} else {
+				sizes[i] = r.u32()
+				if sizes[i] > maxSampleSize {
+					return nil, fmt.Errorf("%w: 样本过大", ErrUnsupported)
+				}
+			}
+		}
+		return sizes, nil
+	}
+	if stz2 := childBox(stbl, "stz2"); stz2 != nil {
+		r := &reader{b: stz2}
+		r.skip(7)
+		field := r.u8()
+		count := r.u32()
+		if r.err || count > maxSamples || (field != 4 && field != 8 && field != 16) || uint64(count)*uint64(field) > uint64(len(stz2)-r.pos)*8 {
+			return nil, fmt.Errorf("%w: stz2错误", ErrUnsupported)
+		}
+		sizes := make([]uint32, count)
+		for i := range sizes {
+			switch field {
+			case 4:
+				b := stz2[r.pos+i/2]
+				if i%2 == 0 {
+					sizes[i] = uint32(b >> 4)
+				} else {
+					sizes[i] = uint32(b & 0x0F)
+				}
+			case 8:
+				sizes[i] = uint32(r.u8())
+			case 16:
+				sizes[i] = uint32(r.u16())
+			}
+		}
+		return sizes, nil
+	}
+	return nil, fmt.Errorf("%w: 没有stsz", ErrUnsupported)
+}
+
+func sampleOffsets(stbl []byte, samples []Sample, size int64) error {
+	var chunks []int64
+	if stco := childBox(stbl, "stco"); stco != nil {
+		r := &reader{b: stco}
+		r.skip(4)
+		count := r.u32()
+		if uint64(count)*4 > uint64(len(stco)-r.pos) {
+			return fmt.Errorf("%w: stco错误", ErrUnsupported)
+		}
+		chunks = make([]int64, count)
+		for i := range chunks {
+			chunks[i] = int64(r.u32())
+		}
+	} else if co64 := childBox(stbl, "co64"); co64 != nil {
+		r := &reader{b: co64}
+		r.skip(4)
+		count := r.u32()
+		if uint64(count)*8 > uint64(len(co64)-r.pos) {
+			return fmt.Errorf("%w: co64错误", ErrUnsupported)
+		}
+		chunks = make([]int64, count)
+		for i := range chunks {
+			chunks[i] = int64(r.u64())
+		}
+	} else {
+		return fmt.Errorf("%w: 没有stco", ErrUnsupported)
+	}
+
+	r := &reader{b: childBox(stbl, "stsc")}
+	r.skip(4)
+	count := int(r.u32())
+	if r.err || count*12 > len(r.b)-r.pos {
+		return fmt.Errorf("%w: stsc错误", ErrUnsupported)
+	}
+	type stscEntry struct{ firstChunk, perChunk uint32 }
+	entries := make([]stscEntry, count)
+	for i := range entries {
+		entries[i] = stscEntry{r.u32(), r.u32()}
+		r.skip(4)
+	}
+	//每个chunk里的样本是连续存放的
+	sample := 0
+	for i, e := range entries {
+		last := uint32(len(chunks))
+		if i+1 < len(entries) {
+			last = entries[i+1].firstChunk - 1
+		}
+		for chunk := e.firstChunk; chunk >= 1 && chunk <= last && chunk <= uint32(len(chunks)); chunk++ {
+			offset := chunks[chunk-1]
+			for j := uint32(0); j < e.perChunk && sample < len(samples); j++ {
+				if offset < 0 || offset+int64(samples[sample].Size) > size {
+					return fmt.Errorf("%w: 样本超出文件范围", ErrUnsupported)
+				}
+				samples[sample].Offset = offset
+				offset += int64(samples[sample].Size)
+				sample++
+			}
+		}
+	}
+	if sample != len(samples) {
+		return fmt.Errorf("%w: 样本表不一致", ErrUnsupported)
+	}
+	return nil
+}
+
+func sampleTimes(stbl []byte, samples []Sample) error {
+	r := &reader{b: childBox(stbl, "stts")}
+	r.skip(4)
+	count := r.u32()
+	var dts uint64
+	sample := 0
+	for i := uint32(0); i < count && !r.err; i++ {
+		n, delta := r.u32(), r.u32()
+		for j := uint32(0); j < n && sample < len(samples); j++ {
+			samples[sample].DTS = dts
+			samples[sample].Dur = delta
+			dts += uint64(delta)
+			sample++
+		}
+	}
+	if r.err || sample != len(samples) {
+		return fmt.Errorf("%w: stts错误", ErrUnsupported)
+	}
+	ctts := childBox(stbl, "ctts")
+	if ctts == nil {
+		return nil
+	}
+	r = &reader{b: ctts}
+	r.skip(4)
+	count = r.u32()
+	sample = 0
+	for i := uint32(0); i < count && !r.err; i++ {
+		//版本0的偏移是无符号数，实际文件里也有当作有符号数写的，统一按int32处理
+		n, offset := r.u32(), int32(r.u32())
+		for j := uint32(0); j < n && sample < len(samples); j++ {
+			samples[sample].CTO = offset
+			sample++
+		}
+	}
+	if r.err {
+		return fmt.Errorf("%w: ctts错误", ErrUnsupported)
+	}
+	return nil
+}
+
+// 没有stss表示每个样本都是关键帧(音频一般如此)
+func sampleKeyframes(stbl []byte, samples []Sample) error {
+	stss := childBox(stbl, "stss")
+	if stss == nil {
+		for i := range samples {
+			samples[i].Key = true
+		}
+		return nil
+	}
+	r := &reader{b: stss}
+	r.skip(4)
+	count := r.u32()
+	for i := uint32(0); i < count && !r.err; i++ {
+		n := r.u32()
+		if n >= 1 && int(n) <= len(samples) {
+			samples[n-1].Key = true
+		}
+	}
+	if r.err {
+		return fmt.Errorf("%w: stss错误", ErrUnsupported)
+	}
+	return nil
+}
+
+// RFC 6381 codecs参数，HLS的CODECS属性和DASH的codecs属性都用它
+func codecString(format string, children []byte) string {
+	switch format {
+	case "avc1", "avc3":
+		avcC := childBox(children, "avcC")
+		if len(avcC) < 4 {
+			return ""
+		}
+		return fmt.Sprintf("%s.%02x%02x%02x", format, avcC[1], avcC[2], avcC[3])
+	case "mp4a":
+		esds := childBox(children, "esds")
+		if len(esds) < 4 {
+			return ""
+		}
+		return mp4aCodec(esds[4:])
+	}
+	return ""
+}
+
+// 从esds的描述符里取出objectTypeIndication和AAC的audioObjectType
+func mp4aCodec(b []byte) string {
+	r := &reader{b: b}
+	if r.u8() != 0x03 {
+		return ""
+	}
+	descriptorLen(r)
+	r.skip(2)
+	flags := r.u8()
+	if flags&0x80 != 0 {
+		r.skip(2)
+	}
+	if flags&0x40 != 0 {
+		r.skip(int(r.u8()))
+	}
+	if flags&0x20 != 0 {
+		r.skip(2)
+	}
+	if r.u8() != 0x04 {
+		return ""
+	}
+	descriptorLen(r)
+	oti := r.u8()
+	r.skip(12)
+	if r.err {
+		return ""
+	}
+	if oti != 0x40 {
+		return fmt.Sprintf("mp4a.%02x", oti)
+	}
+	if r.u8() != 0x05 {
+		return "mp4a.40.2"
+	}
+	descriptorLen(r)
+	b0, b1 := r.u8(), r.u8()
+	if r.err {
+		return "mp4a.40.2"
+	}
+	return fmt.Sprintf("mp4a.40.%d", aacObjectType(b0, b1))
+}
+
+// AudioSpecificConfig开头的audioObjectType，5位，为31时后面再跟6位
+func aacObjectType(b0, b1 byte) int {
+	aot := int(b0 >> 3)
+	if aot == 31 {
+		aot = 32 + int(b0&0x07)<<3 | int(b1>>5)
+	}
+	return aot
+}
+
+// 描述符长度：每字节7位，最高位为1表示后面还有
+func descriptorLen(r *reader) int {
+	n := 0
+	for i := 0; i < 4; i++ {
+		b := r.u8()
+		n = n<<7 | int(b&0x7F)
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	return n
+}
@@ -0,0 +1,157 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+)
+
+// 把第n个(从0开始)type为typ的box内容中偏移off处的4字节改成v，用来构造损坏的文件
+func patchBox(t testing.TB, b []byte, typ string, n, off int, v uint32) []byte {
+	t.Helper()
+	b = bytes.Clone(b)
+	pos := 0
+	for i := 0; ; i++ {
+		idx := bytes.Index(b[pos:], []byte(typ))
+		if idx < 0 {
+			t.Fatalf("找不到第%d个%s", n, typ)
+		}
+		pos += idx + 4
+		if i == n {
+			binary.BigEndian.PutUint32(b[pos+off:], v)
+			return b
+		}
+	}
+}
+
+func TestOpen(t *testing.T) {
+	b := readFixture(t, "sample.mp4")
+	movie, err := Open(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, a := movie.Video, movie.Audio
+	if v == nil || a == nil {
+		t.Fatalf("轨道不完整：video=%v audio=%v", v, a)
+	}
+	if v.Codec != "avc1.64001f" || v.Width != 1280 || v.Height != 720 || v.Timescale != 90000 {
+		t.Errorf("视频轨道 = %s %dx%d timescale %d", v.Codec, v.Width, v.Height, v.Timescale)
+	}
+	if a.Codec != "mp4a.40.2" || a.Channels != 2 || a.SampleRate != 44100 {
+		t.Errorf("音频轨道 = %s %d声道 %dHz", a.Codec, a.Channels, a.SampleRate)
+	}
+	if len(v.Samples) != fixtureVideoSamples || len(a.Samples) != fixtureAudioSamples {
+		t.Fatalf("样本数 = %d/%d", len(v.Samples), len(a.Samples))
+	}
+
+	//样本的位置和大小要对得上mdat里的内容
+	for i, s := range v.Samples {
+		if int(s.Size) != fixtureVideoSize(i) || s.DTS != uint64(i*fixtureVideoDelta) || s.Key != (i%15 == 0) {
+			t.Errorf("视频样本%d = %+v", i, s)
+		}
+		if got := b[s.Offset : s.Offset+int64(s.Size)]; !bytes.Equal(got, bytes.Repeat([]byte{byte(i)}, int(s.Size))) {
+			t.Errorf("视频样本%d的位置错误", i)
+		}
+	}
+	for i, s := range a.Samples {
+		if s.Size != fixtureAudioSize || s.DTS != uint64(i*1024) || !s.Key {
+			t.Errorf("音频样本%d = %+v", i, s)
+		}
+		if b[s.Offset] != byte(0x80+i) {
+			t.Errorf("音频样本%d的位置错误", i)
+		}
+	}
+}
+
+func TestOpenRejects(t *testing.T) {
+	b := readFixture(t, "sample.mp4")
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		//固定大小的stsz：样本数很大但没有逐个样本的表，不能按样本数分配内存
+		{"固定大小的样本数过大", patchBox(t, patchBox(t, b, "stsz", 0, 4, 1000), "stsz", 0, 8, maxSamples)},
+		{"样本数超过上限", patchBox(t, patchBox(t, b, "stsz", 1, 4, 1), "stsz", 1, 8, maxSamples+1)},
+		{"样本过大", patchBox(t, b, "stsz", 0, 12, maxSampleSize+1)},
+		{"样本超出文件范围", patchBox(t, b, "stco", 1, 8, uint32(len(b)-10))},
+		{"不是MP4", []byte("not a movie at all")},
+		{"空文件", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Open(bytes.NewReader(tt.data), int64(len(tt.data)))
+			if !errors.Is(err, ErrUnsupported) {
+				t.Errorf("err = %v，应该是ErrUnsupported", err)
+			}
+		})
+	}
+}
+
+// 截断在任何位置都只返回错误，不能panic
+func TestOpenTruncated(t *testing.T) {
+	b := readFixture(t, "sample.mp4")
+	for n := 0; n < len(b); n++ {
+		movie, err := Open(bytes.NewReader(b[:n]), int64(n))
+		if err == nil {
+			//moov在最后，截断后不应该还能打开
+			t.Fatalf("截断到%d字节仍然打开成功：%+v", n, movie)
+		}
+	}
+}
+
+func TestFragment(t *testing.T) {
+	b := readFixture(t, "sample.mp4")
+	movie, err := Open(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]int{}
+	pkg, err := movie.Fragment(400*time.Millisecond, func(name string, data []byte) error {
+		files[name] = len(data)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	//关键帧在第0帧和第15帧，每段0.5秒
+	if pkg.Video == nil || len(pkg.Video.Segments) != 2 {
+		t.Fatalf("视频分段 = %+v", pkg.Video)
+	}
+	if pkg.Audio == nil || len(pkg.Audio.Segments) != 2 {
+		t.Fatalf("音频分段 = %+v", pkg.Audio)
+	}
+	for _, s := range append(pkg.Video.Segments, pkg.Audio.Segments...) {
+		if files[s.Name] == 0 || int64(files[s.Name]) != s.Size {
+			t.Errorf("分段%s：写出%d字节，记录%d字节", s.Name, files[s.Name], s.Size)
+		}
+	}
+	if files[pkg.Video.Init] == 0 || files[pkg.Audio.Init] == 0 {
+		t.Errorf("没有写出初始化段：%v", files)
+	}
+}
+
+// go test -fuzz FuzzOpen ./media
+func FuzzOpen(f *testing.F) {
+	for name := range fixtures {
+		f.Add(readFixture(f, name))
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		movie, err := Open(bytes.NewReader(b), int64(len(b)))
+		if err != nil {
+			return
+		}
+		for _, track := range []*Track{movie.Video, movie.Audio} {
+			if track == nil {
+				continue
+			}
+			for _, s := range track.Samples {
+				if s.Offset < 0 || s.Offset+int64(s.Size) > int64(len(b)) {
+					t.Fatalf("样本超出文件范围：%+v", s)
+				}
+			}
+		}
+		movie.Fragment(time.Second, func(string, []byte) error { return nil })
+	})
+}
@@ -0,0 +1,208 @@
+package media
+
+//把解复用出来的样本切成分片MP4：视频在关键帧处切分，音频按相同的时间点切分，
+//这样不同轨道的第N个分段覆盖同一段时间，HLS和DASH都可以直接使用
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// 连续读取样本时允许跳过的最大空隙，交错存放的音视频数据一次读出来再拆开
+const maxReadGap = 64 << 10
+
+// 一次读取的最大字节数
+const maxReadRun = 32 << 20
+
+// 一个分段的样本数据的最大字节数，只有一个关键帧等异常文件会把很长的时间切成一个分段
+const maxSegmentData = 256 << 20
+
+// 写出一个打包文件，name是相对路径(如video_00001.m4s)
+type WriteFunc func(name string, data []byte) error
+
+// 一个媒体段
+type Segment struct {
+	Name     string
+	Start    uint64 //第一个样本的解码时间，单位是流的Timescale
+	Duration uint64 //单位是流的Timescale
+	Size     int64
+}
+
+// 打包后的一路流(视频或音频)
+type Stream struct {
+	Kind             string
+	Codec            string
+	Width            int
+	Height           int
+	Channels         int
+	SampleRate       int
+	Timescale        uint32
+	Init             string //初始化段文件名
+	Segments         []Segment
+	Bandwidth        int64 //峰值码率(bps)，按最大的分段计算
+	AverageBandwidth int64 //平均码率(bps)
+}
+
+// 时长(秒)
+func (s *Stream) Seconds() float64 {
+	var total uint64
+	for _, seg := range s.Segments {
+		total += seg.Duration
+	}
+	return float64(total) / float64(s.Timescale)
+}
+
+// 打包结果
+type Package struct {
+	Video *Stream
+	Audio *Stream
+}
+
+// 按目标时长切分并写出初始化段和媒体段；视频的分段以关键帧开头，实际时长可能比目标更长
+func (m *Movie) Fragment(target time.Duration, write WriteFunc) (*Package, error) {
+	if target <= 0 {
+		return nil, fmt.Errorf("分段时长必须大于0")
+	}
+	pkg := &Package{}
+	var bounds []uint64
+	var boundScale uint32
+	if m.Video != nil {
+		bounds = keyframeBounds(m.Video, target)
+		boundScale = m.Video.Timescale
+		stream, err := m.fragmentTrack(m.Video, bounds, boundScale, write)
+		if err != nil {
+			return nil, err
+		}
+		pkg.Video = stream
+	}
+	if m.Audio != nil {
+		if bounds == nil {
+			bounds = keyframeBounds(m.Audio, target)
+			boundScale = m.Audio.Timescale
+		}
+		stream, err := m.fragmentTrack(m.Audio, bounds, boundScale, write)
+		if err != nil {
+			return nil, err
+		}
+		pkg.Audio = stream
+	}
+	return pkg, nil
+}
+
+// 切分点(解码时间)：距离上一个切分点至少target的第一个关键帧
+func keyframeBounds(t *Track, target time.Duration) []uint64 {
+	step := uint64(target.Seconds() * float64(t.Timescale))
+	bounds := []uint64{t.Samples[0].DTS}
+	for _, s := range t.Samples[1:] {
+		if s.Key && s.DTS >= bounds[len(bounds)-1]+step {
+			bounds = append(bounds, s.DTS)
+		}
+	}
+	return bounds
+}
+
+// 按切分点(单位boundScale)把一条轨道的样本分组，每组写成一个媒体段
+func (m *Movie) fragmentTrack(t *Track, bounds []uint64, boundScale uint32, write WriteFunc) (*Stream, error) {
+	stream := &Stream{
+		Kind:       t.Kind,
+		Codec:      t.Codec,
+		Width:      t.Width,
+		Height:     t.Height,
+		Channels:   t.Channels,
+		SampleRate: t.SampleRate,
+		Timescale:  t.Timescale,
+		Init:       t.Kind + "_init.mp4",
+	}
+	var totalSize int64
+	var totalDur uint64
+	samples := t.Samples
+	for k := range bounds {
+		//第k段包含解码时间在[bounds[k],bounds[k+1])的样本，时间换算到同一个时间基比较
+		n := len(samples)
+		if k+1 < len(bounds) {
+			n = 0
+			for n < len(samples) && samples[n].DTS*uint64(boundScale) < bounds[k+1]*uint64(t.Timescale) {
+				n++
+			}
+		}
+		group := samples[:n]
+		samples = samples[n:]
+		if len(group) == 0 {
+			continue
+		}
+		data, err := m.readSamples(group)
+		if err != nil {
+			return nil, err
+		}
+		//分段按顺序连续编号(音频可能有空的分段被跳过)，DASH的$Number$模板要求编号连续
+		index := len(stream.Segments)
+		name := fmt.Sprintf("%s_%05d.m4s", t.Kind, index)
+		segment := mediaSegment(uint32(index+1), group, data)
+		if err := write(name, segment); err != nil {
+			return nil, err
+		}
+		var dur uint64
+		for _, s := range group {
+			dur += uint64(s.Dur)
+		}
+		stream.Segments = append(stream.Segments, Segment{
+			Name:     name,
+			Start:    group[0].DTS,
+			Duration: dur,
+			Size:     int64(len(segment)),
+		})
+		if dur > 0 {
+			stream.Bandwidth = max(stream.Bandwidth, int64(len(segment))*8*int64(t.Timescale)/int64(dur))
+		}
+		totalSize += int64(len(segment))
+		totalDur += dur
+	}
+	if len(stream.Segments) == 0 {
+		return nil, fmt.Errorf("%w: 没有样本", ErrUnsupported)
+	}
+	if totalDur > 0 {
+		stream.AverageBandwidth = totalSize * 8 * int64(t.Timescale) / int64(totalDur)
+	}
+	if err := write(stream.Init, initSegment(t)); err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// 读出一组样本的数据，按样本顺序拼接；位置相邻(或空隙很小)的样本合并成一次读取
+func (m *Movie) readSamples(samples []Sample) ([]byte, error) {
+	var total int
+	for _, s := range samples {
+		total += int(s.Size)
+	}
+	if total > maxSegmentData {
+		return nil, fmt.Errorf("%w: 分段过大", ErrUnsupported)
+	}
+	data := make([]byte, 0, total)
+	for i := 0; i < len(samples); {
+		start := samples[i].Offset
+		end := start + int64(samples[i].Size)
+		j := i + 1
+		for j < len(samples) {
+			s := samples[j]
+			if s.Offset < end || s.Offset-end > maxReadGap || s.Offset+int64(s.Size)-start > maxReadRun {
+				break
+			}
+			end = s.Offset + int64(s.Size)
+			j++
+		}
+		buf := make([]byte, end-start)
+		if n, err := m.r.ReadAt(buf, start); n < len(buf) {
+			if err == nil || err == io.EOF {
+				err = fmt.Errorf("%w: 样本超出文件范围", ErrUnsupported)
+			}
+			return nil, err
+		}
+		for _, s := range samples[i:j] {
+			off := s.Offset - start
+			data = append(data, buf[off:off+int64(s.Size)]...)
+		}
+		i = j
+	}
+	return data, nil
+}
@@ -0,0 +1,189 @@
+package media
+
+//探测媒体文件的元信息：时长、分辨率、编码、帧率、码率
+//MP4/MOV读moov里的mvhd/tkhd/mdhd/stsd，Matroska/WebM读Segment里的Info和Tracks(mkv.go)，都不需要读取音视频数据
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// 探测出来的元信息，文件里没有的字段为零值
+type Info struct {
+	Container  string //mp4、mov、webm、matroska
+	Duration   time.Duration
+	Width      int
+	Height     int
+	VideoCodec string //能解析出参数时为RFC 6381格式(如avc1.64001f、mp4a.40.2)，否则为编码名(如hvc1、vp9、opus)
+	AudioCodec string
+	FrameRate  float64
+	Bitrate    int64 //整个文件的平均码率，bit/s
+}
+
+// 探测MP4/MOV或Matroska/WebM文件，其他格式返回ErrUnsupported
+// 读取失败(如存储出错)时返回原始错误
+func Probe(r io.ReaderAt, size int64) (*Info, error) {
+	magic := make([]byte, 4)
+	if _, err := r.ReadAt(magic, 0); err != nil {
+		if err == io.EOF {
+			return nil, fmt.Errorf("%w: 文件不完整", ErrUnsupported)
+		}
+		return nil, err
+	}
+	var info *Info
+	var err error
+	if binary.BigEndian.Uint32(magic) == idEBML {
+		info, err = probeMatroska(r, size)
+	} else {
+		info, err = probeMP4(r, size)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if info.VideoCodec == "" && info.AudioCodec == "" {
+		return nil, fmt.Errorf("%w: 没有音视频轨道", ErrUnsupported)
+	}
+	if seconds := info.Duration.Seconds(); seconds > 0 {
+		//时长很短(文件损坏)时码率可能超出int64，这时不记录
+		if bitrate := float64(size) * 8 / seconds; bitrate < math.MaxInt64 {
+			info.Bitrate = int64(bitrate)
+		}
+	}
+	info.FrameRate = math.Round(info.FrameRate*1000) / 1000
+	return info, nil
+}
+
+// MP4/MOV：已经分片的MP4也可以探测，只是没有样本表时帧率为0
+func probeMP4(r io.ReaderAt, size int64) (*Info, error) {
+	moov, err := readMoov(r, size)
+	if err != nil {
+		return nil, err
+	}
+	info := &Info{Container: "mp4"}
+	//QuickTime的主品牌是"qt  "，很老的MOV文件没有ftyp
+	ftyp := make([]byte, 12)
+	if n, _ := r.ReadAt(ftyp, 0); n < 12 || string(ftyp[4:8]) != "ftyp" || string(ftyp[8:12]) == "qt  " {
+		info.Container = "mov"
+	}
+
+	mvhd := &reader{b: childBox(moov, "mvhd")}
+	var timescale uint32
+	var duration uint64
+	if mvhd.u8() == 1 {
+		mvhd.skip(3 + 16)
+		timescale = mvhd.u32()
+		duration = mvhd.u64()
+	} else {
+		mvhd.skip(3 + 8)
+		timescale = mvhd.u32()
+		duration = uint64(mvhd.u32())
+		if duration == math.MaxUint32 {
+			duration = 0
+		}
+	}
+	//分片MP4的mvhd时长一般为0，总时长在mehd里
+	if duration == 0 {
+		mehd := &reader{b: findBox(moov, "mvex", "mehd")}
+		if mehd.u8() == 1 {
+			mehd.skip(3)
+			duration = mehd.u64()
+		} else {
+			mehd.skip(3)
+			duration = uint64(mehd.u32())
+		}
+	}
+	if !mvhd.err && timescale > 0 {
+		d, ok := secondsToDuration(float64(duration) / float64(timescale))
+		if !ok {
+			return nil, fmt.Errorf("%w: mvhd时长错误", ErrUnsupported)
+		}
+		info.Duration = d
+	}
+
+	boxes, err := parseBoxes(moov)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnsupported, err)
+	}
+	for _, bx := range boxes {
+		if bx.typ != "trak" {
+			continue
+		}
+		track, err := trackHeader(bx.data)
+		if err != nil || track == nil {
+			continue
+		}
+		stbl := findBox(bx.data, "mdia", "minf", "stbl")
+		if stbl == nil || parseStsd(track, stbl) != nil {
+			continue
+		}
+		switch {
+		case track.Kind == KindVideo && info.VideoCodec == "":
+			info.VideoCodec = probeCodec(track)
+			info.Width, info.Height = track.Width, track.Height
+			if w, h := displaySize(bx.data); w > 0 && h > 0 {
+				info.Width, info.Height = w, h
+			}
+			if track.Duration > 0 {
+				info.FrameRate = float64(sampleCount(stbl)) * float64(track.Timescale) / float64(track.Duration)
+			}
+		case track.Kind == KindAudio && info.AudioCodec == "":
+			info.AudioCodec = probeCodec(track)
+		}
+	}
+	return info, nil
+}
+
+// 秒数转成time.Duration，NaN、负数、无穷大或超出time.Duration的范围时返回false
+func secondsToDuration(seconds float64) (time.Duration, bool) {
+	if math.IsNaN(seconds) || seconds < 0 || seconds >= float64(math.MaxInt64/int64(time.Second)) {
+		return 0, false
+	}
+	return time.Duration(seconds * float64(time.Second)), true
+}
+
+// 认不出参数的编码用样本描述的四字符编码
+func probeCodec(t *Track) string {
+	if t.Codec != "" {
+		return t.Codec
+	}
+	return t.Format
+}
+
+// tkhd里的显示宽高(16.16定点数)，旋转90度/270度的视频(手机竖拍)交换宽高
+func displaySize(trak []byte) (int, int) {
+	r := &reader{b: childBox(trak, "tkhd")}
+	if r.u8() == 1 {
+		r.skip(3 + 8 + 8 + 4 + 4 + 8 + 16)
+	} else {
+		r.skip(3 + 4 + 4 + 4 + 4 + 4 + 16)
+	}
+	//变换矩阵的前两项a、b：a为0且b不为0表示旋转了90度或270度
+	a, b := r.u32(), r.u32()
+	r.skip(28)
+	width, height := int(r.u32()>>16), int(r.u32()>>16)
+	if r.err {
+		return 0, 0
+	}
+	if a == 0 && b != 0 {
+		width, height = height, width
+	}
+	return width, height
+}
+
+// stts里的样本总数
+func sampleCount(stbl []byte) uint64 {
+	r := &reader{b: childBox(stbl, "stts")}
+	r.skip(4)
+	count := r.u32()
+	var total uint64
+	for i := uint32(0); i < count && !r.err; i++ {
+		total += uint64(r.u32())
+		r.skip(4)
+	}
+	if r.err {
+		return 0
+	}
+	return total
+}
@@ -0,0 +1,107 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestProbe(t *testing.T) {
+	tests := []struct {
+		file string
+		want Info //Bitrate按文件大小计算
+	}{
+		{"sample.mp4", Info{Container: "mp4", Duration: time.Second, Width: 1280, Height: 720,
+			VideoCodec: "avc1.64001f", AudioCodec: "mp4a.40.2", FrameRate: 30}},
+		{"sample_rotated.mov", Info{Container: "mov", Duration: time.Second, Width: 720, Height: 1280,
+			VideoCodec: "avc1.64001f", AudioCodec: "mp4a.40.2", FrameRate: 30}},
+		{"sample.webm", Info{Container: "webm", Duration: time.Second, Width: 1280, Height: 720,
+			VideoCodec: "vp9", AudioCodec: "opus", FrameRate: 30}},
+		{"sample.mkv", Info{Container: "matroska", Duration: 2 * time.Second, Width: 1920, Height: 1080,
+			VideoCodec: "avc1.4d4028", AudioCodec: "mp4a.40.2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			b := readFixture(t, tt.file)
+			info, err := Probe(bytes.NewReader(b), int64(len(b)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := tt.want
+			want.Bitrate = int64(float64(len(b)) * 8 / want.Duration.Seconds())
+			if *info != want {
+				t.Errorf("Probe() = %+v\n想要 %+v", *info, want)
+			}
+		})
+	}
+}
+
+func TestProbeInvalidDuration(t *testing.T) {
+	tests := []struct {
+		name     string
+		duration []byte
+	}{
+		{"NaN", ebmlFloat64Data(math.NaN())},
+		{"正无穷", ebmlFloat64Data(math.Inf(1))},
+		{"负无穷", ebmlFloat64Data(math.Inf(-1))},
+		{"负数", ebmlFloat64Data(-1000)},
+		{"超出范围", ebmlFloat64Data(1e300)},
+		{"float32的NaN", binary.BigEndian.AppendUint32(nil, math.Float32bits(float32(math.NaN())))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := buildWebM(tt.duration)
+			info, err := Probe(bytes.NewReader(b), int64(len(b)))
+			if !errors.Is(err, ErrUnsupported) {
+				t.Errorf("Probe() = %+v, %v，应该返回ErrUnsupported", info, err)
+			}
+		})
+	}
+}
+
+// 64位的mvhd时长除以timescale超出time.Duration的范围
+func TestProbeMP4DurationOverflow(t *testing.T) {
+	b := buildMP4(mp4Options{duration: math.MaxUint64 / 2})
+	info, err := Probe(bytes.NewReader(b), int64(len(b)))
+	if !errors.Is(err, ErrUnsupported) {
+		t.Errorf("Probe() = %+v, %v，应该返回ErrUnsupported", info, err)
+	}
+}
+
+// 不管输入是什么，探测结果都要是合理的值
+func checkInfo(t *testing.T, info *Info) {
+	t.Helper()
+	if info.Duration < 0 || info.Bitrate < 0 || info.Width < 0 || info.Height < 0 ||
+		math.IsNaN(info.FrameRate) || math.IsInf(info.FrameRate, 0) || info.FrameRate < 0 {
+		t.Fatalf("探测结果不合理：%+v", *info)
+	}
+}
+
+// 截断在任何位置都不能panic
+func TestProbeTruncated(t *testing.T) {
+	for name := range fixtures {
+		b := readFixture(t, name)
+		for n := 0; n < len(b); n++ {
+			info, err := Probe(bytes.NewReader(b[:n]), int64(n))
+			if err == nil {
+				checkInfo(t, info)
+			}
+		}
+	}
+}
+
+// go test -fuzz FuzzProbe ./media
+func FuzzProbe(f *testing.F) {
+	for name := range fixtures {
+		f.Add(readFixture(f, name))
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		info, err := Probe(bytes.NewReader(b), int64(len(b)))
+		if err == nil {
+			checkInfo(t, info)
+		}
+	})
+}
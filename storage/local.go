@@ -0,0 +1,318 @@
+package storage
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// 本地磁盘实现，用于开发和CI等没有MinIO的环境
+// 对象key(用/分隔)直接映射为root下的相对路径
+// root/.multipart/<uploadId>/ 下存放分片上传中的各个分片，root/.tmp/ 下存放写入中的临时文件
+type localStorage struct {
+	root string
+}
+
+const (
+	multipartDir = ".multipart"
+	tmpDir       = ".tmp"
+)
+
+// 创建本地存储，root不存在会自动创建
+func NewLocal(root string) (Storage, error) {
+	if root == "" {
+		return nil, errors.New("本地存储的根目录不能为空")
+	}
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range []string{abs, filepath.Join(abs, multipartDir), filepath.Join(abs, tmpDir)} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("创建本地存储目录失败：%w", err)
+		}
+	}
+	return &localStorage{root: abs}, nil
+}
+
+// 把对象key转换成磁盘路径，防止../之类的路径穿越
+func (s *localStorage) objectPath(key string) (string, error) {
+	cleaned := path.Clean("/" + key)[1:]
+	if cleaned == "" || cleaned != key || strings.HasPrefix(cleaned, ".") {
+		return "", fmt.Errorf("非法的对象名：%q", key)
+	}
+	return filepath.Join(s.root, filepath.FromSlash(cleaned)), nil
+}
+
+// 分片上传的目录，uploadId由NewMultipartUpload生成(UUID)，这里也校验一下
+func (s *localStorage) uploadDir(uploadId string) (string, error) {
+	if _, err := uuid.Parse(uploadId); err != nil {
+		return "", ErrNotFound
+	}
+	dir := filepath.Join(s.root, multipartDir, uploadId)
+	if _, err := os.Stat(dir); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", ErrNotFound
+		}
+		return "", err
+	}
+	return dir, nil
+}
+
+// 先写临时文件，写完再重命名，避免读到写了一半的对象。返回内容的MD5和实际写入的字节数
+func (s *localStorage) writeFile(dst string, r io.Reader) (string, int64, error) {
+	tmp, err := os.CreateTemp(filepath.Join(s.root, tmpDir), "put-*")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(tmp.Name()) //重命名成功后这里删除会失败，忽略即可
+
+	hash := md5.New()
+	n, err := io.Copy(io.MultiWriter(tmp, hash), r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return "", 0, err
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), n, nil
+}
+
+func (s *localStorage) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) (ObjectInfo, error) {
+	p, err := s.objectPath(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if size >= 0 {
+		r = io.LimitReader(r, size)
+	}
+	etag, n, err := s.writeFile(p, r)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if size >= 0 && n != size {
+		os.Remove(p)
+		return ObjectInfo{}, fmt.Errorf("数据不完整：期望%d字节，实际%d字节", size, n)
+	}
+	info, err := s.Stat(ctx, key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	info.ETag = etag
+	return info, nil
+}
+
+// 本地文件加上Close，满足io.ReadCloser
+type sectionReadCloser struct {
+	io.Reader
+	f *os.File
+}
+
+func (r *sectionReadCloser) Close() error { return r.f.Close() }
+
+func (s *localStorage) Get(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	p, err := s.objectPath(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if offset < 0 || offset > fi.Size() {
+		f.Close()
+		return nil, fmt.Errorf("读取范围越界：offset=%d size=%d", offset, fi.Size())
+	}
+	if length <= 0 || offset+length > fi.Size() {
+		length = fi.Size() - offset
+	}
+	return &sectionReadCloser{Reader: io.NewSectionReader(f, offset, length), f: f}, nil
+}
+
+func (s *localStorage) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	p, err := s.objectPath(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return ObjectInfo{}, ErrNotFound
+		}
+		return ObjectInfo{}, err
+	}
+	if fi.IsDir() {
+		return ObjectInfo{}, ErrNotFound
+	}
+	return s.fileInfo(key, fi), nil
+}
+
+// 本地文件没有单独保存元信息：ContentType按后缀推断，ETag由大小和修改时间生成
+func (s *localStorage) fileInfo(key string, fi fs.FileInfo) ObjectInfo {
+	contentType := mime.TypeByExtension(path.Ext(key))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	return ObjectInfo{
+		Key:          key,
+		Size:         fi.Size(),
+		ContentType:  contentType,
+		ETag:         fmt.Sprintf("%x-%x", fi.ModTime().UnixNano(), fi.Size()),
+		LastModified: fi.ModTime(),
+	}
+}
+
+func (s *localStorage) Delete(ctx context.Context, key string) error {
+	p, err := s.objectPath(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (s *localStorage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	err := filepath.WalkDir(s.root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(s.root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if d.IsDir() {
+			//跳过.multipart和.tmp等内部目录
+			if key != "." && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, s.fileInfo(key, fi))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+func (s *localStorage) NewMultipartUpload(ctx context.Context, key string, contentType string) (string, error) {
+	if _, err := s.objectPath(key); err != nil {
+		return "", err
+	}
+	uploadId := uuid.New().String()
+	if err := os.MkdirAll(filepath.Join(s.root, multipartDir, uploadId), 0o755); err != nil {
+		return "", err
+	}
+	return uploadId, nil
+}
+
+func partFileName(partNumber int) string {
+	return fmt.Sprintf("part-%05d", partNumber)
+}
+
+func (s *localStorage) PutPart(ctx context.Context, key, uploadId string, partNumber int, r io.Reader, size int64) (Part, error) {
+	//和S3一致，分片编号范围1~10000
+	if partNumber < 1 || partNumber > 10000 {
+		return Part{}, fmt.Errorf("非法的分片编号：%d", partNumber)
+	}
+	dir, err := s.uploadDir(uploadId)
+	if err != nil {
+		return Part{}, err
+	}
+	if size >= 0 {
+		r = io.LimitReader(r, size)
+	}
+	etag, n, err := s.writeFile(filepath.Join(dir, partFileName(partNumber)), r)
+	if err != nil {
+		return Part{}, err
+	}
+	if size >= 0 && n != size {
+		return Part{}, fmt.Errorf("分片数据不完整：期望%d字节，实际%d字节", size, n)
+	}
+	return Part{PartNumber: partNumber, ETag: etag, Size: n}, nil
+}
+
+func (s *localStorage) CompleteMultipartUpload(ctx context.Context, key, uploadId string, parts []Part) error {
+	dst, err := s.objectPath(key)
+	if err != nil {
+		return err
+	}
+	dir, err := s.uploadDir(uploadId)
+	if err != nil {
+		return err
+	}
+	//和S3一样要求分片编号递增
+	if !sort.SliceIsSorted(parts, func(i, j int) bool { return parts[i].PartNumber < parts[j].PartNumber }) {
+		return errors.New("分片编号必须递增")
+	}
+	//按顺序把所有分片拼成一个文件
+	pr, pw := io.Pipe()
+	go func() {
+		for _, part := range parts {
+			f, err := os.Open(filepath.Join(dir, partFileName(part.PartNumber)))
+			if err != nil {
+				pw.CloseWithError(fmt.Errorf("分片%d不存在：%w", part.PartNumber, err))
+				return
+			}
+			_, err = io.Copy(pw, f)
+			f.Close()
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.Close()
+	}()
+	_, _, err = s.writeFile(dst, pr)
+	pr.Close()
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+func (s *localStorage) AbortMultipartUpload(ctx context.Context, key, uploadId string) error {
+	dir, err := s.uploadDir(uploadId)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
@@ -0,0 +1,161 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func newTestLocal(t *testing.T) Storage {
+	t.Helper()
+	s, err := NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func readAll(t *testing.T, s Storage, key string, offset, length int64) string {
+	t.Helper()
+	body, err := s.Get(context.Background(), key, offset, length)
+	if err != nil {
+		t.Fatalf("Get(%q, %d, %d)：%v", key, offset, length, err)
+	}
+	defer body.Close()
+	b, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestLocalGet(t *testing.T) {
+	s := newTestLocal(t)
+	ctx := context.Background()
+	if _, err := s.Put(ctx, "videos/1/a.mp4", strings.NewReader("0123456789"), 10, "video/mp4"); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name           string
+		offset, length int64
+		want           string
+	}{
+		{"整个对象", 0, -1, "0123456789"},
+		{"length为0读到末尾", 0, 0, "0123456789"},
+		{"从中间读到末尾", 4, -1, "456789"},
+		{"从中间读到末尾(length为0)", 4, 0, "456789"},
+		{"中间一段", 2, 3, "234"},
+		{"超出末尾的部分被截断", 8, 100, "89"},
+		{"offset在末尾", 10, -1, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := readAll(t, s, "videos/1/a.mp4", tt.offset, tt.length); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := s.Get(ctx, "videos/1/a.mp4", 11, -1); err == nil {
+		t.Error("offset超出文件大小应该返回错误")
+	}
+	if _, err := s.Get(ctx, "videos/1/missing.mp4", 0, -1); !errors.Is(err, ErrNotFound) {
+		t.Errorf("对象不存在：err = %v", err)
+	}
+}
+
+func TestLocalObjectPath(t *testing.T) {
+	s := newTestLocal(t)
+	ctx := context.Background()
+	for _, key := range []string{"", "../escape", "a/../../escape", "/abs", ".multipart/x", "a//b"} {
+		if _, err := s.Put(ctx, key, strings.NewReader("x"), 1, ""); err == nil {
+			t.Errorf("Put(%q)应该返回错误", key)
+		}
+	}
+}
+
+func TestLocalPutSizeMismatch(t *testing.T) {
+	s := newTestLocal(t)
+	ctx := context.Background()
+	if _, err := s.Put(ctx, "a.mp4", strings.NewReader("short"), 10, ""); err == nil {
+		t.Fatal("数据不完整时应该返回错误")
+	}
+	if _, err := s.Stat(ctx, "a.mp4"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("不完整的对象应该被删除：err = %v", err)
+	}
+}
+
+func TestLocalMultipart(t *testing.T) {
+	s := newTestLocal(t)
+	ctx := context.Background()
+	uploadId, err := s.NewMultipartUpload(ctx, "videos/1/b.mp4", "video/mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//乱序上传，按编号合并
+	var parts []Part
+	for _, n := range []int{2, 1, 3} {
+		data := bytes.Repeat([]byte{byte('a' + n - 1)}, 4)
+		part, err := s.PutPart(ctx, "videos/1/b.mp4", uploadId, n, bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts = append(parts, part)
+	}
+	if err := s.CompleteMultipartUpload(ctx, "videos/1/b.mp4", uploadId, parts); err == nil {
+		t.Fatal("分片编号不递增时应该返回错误")
+	}
+	parts[0], parts[1] = parts[1], parts[0]
+	if err := s.CompleteMultipartUpload(ctx, "videos/1/b.mp4", uploadId, parts); err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, s, "videos/1/b.mp4", 0, 0); got != "aaaabbbbcccc" {
+		t.Errorf("合并结果 = %q", got)
+	}
+	//完成后分片目录被删除
+	if err := s.AbortMultipartUpload(ctx, "videos/1/b.mp4", uploadId); !errors.Is(err, ErrNotFound) {
+		t.Errorf("完成后再终止：err = %v", err)
+	}
+	if _, err := s.PutPart(ctx, "videos/1/b.mp4", "not-a-uuid", 1, strings.NewReader("x"), 1); !errors.Is(err, ErrNotFound) {
+		t.Errorf("非法的uploadId：err = %v", err)
+	}
+}
+
+func TestLocalListAndDelete(t *testing.T) {
+	s := newTestLocal(t)
+	ctx := context.Background()
+	for _, key := range []string{"videos/1/a.mp4", "videos/1/a/hls/master.m3u8", "videos/2/c.mp4"} {
+		if _, err := s.Put(ctx, key, strings.NewReader("x"), 1, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//进行中的分片上传不出现在列表里
+	if _, err := s.NewMultipartUpload(ctx, "videos/1/d.mp4", ""); err != nil {
+		t.Fatal(err)
+	}
+	objects, err := s.List(ctx, "videos/1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, o := range objects {
+		keys = append(keys, o.Key)
+	}
+	sort.Strings(keys)
+	if got := strings.Join(keys, ","); got != "videos/1/a.mp4,videos/1/a/hls/master.m3u8" {
+		t.Errorf("List = %s", got)
+	}
+	if err := s.Delete(ctx, "videos/1/a.mp4"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(ctx, "videos/1/a.mp4"); err != nil {
+		t.Errorf("删除不存在的对象不算错误：%v", err)
+	}
+	if _, err := s.Stat(ctx, "videos/1/a.mp4"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("删除后Stat：err = %v", err)
+	}
+}
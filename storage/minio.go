@@ -0,0 +1,183 @@
+package storage
+
+import (
+	"Project01/config"
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// MinIO实现
+type minioStorage struct {
+	//Core客户端内嵌了高层的*minio.Client。
+	//高层API:PutObject上传对象，GetObject下载对象，RemoveObject 删除对象
+	//Core提供接近原始S3协议的接口：NewMultipartUpload,PutObjectPart,CompleteMultipartUpload,AbortMultipartUpload
+	core   *minio.Core
+	bucket string //桶名
+}
+
+// 初始化MinIO客户端
+func NewMinio(cfg config.StorageConfig) (Storage, error) {
+	core, err := minio.NewCore(cfg.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.AccessKeyID, cfg.SecretAccessKey, ""),
+		Secure: cfg.UseSSL,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &minioStorage{core: core, bucket: cfg.Bucket}, nil
+}
+
+// 把MinIO的"对象不存在"错误转换成ErrNotFound
+func convertErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	switch minio.ToErrorResponse(err).Code {
+	case "NoSuchKey", "NoSuchUpload":
+		return ErrNotFound
+	}
+	return err
+}
+
+func toObjectInfo(info minio.ObjectInfo) ObjectInfo {
+	return ObjectInfo{
+		Key:          info.Key,
+		Size:         info.Size,
+		ContentType:  info.ContentType,
+		ETag:         info.ETag,
+		LastModified: info.LastModified,
+	}
+}
+
+func (s *minioStorage) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) (ObjectInfo, error) {
+	info, err := s.core.Client.PutObject(ctx, s.bucket, key, r, size,
+		minio.PutObjectOptions{ContentType: contentType})
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{
+		Key:          info.Key,
+		Size:         info.Size,
+		ContentType:  contentType,
+		ETag:         info.ETag,
+		LastModified: info.LastModified,
+	}, nil
+}
+
+func (s *minioStorage) Get(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	opts := minio.GetObjectOptions{}
+	switch {
+	case length > 0:
+		if err := opts.SetRange(offset, offset+length-1); err != nil {
+			return nil, err
+		}
+	case offset > 0:
+		//bytes=offset-
+		if err := opts.SetRange(offset, 0); err != nil {
+			return nil, err
+		}
+	}
+	//GetObject是懒加载的，不会立即发请求，要Stat一下才知道对象是否存在
+	obj, err := s.core.Client.GetObject(ctx, s.bucket, key, opts)
+	if err != nil {
+		return nil, convertErr(err)
+	}
+	if _, err := obj.Stat(); err != nil {
+		obj.Close()
+		return nil, convertErr(err)
+	}
+	return obj, nil
+}
+
+func (s *minioStorage) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	info, err := s.core.Client.StatObject(ctx, s.bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		return ObjectInfo{}, convertErr(err)
+	}
+	return toObjectInfo(info), nil
+}
+
+func (s *minioStorage) Delete(ctx context.Context, key string) error {
+	return s.core.Client.RemoveObject(ctx, s.bucket, key, minio.RemoveObjectOptions{})
+}
+
+func (s *minioStorage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	for info := range s.core.Client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if info.Err != nil {
+			return nil, info.Err
+		}
+		objects = append(objects, toObjectInfo(info))
+	}
+	return objects, nil
+}
+
+func (s *minioStorage) NewMultipartUpload(ctx context.Context, key string, contentType string) (string, error) {
+	return s.core.NewMultipartUpload(ctx, s.bucket, key, minio.PutObjectOptions{ContentType: contentType})
+}
+
+func (s *minioStorage) PutPart(ctx context.Context, key, uploadId string, partNumber int, r io.Reader, size int64) (Part, error) {
+	res, err := s.core.PutObjectPart(ctx, s.bucket, key, uploadId, partNumber, r, size, minio.PutObjectPartOptions{})
+	if err != nil {
+		return Part{}, convertErr(err)
+	}
+	return Part{PartNumber: res.PartNumber, ETag: res.ETag, Size: res.Size}, nil
+}
+
+func (s *minioStorage) CompleteMultipartUpload(ctx context.Context, key, uploadId string, parts []Part) error {
+	completeParts := make([]minio.CompletePart, 0, len(parts))
+	for _, p := range parts {
+		completeParts = append(completeParts, minio.CompletePart{PartNumber: p.PartNumber, ETag: p.ETag})
+	}
+	_, err := s.core.CompleteMultipartUpload(ctx, s.bucket, key, uploadId, completeParts, minio.PutObjectOptions{})
+	return convertErr(err)
+}
+
+func (s *minioStorage) AbortMultipartUpload(ctx context.Context, key, uploadId string) error {
+	return convertErr(s.core.AbortMultipartUpload(ctx, s.bucket, key, uploadId))
+}
+
+func (s *minioStorage) PresignGet(ctx context.Context, key string, expires time.Duration) (string, error) {
+	u, err := s.core.PresignedGetObject(ctx, s.bucket, key, expires, nil)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+// 分片的预签名URL：对PUT /<key>?partNumber=N&uploadId=xxx签名，和PutObjectPart发出的请求一致
+func (s *minioStorage) PresignPart(ctx context.Context, key, uploadId string, partNumber int, expires time.Duration) (string, error) {
+	params := url.Values{}
+	params.Set("partNumber", strconv.Itoa(partNumber))
+	params.Set("uploadId", uploadId)
+	u, err := s.core.Presign(ctx, http.MethodPut, s.bucket, key, expires, params)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+func (s *minioStorage) ListParts(ctx context.Context, key, uploadId string) ([]Part, error) {
+	var parts []Part
+	marker := 0
+	for {
+		res, err := s.core.ListObjectParts(ctx, s.bucket, key, uploadId, marker, 1000)
+		if err != nil {
+			return nil, convertErr(err)
+		}
+		for _, p := range res.ObjectParts {
+			parts = append(parts, Part{PartNumber: p.PartNumber, ETag: p.ETag, Size: p.Size})
+		}
+		if !res.IsTruncated {
+			return parts, nil
+		}
+		marker = res.NextPartNumberMarker
+	}
+}
@@ -0,0 +1,74 @@
+package storage
+
+//对象存储的抽象层：video包只依赖这里的Storage接口，不再直接操作MinIO客户端
+//目前有两种实现：MinIO(minio.go)和本地磁盘(local.go)，由配置storage.backend选择
+import (
+	"Project01/config"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// 对象不存在时各实现统一返回的错误，调用方用errors.Is判断
+var ErrNotFound = errors.New("对象不存在")
+
+// 对象元信息
+type ObjectInfo struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	ContentType  string    `json:"content_type"`
+	ETag         string    `json:"etag"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+// 分片上传中已上传的一个分片，Complete时需要按顺序传回
+type Part struct {
+	PartNumber int    //分片编号，从1开始
+	ETag       string //上传分片后存储端返回的标识
+	Size       int64  //分片大小
+}
+
+// 对象存储接口
+type Storage interface {
+	//上传对象，size为-1表示大小未知
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) (ObjectInfo, error)
+	//读取对象的[offset,offset+length)部分，length<=0表示一直读到末尾(和MinIO的Range一致)
+	Get(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error)
+	//获取对象元信息
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+	//删除对象，对象不存在不算错误
+	Delete(ctx context.Context, key string) error
+	//列出以prefix开头的所有对象
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+
+	//分片上传：初始化 -> 上传分片 -> 完成(或终止)
+	NewMultipartUpload(ctx context.Context, key string, contentType string) (string, error)
+	PutPart(ctx context.Context, key, uploadId string, partNumber int, r io.Reader, size int64) (Part, error)
+	CompleteMultipartUpload(ctx context.Context, key, uploadId string, parts []Part) error
+	AbortMultipartUpload(ctx context.Context, key, uploadId string) error
+}
+
+// 可选能力：生成预签名URL，客户端拿着URL直接读写存储，数据不经过API服务
+// 本地磁盘后端没有这个能力，调用方用类型断言判断：p, ok := s.(Presigner)
+type Presigner interface {
+	//下载对象的URL(GET)
+	PresignGet(ctx context.Context, key string, expires time.Duration) (string, error)
+	//上传multipart upload中一个分片的URL(PUT)
+	PresignPart(ctx context.Context, key, uploadId string, partNumber int, expires time.Duration) (string, error)
+	//列出multipart upload中已经上传的分片，用来确认客户端直传的分片
+	ListParts(ctx context.Context, key, uploadId string) ([]Part, error)
+}
+
+// 根据配置创建对应的存储后端
+func New(cfg config.StorageConfig) (Storage, error) {
+	switch cfg.Backend {
+	case "", "minio":
+		return NewMinio(cfg)
+	case "local":
+		return NewLocal(cfg.LocalRoot)
+	default:
+		return nil, fmt.Errorf("不支持的存储后端：%s", cfg.Backend)
+	}
+}
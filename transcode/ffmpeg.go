@@ -0,0 +1,70 @@
+package transcode
+
+//调用ffmpeg转码：H.264+AAC，按目标高度等比缩放，moov放在文件开头(faststart)
+import (
+	"Project01/config"
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strconv"
+)
+
+// 转码失败时错误信息里保留ffmpeg输出的最后这么多字节
+const stderrTail = 2000
+
+// 调用本机ffmpeg的转码器
+type FFmpeg struct {
+	Path string //ffmpeg可执行文件的完整路径
+}
+
+// 查找ffmpeg可执行文件，找不到时返回错误
+func NewFFmpeg(path string) (*FFmpeg, error) {
+	full, err := exec.LookPath(path)
+	if err != nil {
+		return nil, fmt.Errorf("找不到ffmpeg(%s)：%w", path, err)
+	}
+	return &FFmpeg{Path: full}, nil
+}
+
+func (f *FFmpeg) Transcode(ctx context.Context, src, dst string, r config.RenditionConfig) error {
+	bitrate := r.VideoBitrate
+	args := []string{
+		"-hide_banner", "-nostdin", "-y", "-loglevel", "error",
+		"-i", src,
+		//只取第一路视频和第一路音频(没有音频也可以)
+		"-map", "0:v:0", "-map", "0:a:0?",
+		//高度不超过原视频，宽度按比例取偶数
+		"-vf", "scale=-2:'trunc(min(" + strconv.Itoa(r.Height) + ",ih)/2)*2'",
+		"-c:v", "libx264", "-preset", "veryfast", "-profile:v", "high", "-pix_fmt", "yuv420p",
+		"-b:v", bitrate, "-maxrate", bitrate, "-bufsize", doubleBitrate(bitrate),
+		"-c:a", "aac", "-b:a", r.AudioBitrate,
+		"-movflags", "+faststart",
+		"-f", "mp4", dst,
+	}
+	cmd := exec.CommandContext(ctx, f.Path, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		out := stderr.Bytes()
+		if len(out) > stderrTail {
+			out = out[len(out)-stderrTail:]
+		}
+		return fmt.Errorf("ffmpeg执行失败：%w：%s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// VBV缓冲区取两倍码率，如2800k -> 5600k
+func doubleBitrate(bitrate string) string {
+	unit := ""
+	num := bitrate
+	if n := len(bitrate); n > 0 && (bitrate[n-1] == 'k' || bitrate[n-1] == 'M') {
+		num, unit = bitrate[:n-1], bitrate[n-1:]
+	}
+	v, err := strconv.Atoi(num)
+	if err != nil {
+		return bitrate
+	}
+	return strconv.Itoa(v*2) + unit
+}
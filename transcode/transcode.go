@@ -0,0 +1,52 @@
+package transcode
+
+//转码：把原始视频转成不同分辨率/码率的MP4
+//默认调用本机的ffmpeg(ffmpeg.go)；noop实现不转码，直接复制原文件，用于测试和没有ffmpeg的环境
+import (
+	"Project01/config"
+	"context"
+	"fmt"
+	"io"
+	"os"
+)
+
+// 转码器：输入和输出都是本地文件，输出为MP4
+type Transcoder interface {
+	Transcode(ctx context.Context, src, dst string, r config.RenditionConfig) error
+}
+
+// 根据配置创建转码器
+func New(cfg config.TranscodeConfig) (Transcoder, error) {
+	switch cfg.Transcoder {
+	case "", "ffmpeg":
+		f, err := NewFFmpeg(cfg.FFmpegPath)
+		if err != nil {
+			return nil, err
+		}
+		return f, nil
+	case "noop":
+		return Noop{}, nil
+	default:
+		return nil, fmt.Errorf("不支持的转码器：%s", cfg.Transcoder)
+	}
+}
+
+// 不转码，把原文件原样复制为输出
+type Noop struct{}
+
+func (Noop) Transcode(ctx context.Context, src, dst string, r config.RenditionConfig) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
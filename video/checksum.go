@@ -0,0 +1,48 @@
+package video
+
+//分片和整个文件的SHA-256校验
+import (
+	"encoding/hex"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 客户端传分片SHA-256的请求头，也可以用表单字段sha256传
+const chunkChecksumHeader = "X-Chunk-SHA256"
+
+// 规范化客户端传来的SHA-256：去掉空白，转小写，必须是64位十六进制
+// 为空表示客户端没有传，返回ok=true
+func normalizeSHA256(s string) (string, bool) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" {
+		return "", true
+	}
+	if len(s) != 64 {
+		return "", false
+	}
+	if _, err := hex.DecodeString(s); err != nil {
+		return "", false
+	}
+	return s, true
+}
+
+// 从请求中取出分片的SHA-256(请求头优先)
+func chunkChecksumFromRequest(c *gin.Context) (string, bool) {
+	value := c.GetHeader(chunkChecksumHeader)
+	if value == "" {
+		value = c.PostForm("sha256")
+	}
+	return normalizeSHA256(value)
+}
+
+// 校验和不一致：数据在传输中损坏，客户端可以重传
+func respondChecksumMismatch(c *gin.Context, code, expected, actual string) {
+	c.JSON(400, gin.H{
+		"error":     "校验和不一致，请重新上传",
+		"code":      code,
+		"retryable": true,
+		"expected":  expected,
+		"actual":    actual,
+	})
+}
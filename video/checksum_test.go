@@ -0,0 +1,172 @@
+package video
+
+import (
+	"Project01/db"
+	"Project01/internal/dbtest"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"mime/multipart"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestNormalizeSHA256(t *testing.T) {
+	valid := sha256Hex([]byte("x"))
+	tests := []struct {
+		name string
+		in   string
+		want string
+		ok   bool
+	}{
+		{"没有传", "", "", true},
+		{"只有空白", "  ", "", true},
+		{"小写", valid, valid, true},
+		{"大写转小写", strings.ToUpper(valid), valid, true},
+		{"去掉首尾空白", " " + valid + "\n", valid, true},
+		{"太短", valid[:63], "", false},
+		{"太长", valid + "0", "", false},
+		{"不是十六进制", "g" + valid[1:], "", false},
+		{"base64编码的摘要", "LCa0a2j/xo/5m0U8HTBBNBNCLXBkg7+g+YpeiGJm564=", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := normalizeSHA256(tt.in)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("normalizeSHA256(%q) = %q %v, want %q %v", tt.in, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+// 分片接口的会话：两个4字节的分片，有真实的multipart upload
+func createChunkSession(t *testing.T) *db.UploadSession {
+	t.Helper()
+	session := createTestSession(t)
+	multipartUploadId, err := store.NewMultipartUpload(context.Background(), session.ObjectKey, "video/mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.MultipartUploadId = multipartUploadId
+	if err := db.GetDB().Save(session).Error; err != nil {
+		t.Fatal(err)
+	}
+	return session
+}
+
+// 上传第1个分片(第0个分片要检查文件头)，checksum放在请求头里
+func uploadChunk(t *testing.T, data []byte, checksum string) (int, map[string]interface{}) {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, _ := mw.CreateFormFile("file", "chunk")
+	fw.Write(data)
+	mw.Close()
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/upload/:uploadId/chunk/:index", withSession, UploadChunkHandler)
+	req := httptest.NewRequest("POST", "/upload/upload-1/chunk/1", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	if checksum != "" {
+		req.Header.Set(chunkChecksumHeader, checksum)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	var reply map[string]interface{}
+	_ = json.Unmarshal(w.Body.Bytes(), &reply)
+	return w.Code, reply
+}
+
+func TestUploadChunkChecksum(t *testing.T) {
+	dbtest.Open(t)
+	useLocalStore(t)
+	createChunkSession(t)
+	good, bad := []byte("abcd"), []byte("abcX")
+
+	tests := []struct {
+		name     string
+		data     []byte
+		checksum string
+		code     int
+		errCode  string
+		status   string //之后分片的状态
+		uploaded uint64 //之后会话的已上传大小
+	}{
+		{"校验和格式错误", good, "abc", 400, "", "pending", 0},
+		{"大小不对", []byte("abc"), "", 400, "chunk_size_mismatch", "pending", 0},
+		{"数据损坏", bad, sha256Hex(good), 400, "chunk_checksum_mismatch", "pending", 0},
+		{"校验通过", good, strings.ToUpper(sha256Hex(good)), 200, "", "completed", 4},
+		{"重传时损坏，已完成的分片改回pending", bad, sha256Hex(good), 400, "chunk_checksum_mismatch", "pending", 0},
+		{"不带校验和", good, "", 200, "", "completed", 4},
+	}
+	for _, tt := range tests {
+		code, reply := uploadChunk(t, tt.data, tt.checksum)
+		if code != tt.code {
+			t.Fatalf("%s：状态码 = %d, want %d, %v", tt.name, code, tt.code, reply)
+		}
+		if tt.errCode != "" && reply["code"] != tt.errCode {
+			t.Errorf("%s：code = %v", tt.name, reply["code"])
+		}
+		if tt.errCode == "chunk_checksum_mismatch" && (reply["expected"] != sha256Hex(good) || reply["actual"] != sha256Hex(bad)) {
+			t.Errorf("%s：expected = %v, actual = %v", tt.name, reply["expected"], reply["actual"])
+		}
+		chunk := chunkStatus(t, "upload-1", 1)
+		if chunk.Status != tt.status {
+			t.Errorf("%s：分片状态 = %s", tt.name, chunk.Status)
+		}
+		if tt.status == "completed" && chunk.Checksum != sha256Hex(good) {
+			t.Errorf("%s：保存的校验和 = %s", tt.name, chunk.Checksum)
+		}
+		if session := loadSession(t, "upload-1"); session.UploadedSize != tt.uploaded {
+			t.Errorf("%s：已上传%d字节", tt.name, session.UploadedSize)
+		}
+	}
+}
+
+// 整个文件的SHA-256在完成上传时校验，不一致时删除合并后的对象，会话失败
+func TestCompleteFileChecksum(t *testing.T) {
+	tests := []struct {
+		name   string
+		sha256 string
+		code   int
+		status string
+	}{
+		{"一致", sha256Hex(tusData), 204, "completed"},
+		{"不一致", sha256Hex([]byte("other")), 400, "failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dbtest.Open(t)
+			useLocalStore(t)
+			session := createTusSession(t)
+			if err := db.GetDB().Model(session).Update("file_sha256", tt.sha256).Error; err != nil {
+				t.Fatal(err)
+			}
+			w := tusPatch(tusRouter(), 0, tusData, "")
+			if w.Code != tt.code {
+				t.Fatalf("状态码 = %d, want %d, %s", w.Code, tt.code, w.Body.String())
+			}
+			if got := loadSession(t, session.UploadId).Status; got != tt.status {
+				t.Errorf("会话状态 = %s", got)
+			}
+			_, err := store.Stat(context.Background(), session.ObjectKey)
+			if exists := err == nil; exists != (tt.status == "completed") {
+				t.Errorf("合并后的对象：%v", err)
+			}
+			if tt.status == "failed" && !strings.Contains(w.Body.String(), "file_checksum_mismatch") {
+				t.Errorf("响应 = %s", w.Body.String())
+			}
+		})
+	}
+}
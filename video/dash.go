@@ -0,0 +1,18 @@
+package video
+
+//MPEG-DASH播放：清单在打包HLS时一起生成(media.Package.DASHManifest)，分段和HLS是同一批文件
+import "github.com/gin-gonic/gin"
+
+// DASH路由可以读取的文件类型
+var dashContentTypes = map[string]string{
+	".mpd": "application/dash+xml",
+	".mp4": "video/mp4",
+	".m4s": "video/iso.segment",
+}
+
+// 获取DASH清单或分段，播放器从manifest.mpd开始，分段按清单里的模板相对请求
+// GET /videos/:id/dash/:file
+// 没有打包完成时返回404，客户端改用/play播放原始文件
+func DASHHandler(c *gin.Context) {
+	servePackageFile(c, dashContentTypes)
+}
@@ -0,0 +1,123 @@
+package video
+
+//按整个文件的SHA-256去重：相同内容只存一份，再次上传时秒传
+import (
+	"Project01/db"
+	"Project01/login"
+	"context"
+	"errors"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// 保存视频记录，同时在内容表中登记对象；sha256为空时不登记，不参与去重
+// 如果相同内容已经存在，视频记录改为引用已有对象，并删除刚上传的重复对象
+// 保存失败时删除刚上传的对象，避免存储里留下没人引用的文件
+// 打包、转码等后台任务和视频记录在同一个事务里入队
+// afterCreate不为空时在同一个事务里执行(如更新上传会话状态)，返回错误则整个事务回滚
+func createVideo(video *db.VideoInfo, sha256, contentType string, afterCreate func(tx *gorm.DB) error) error {
+	uploadedKey := video.ObjectKey
+	err := db.GetDB().Transaction(func(tx *gorm.DB) error {
+		if sha256 != "" {
+			content, err := db.AcquireContent(tx, &db.VideoContent{
+				Sha256:      sha256,
+				ObjectKey:   uploadedKey,
+				Size:        video.Size,
+				ContentType: contentType,
+			})
+			if err != nil {
+				return err
+			}
+			video.ObjectKey = content.ObjectKey
+		}
+		if err := tx.Create(video).Error; err != nil {
+			return err
+		}
+		if err := enqueueVideoJobs(tx, video); err != nil {
+			return err
+		}
+		if afterCreate != nil {
+			return afterCreate(tx)
+		}
+		return nil
+	})
+	if err != nil {
+		video.ObjectKey = uploadedKey
+		_ = store.Delete(context.Background(), uploadedKey)
+		return err
+	}
+	if video.ObjectKey != uploadedKey {
+		_ = store.Delete(context.Background(), uploadedKey)
+	}
+	wakeJobWorkers()
+	return nil
+}
+
+// 秒传：存储中已经有相同内容时直接创建视频记录，不需要再传分片
+// 返回true表示已经写好响应(秒传成功或出错)，false表示没有相同内容，继续正常的分片上传
+func instantUpload(c *gin.Context, user *login.Principal, filename, sha256 string, size uint64) bool {
+	extContainer, uerr := checkExtension(filename)
+	if uerr != nil {
+		uerr.respond(c)
+		return true
+	}
+	fileName := displayFileName(filename)
+	video := db.VideoInfo{
+		FileName:   fileName,
+		Title:      fileName,
+		Size:       int64(size),
+		UploaderId: user.UserId,
+	}
+	err := db.GetDB().Transaction(func(tx *gorm.DB) error {
+		content, err := db.ReuseContent(tx, sha256, int64(size))
+		if err != nil {
+			return err
+		}
+		//已有对象的真实格式要和这次的扩展名一致，否则当作新文件正常上传，在第0个分片时拒绝
+		if containerFamilies[contentContainer(content.ContentType)] != containerFamilies[extContainer] {
+			return gorm.ErrRecordNotFound
+		}
+		//只凭客户端给出的哈希就能复用对象，被屏蔽的内容不能这样重新发布，也当作新文件正常上传
+		var blocked int64
+		if err := tx.Model(&db.VideoInfo{}).
+			Where("object_key=? AND status=?", content.ObjectKey, "blocked").
+			Count(&blocked).Error; err != nil {
+			return err
+		}
+		if blocked > 0 {
+			return gorm.ErrRecordNotFound
+		}
+		video.ObjectKey = content.ObjectKey
+		if err := tx.Create(&video).Error; err != nil {
+			return err
+		}
+		//已有对象一般已经打包、转码过，任务会直接登记已有的结果
+		return enqueueVideoJobs(tx, &video)
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": "秒传失败"})
+		return true
+	}
+	wakeJobWorkers()
+	c.JSON(200, gin.H{
+		"message":  "秒传成功",
+		"instant":  true,
+		"video_id": video.ID,
+		"filename": fileName,
+	})
+	return true
+}
+
+// 根据MIME类型反查容器格式
+func contentContainer(contentType string) string {
+	for container, ct := range containerContentTypes {
+		if ct == contentType {
+			return container
+		}
+	}
+	return ""
+}
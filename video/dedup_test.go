@@ -0,0 +1,118 @@
+package video
+
+import (
+	"Project01/db"
+	"Project01/internal/dbtest"
+	"Project01/login"
+	"context"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 上传完成：对象已经在存储里，登记内容并创建视频记录
+func createTestVideo(t *testing.T, userId uint64, data []byte) *db.VideoInfo {
+	t.Helper()
+	video := &db.VideoInfo{FileName: "a.mp4", ObjectKey: newObjectKey(userId, "a.mp4"), Size: int64(len(data)), UploaderId: userId, Status: "ready"}
+	putObject(t, video.ObjectKey, data)
+	if err := createVideo(video, sha256Hex(data), "video/mp4", nil); err != nil {
+		t.Fatal(err)
+	}
+	return video
+}
+
+func objectExists(key string) bool {
+	_, err := store.Stat(context.Background(), key)
+	return err == nil
+}
+
+// 相同内容只保存一份，删除视频时引用计数降到0才删除对象
+func TestDedupRefCount(t *testing.T) {
+	dbtest.Open(t)
+	useLocalStore(t)
+	data := []byte("same content")
+	first := createTestVideo(t, 1, data)
+	uploaded := newObjectKey(2, "a.mp4")
+	second := &db.VideoInfo{FileName: "a.mp4", ObjectKey: uploaded, Size: int64(len(data)), UploaderId: 2, Status: "ready"}
+	putObject(t, uploaded, data)
+	if err := createVideo(second, sha256Hex(data), "video/mp4", nil); err != nil {
+		t.Fatal(err)
+	}
+	if second.ObjectKey != first.ObjectKey {
+		t.Fatalf("第二个视频的对象 = %s, want %s", second.ObjectKey, first.ObjectKey)
+	}
+	if objectExists(uploaded) {
+		t.Error("重复上传的对象没有删除")
+	}
+
+	r := videoRouter(&login.Principal{UserId: 99, Permissions: []string{"video:*"}})
+	del := func(id uint64) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("DELETE", "/videos/"+strconv.FormatUint(id, 10), nil))
+		if w.Code != 200 {
+			t.Fatalf("删除视频%d：%d %s", id, w.Code, w.Body.String())
+		}
+	}
+	del(first.ID)
+	if !objectExists(first.ObjectKey) {
+		t.Fatal("还有视频引用时对象被删除了")
+	}
+	del(second.ID)
+	if objectExists(first.ObjectKey) {
+		t.Error("最后一个引用删除后对象还在")
+	}
+}
+
+// 秒传：扩展名和已有内容的格式不一致、内容被屏蔽时不复用，按新文件上传
+func TestInstantUpload(t *testing.T) {
+	dbtest.Open(t)
+	useLocalStore(t)
+	old := uploadCfg
+	uploadCfg.AllowedContainers = []string{"mp4", "webm"}
+	t.Cleanup(func() { uploadCfg = old })
+	data := []byte("same content")
+	existing := createTestVideo(t, 1, data)
+
+	user := &login.Principal{UserId: 2}
+	instant := func(filename string, size uint64) int {
+		gin.SetMode(gin.TestMode)
+		r := gin.New()
+		r.POST("/", func(c *gin.Context) {
+			if !instantUpload(c, user, filename, sha256Hex(data), size) {
+				c.Status(204) //继续正常上传
+			}
+		})
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("POST", "/", nil))
+		return w.Code
+	}
+	refCount := func() int64 {
+		var content db.VideoContent
+		if err := db.GetDB().Where("sha256=?", sha256Hex(data)).First(&content).Error; err != nil {
+			t.Fatal(err)
+		}
+		return content.RefCount
+	}
+
+	if code := instant("b.mp4", uint64(len(data))); code != 200 || refCount() != 2 {
+		t.Errorf("秒传：%d，引用计数%d", code, refCount())
+	}
+	if code := instant("b.mp4", uint64(len(data))+1); code != 204 {
+		t.Errorf("大小不同：%d", code)
+	}
+	if code := instant("b.webm", uint64(len(data))); code != 204 {
+		t.Errorf("格式不一致：%d", code)
+	}
+	if err := db.GetDB().Model(existing).Update("status", "blocked").Error; err != nil {
+		t.Fatal(err)
+	}
+	if code := instant("c.mp4", uint64(len(data))); code != 204 {
+		t.Errorf("内容被屏蔽：%d", code)
+	}
+	if refCount() != 2 {
+		t.Errorf("没有秒传时引用计数变成了%d", refCount())
+	}
+}
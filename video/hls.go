@@ -0,0 +1,260 @@
+package video
+
+//HLS自适应播放：视频上传完成后由后台任务(jobs.go)把MP4/MOV打包成fMP4分段和m3u8播放列表，
+//放在存储中原始对象的派生目录(derivedPrefix)下的hls/；原始文件仍然可以通过/play播放
+//DASH清单(dash.go)也放在同一个目录，和HLS共用分段
+import (
+	"Project01/config"
+	"Project01/db"
+	"Project01/media"
+	"Project01/storage"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// 打包配置，由Init设置
+var streamingCfg config.StreamingConfig
+
+// HLS路由可以读取的文件类型
+var hlsContentTypes = map[string]string{
+	".m3u8": "application/vnd.apple.mpegurl",
+	".mp4":  "video/mp4",
+	".m4s":  "video/iso.segment",
+}
+
+// 打包文件的Content-Type
+func packageContentType(name string) string {
+	ext := path.Ext(name)
+	if ct, ok := hlsContentTypes[ext]; ok {
+		return ct
+	}
+	return dashContentTypes[ext]
+}
+
+// 原始对象的派生文件(打包、转码结果)所在的目录：服务端生成的对象名(videos/<上传者ID>/<UUID><扩展名>)去掉扩展名
+// 迁移前的旧视频以原始文件名为对象名，去掉扩展名后可能是videos/、uploads/这样的公共目录，
+// 删除派生文件时会误删其他对象，这些对象的派生文件放在单独的derived/<对象名>/下
+// 秒传/去重的视频共享同一个对象，也共享同一份派生文件
+func derivedPrefix(objectKey string) string {
+	if isGeneratedObjectKey(objectKey) {
+		return strings.TrimSuffix(objectKey, path.Ext(objectKey)) + "/"
+	}
+	return "derived/" + objectKey + "/"
+}
+
+// 对象名是不是newObjectKey生成的
+func isGeneratedObjectKey(objectKey string) bool {
+	parts := strings.Split(objectKey, "/")
+	if len(parts) != 3 || parts[0] != "videos" {
+		return false
+	}
+	if _, err := strconv.ParseUint(parts[1], 10, 64); err != nil {
+		return false
+	}
+	name := strings.TrimSuffix(parts[2], path.Ext(parts[2]))
+	_, err := uuid.Parse(name)
+	return err == nil && len(name) == 36
+}
+
+// HLS文件在存储中的目录
+func hlsPrefix(objectKey string) string {
+	return derivedPrefix(objectKey) + "hls/"
+}
+
+// 把存储中的对象当作io.ReaderAt，media包按需读取moov和样本数据
+type objectReader struct {
+	ctx  context.Context
+	key  string
+	size int64
+}
+
+func (r *objectReader) ReadAt(p []byte, off int64) (int, error) {
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	n := min(int64(len(p)), r.size-off)
+	body, err := store.Get(r.ctx, r.key, off, n)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+	read, err := io.ReadFull(body, p[:n])
+	if err == nil && n < int64(len(p)) {
+		err = io.EOF
+	}
+	return read, err
+}
+
+// 打包一个对象，返回打包状态：ready，或者unsupported(不是可以打包的MP4/MOV)
+// 出错时返回错误，由任务重试
+func packageHLS(ctx context.Context, objectKey string) (string, error) {
+	prefix := hlsPrefix(objectKey)
+	//相同内容之前已经打包过
+	if _, err := store.Stat(ctx, prefix+media.HLSMaster); err == nil {
+		if _, err := store.Stat(ctx, prefix+media.DASHManifest); err == nil {
+			return "ready", nil
+		}
+	}
+	info, err := store.Stat(ctx, objectKey)
+	if err != nil {
+		return "", err
+	}
+	err = writeHLS(ctx, objectKey, info.Size)
+	if err == nil {
+		return "ready", nil
+	}
+	//不留下打包了一半的文件
+	if derr := deletePrefix(ctx, prefix); derr != nil {
+		fmt.Printf("清理%s的打包文件失败：%v\n", objectKey, derr)
+	}
+	if errors.Is(err, media.ErrUnsupported) {
+		return "unsupported", nil
+	}
+	return "", err
+}
+
+// 解复用、写出分段、DASH清单和HLS播放列表；HLS主播放列表最后写，它存在就表示打包完整
+func writeHLS(ctx context.Context, objectKey string, size int64) error {
+	prefix := hlsPrefix(objectKey)
+	put := func(name string, data []byte) error {
+		_, err := store.Put(ctx, prefix+name, bytes.NewReader(data), int64(len(data)), packageContentType(name))
+		return err
+	}
+	movie, err := media.Open(&objectReader{ctx: ctx, key: objectKey, size: size}, size)
+	if err != nil {
+		return err
+	}
+	pkg, err := movie.Fragment(streamingCfg.SegmentDuration, put)
+	if err != nil {
+		return err
+	}
+	if err := put(media.DASHManifest, pkg.DASHManifest()); err != nil {
+		return err
+	}
+	playlists := pkg.HLSPlaylists()
+	names := make([]string, 0, len(playlists))
+	for name := range playlists {
+		if name != media.HLSMaster {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range append(names, media.HLSMaster) {
+		if err := put(name, playlists[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 记录打包结果；打包期间视频被删除、对象已经没有视频引用时删除派生文件
+func finishPackaging(id uint64, objectKey, status string) {
+	database := db.GetDB()
+	result := database.Model(&db.VideoInfo{}).Where("id=?", id).Update("hls_status", status)
+	if result.Error != nil {
+		fmt.Printf("更新视频%d的打包状态失败：%v\n", id, result.Error)
+		return
+	}
+	//同一个对象的其他视频(秒传时打包还没完成)一起更新
+	database.Model(&db.VideoInfo{}).
+		Where("object_key=? AND hls_status=?", objectKey, "processing").
+		Update("hls_status", status)
+	//MySQL在值没有变化时影响行数也是0，不能用来判断视频是否已经删除
+	var video db.VideoInfo
+	if err := database.Select("id").First(&video, id).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+		cleanupDerived(objectKey)
+	}
+}
+
+// 对象已经没有视频引用时删除它的派生文件(后台任务在视频删除之后才写完)
+func cleanupDerived(objectKey string) {
+	var count int64
+	if err := db.GetDB().Model(&db.VideoInfo{}).Where("object_key=?", objectKey).Count(&count).Error; err != nil || count > 0 {
+		return
+	}
+	if err := deletePrefix(context.Background(), derivedPrefix(objectKey)); err != nil {
+		fmt.Printf("清理%s的派生文件失败：%v\n", objectKey, err)
+	}
+}
+
+// 删除以prefix开头的所有对象
+func deletePrefix(ctx context.Context, prefix string) error {
+	objects, err := store.List(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	for _, obj := range objects {
+		if err := store.Delete(ctx, obj.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 获取HLS播放列表或分段，播放器从master.m3u8开始，其他文件按相对路径请求
+// GET /videos/:id/hls/:file
+// 没有打包完成时返回404，客户端改用/play播放原始文件
+func HLSHandler(c *gin.Context) {
+	servePackageFile(c, hlsContentTypes)
+}
+
+// 读取路径参数:file指定的打包文件，只允许contentTypes中的扩展名
+func servePackageFile(c *gin.Context, contentTypes map[string]string) {
+	id, ok := parseVideoId(c)
+	if !ok {
+		return
+	}
+	name := c.Param("file")
+	contentType, ok := contentTypes[path.Ext(name)]
+	if !ok || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		c.JSON(404, gin.H{"error": "文件不存在"})
+		return
+	}
+	video, ok := findVideo(c, id)
+	if !ok || !checkPlayable(c, video) {
+		return
+	}
+	if video.HLSStatus != "ready" {
+		c.JSON(404, gin.H{"error": "视频还没有打包完成", "hls_status": video.HLSStatus})
+		return
+	}
+	key := hlsPrefix(video.ObjectKey) + name
+	info, err := store.Stat(c, key)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			c.JSON(404, gin.H{"error": "文件不存在"})
+		} else {
+			c.JSON(500, gin.H{"error": "读取文件失败"})
+		}
+		return
+	}
+	body, err := store.Get(c, key, 0, -1)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "读取文件失败"})
+		return
+	}
+	defer body.Close()
+	//打包结果不会再变化，但需要鉴权，只允许浏览器缓存
+	c.Header("Cache-Control", "private, max-age=86400")
+	c.Header("ETag", quoteETag(info.ETag))
+	c.Header("Content-Length", strconv.FormatInt(info.Size, 10))
+	c.Header("Content-Type", contentType)
+	c.Status(200)
+	if _, err := io.Copy(c.Writer, body); err != nil {
+		fmt.Printf("读取%s失败：%v\n", key, err)
+	}
+}
@@ -0,0 +1,84 @@
+package video
+
+import (
+	"Project01/db"
+	"Project01/internal/dbtest"
+	"context"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestDerivedPrefix(t *testing.T) {
+	const id = "0b6a3c1e-5f7d-4c2a-9e8b-1d2f3a4b5c6d"
+	tests := []struct {
+		key, want string
+	}{
+		{"videos/1/" + id + ".mp4", "videos/1/" + id + "/"},
+		{"videos/42/" + id, "videos/42/" + id + "/"},
+		//迁移前的旧视频：对象名是原始文件名
+		{"videos.mp4", "derived/videos.mp4/"},
+		{"uploads.mp4", "derived/uploads.mp4/"},
+		{"clip", "derived/clip/"},
+		//看起来像但不是服务端生成的
+		{"videos/1/clip.mp4", "derived/videos/1/clip.mp4/"},
+		{"videos/abc/" + id + ".mp4", "derived/videos/abc/" + id + ".mp4/"},
+		{"videos/1/{" + id + "}.mp4", "derived/videos/1/{" + id + "}.mp4/"},
+		{"videos/1/2/" + id + ".mp4", "derived/videos/1/2/" + id + ".mp4/"},
+	}
+	for _, tt := range tests {
+		if got := derivedPrefix(tt.key); got != tt.want {
+			t.Errorf("derivedPrefix(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+	//生成的对象名都有自己的派生目录
+	key := newObjectKey(7, "a.MP4")
+	if got := derivedPrefix(key); got != strings.TrimSuffix(key, ".mp4")+"/" {
+		t.Errorf("derivedPrefix(%q) = %q", key, got)
+	}
+}
+
+// 删除文件名为videos.mp4的旧视频，不能删掉videos/下其他视频的对象
+func TestDeleteLegacyObject(t *testing.T) {
+	dbtest.Open(t)
+	useLocalStore(t)
+	other := newObjectKey(1, "a.mp4")
+	partial := tusPartialKey("upload-1", 1, 10)
+	keys := []string{
+		"videos.mp4",
+		"derived/videos.mp4/hls/master.m3u8",
+		other,
+		derivedPrefix(other) + "hls/master.m3u8",
+		partial,
+	}
+	for _, key := range keys {
+		putObject(t, key, []byte("x"))
+	}
+	pending := &db.PendingDelete{ObjectKey: "videos.mp4"}
+	if err := db.GetDB().Create(pending).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := deleteReleasedObject(context.Background(), pending); err != nil {
+		t.Fatal(err)
+	}
+
+	objects, err := store.List(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var left []string
+	for _, obj := range objects {
+		left = append(left, obj.Key)
+	}
+	sort.Strings(left)
+	want := []string{other, derivedPrefix(other) + "hls/master.m3u8", partial}
+	sort.Strings(want)
+	if strings.Join(left, ",") != strings.Join(want, ",") {
+		t.Errorf("剩下的对象 = %v, want %v", left, want)
+	}
+	var count int64
+	db.GetDB().Model(&db.PendingDelete{}).Count(&count)
+	if count != 0 {
+		t.Errorf("待删除记录没有去掉")
+	}
+}
@@ -0,0 +1,313 @@
+package video
+
+//视频信息的增删改查：前端通过视频ID操作，不再需要知道存储中的对象名
+import (
+	"Project01/db"
+	"Project01/login"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// 分页参数
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// 标题和简介的长度限制(字符数)，和db.VideoInfo的列定义一致
+const (
+	maxTitleLen       = 150
+	maxDescriptionLen = 2000
+)
+
+// 从路径参数:id中解析视频ID
+func parseVideoId(c *gin.Context) (uint64, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "视频ID不合法"})
+		return 0, false
+	}
+	return id, true
+}
+
+// 根据ID查询视频，查不到时直接写好404/500响应
+func findVideo(c *gin.Context, id uint64) (*db.VideoInfo, bool) {
+	var video db.VideoInfo
+	if err := db.GetDB().First(&video, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(404, gin.H{"error": "视频不存在"})
+		} else {
+			c.JSON(500, gin.H{"error": "查询视频失败"})
+		}
+		return nil, false
+	}
+	return &video, true
+}
+
+// 所有权判断：当前用户是不是路径参数:id对应视频的上传者，配合login.RequirePermission使用
+// 视频不存在时返回login.ErrResourceNotFound，由RequirePermission返回404
+func IsVideoOwner(c *gin.Context, p *login.Principal) (bool, error) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return false, nil
+	}
+	var video db.VideoInfo
+	err = db.GetDB().Select("uploader_id").First(&video, id).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return false, login.ErrResourceNotFound
+		}
+		return false, err
+	}
+	return video.UploaderId == p.UserId, nil
+}
+
+// 视频列表，按上传时间倒序分页
+// GET /videos?page=1&page_size=20&uploader_id=xxx&status=xxx
+// 只列出可以播放(ready)的视频；查看自己上传的视频或者有video:moderate权限时列出所有状态，可以按status过滤
+func ListVideosHandler(c *gin.Context) {
+	user, err := login.CurrentUser(c)
+	if err != nil {
+		c.JSON(401, gin.H{"error": err.Error()})
+		return
+	}
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		c.JSON(400, gin.H{"error": "page不合法"})
+		return
+	}
+	pageSize, err := strconv.Atoi(c.DefaultQuery("page_size", strconv.Itoa(defaultPageSize)))
+	if err != nil || pageSize < 1 || pageSize > maxPageSize {
+		c.JSON(400, gin.H{"error": "page_size必须在1~100之间"})
+		return
+	}
+
+	query := db.GetDB().Model(&db.VideoInfo{})
+	seeAll := user.Can("video", "moderate")
+	//按上传者过滤
+	if uploader := c.Query("uploader_id"); uploader != "" {
+		uploaderId, err := strconv.ParseUint(uploader, 10, 64)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "uploader_id不合法"})
+			return
+		}
+		query = query.Where("uploader_id=?", uploaderId)
+		seeAll = seeAll || uploaderId == user.UserId
+	}
+	//按处理状态过滤
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status=?", status)
+	}
+	if !seeAll {
+		query = query.Where("status=?", "ready")
+	}
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		c.JSON(500, gin.H{"error": "查询视频数量失败"})
+		return
+	}
+	var videos []db.VideoInfo
+	if err := query.Order("upload_time DESC, id DESC").
+		Offset((page - 1) * pageSize).Limit(pageSize).
+		Find(&videos).Error; err != nil {
+		c.JSON(500, gin.H{"error": "查询视频列表失败"})
+		return
+	}
+	c.JSON(200, gin.H{
+		"videos":    videos,
+		"total":     total,
+		"page":      page,
+		"page_size": pageSize,
+	})
+}
+
+// 查询单个视频，不是ready的视频只有上传者和有video:moderate权限的用户能看到
+// GET /videos/:id
+func GetVideoHandler(c *gin.Context) {
+	id, ok := parseVideoId(c)
+	if !ok {
+		return
+	}
+	video, ok := findVisibleVideo(c, id)
+	if !ok {
+		return
+	}
+	c.JSON(200, video)
+}
+
+// 修改视频信息的请求，字段为空表示不修改
+type UpdateVideoRequest struct {
+	Title       *string `json:"title"`
+	Description *string `json:"description"`
+}
+
+// 修改视频标题和简介(上传者或者有video:update权限)
+// PATCH /videos/:id
+func UpdateVideoHandler(c *gin.Context) {
+	id, ok := parseVideoId(c)
+	if !ok {
+		return
+	}
+	var req UpdateVideoRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "参数错误"})
+		return
+	}
+	updates := map[string]interface{}{}
+	if req.Title != nil {
+		title := strings.TrimSpace(*req.Title)
+		if title == "" || utf8.RuneCountInString(title) > maxTitleLen {
+			c.JSON(400, gin.H{"error": "标题不能为空，且不能超过150个字符"})
+			return
+		}
+		updates["title"] = title
+	}
+	if req.Description != nil {
+		if utf8.RuneCountInString(*req.Description) > maxDescriptionLen {
+			c.JSON(400, gin.H{"error": "简介不能超过2000个字符"})
+			return
+		}
+		updates["description"] = *req.Description
+	}
+	video, ok := findVideo(c, id)
+	if !ok {
+		return
+	}
+	if len(updates) > 0 {
+		if err := db.GetDB().Model(video).Updates(updates).Error; err != nil {
+			c.JSON(500, gin.H{"error": "修改视频信息失败"})
+			return
+		}
+	}
+	c.JSON(200, video)
+}
+
+// 视频已经转码出来的规格，播放时用/play?rendition=<name>选择
+// GET /videos/:id/renditions
+func ListRenditionsHandler(c *gin.Context) {
+	id, ok := parseVideoId(c)
+	if !ok {
+		return
+	}
+	video, ok := findVisibleVideo(c, id)
+	if !ok {
+		return
+	}
+	var renditions []db.Rendition
+	if err := db.GetDB().Where("video_id=?", video.ID).Order("height DESC").Find(&renditions).Error; err != nil {
+		c.JSON(500, gin.H{"error": "查询转码规格失败"})
+		return
+	}
+	c.JSON(200, gin.H{"renditions": renditions})
+}
+
+// 要播放的对象：默认是原始文件，?rendition=<name>时是转码后的规格，找不到时直接写好404/500响应
+func playObjectKey(c *gin.Context, video *db.VideoInfo) (string, bool) {
+	name := c.Query("rendition")
+	if name == "" {
+		return video.ObjectKey, true
+	}
+	var rendition db.Rendition
+	if err := db.GetDB().Where("video_id=? AND name=?", video.ID, name).First(&rendition).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(404, gin.H{"error": "视频没有这个规格"})
+		} else {
+			c.JSON(500, gin.H{"error": "查询转码规格失败"})
+		}
+		return "", false
+	}
+	return rendition.ObjectKey, true
+}
+
+// 删除视频(上传者或者有video:delete权限)：删除评论、视频记录，没有其他视频引用时删除存储中的对象
+// DELETE /videos/:id
+func DeleteVideoHandler(c *gin.Context) {
+	id, ok := parseVideoId(c)
+	if !ok {
+		return
+	}
+	video, ok := findVideo(c, id)
+	if !ok {
+		return
+	}
+	var pending *db.PendingDelete
+	//数据库的删除(包括转码结果和没有执行完的后台任务)放在事务里；对象不再被引用时在同一个事务里登记待删除，
+	//提交之后才删除存储中的对象，提交失败时视频仍然完整可用
+	err := db.GetDB().Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("video_id=?", video.ID).Delete(&db.Comment{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Delete(video).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("video_id=?", video.ID).Delete(&db.Rendition{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("video_id=?", video.ID).Delete(&db.Job{}).Error; err != nil {
+			return err
+		}
+		//秒传的视频和其他视频共享同一个对象，引用计数降到0才删除
+		release, err := db.ReleaseContent(tx, video.ObjectKey)
+		if err != nil || !release {
+			return err
+		}
+		pending = &db.PendingDelete{ObjectKey: video.ObjectKey}
+		return tx.Create(pending).Error
+	})
+	if err != nil {
+		fmt.Printf("删除视频%d失败：%v\n", video.ID, err)
+		c.JSON(500, gin.H{"error": "删除视频失败"})
+		return
+	}
+	//视频记录已经删除，存储中的对象删除失败时由后台清理任务重试
+	if pending != nil {
+		if err := deleteReleasedObject(c, pending); err != nil {
+			fmt.Printf("删除对象%s失败，稍后重试：%v\n", pending.ObjectKey, err)
+		}
+	}
+	c.JSON(200, gin.H{"message": "删除视频成功"})
+}
+
+// 删除不再被引用的对象和它的派生文件(打包、转码结果)，全部成功后去掉待删除记录
+func deleteReleasedObject(ctx context.Context, pending *db.PendingDelete) error {
+	if err := store.Delete(ctx, pending.ObjectKey); err != nil {
+		return err
+	}
+	if err := deletePrefix(ctx, derivedPrefix(pending.ObjectKey)); err != nil {
+		return err
+	}
+	return db.GetDB().Delete(pending).Error
+}
+
+// 重试删除之前没有删掉的对象；刚登记的记录留给删除视频的请求自己处理
+func retryPendingDeletes(ctx context.Context) (int, error) {
+	deadline := time.Now().Add(-time.Minute)
+	count := 0
+	var lastId uint64
+	for {
+		var batch []db.PendingDelete
+		if err := db.GetDB().Where("id>? AND created_time<?", lastId, deadline).
+			Order("id").Limit(100).Find(&batch).Error; err != nil {
+			return count, err
+		}
+		for i := range batch {
+			if err := deleteReleasedObject(ctx, &batch[i]); err != nil {
+				fmt.Printf("删除对象%s失败：%v\n", batch[i].ObjectKey, err)
+				continue
+			}
+			count++
+		}
+		if len(batch) < 100 {
+			return count, nil
+		}
+		lastId = batch[len(batch)-1].ID
+	}
+}
@@ -0,0 +1,67 @@
+package video
+
+import (
+	"Project01/db"
+	"Project01/internal/dbtest"
+	"Project01/login"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 和main.go中修改、删除视频的路由相同，用户身份直接放入上下文
+func videoRouter(p *login.Principal) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(func(c *gin.Context) { login.SetCurrentUser(c, p) })
+	r.PATCH("/videos/:id", login.RequirePermission("video", "update", IsVideoOwner), UpdateVideoHandler)
+	r.DELETE("/videos/:id", login.RequirePermission("video", "delete", IsVideoOwner), DeleteVideoHandler)
+	return r
+}
+
+func TestVideoOwnership(t *testing.T) {
+	uploader := &login.Principal{UserId: 1, Permissions: []string{"video:read"}}
+	other := &login.Principal{UserId: 2, Permissions: []string{"video:read"}}
+	moderator := &login.Principal{UserId: 3, Permissions: []string{"video:update", "video:delete"}}
+	tests := []struct {
+		name   string
+		user   *login.Principal
+		method string
+		id     string
+		code   int
+	}{
+		{"上传者修改", uploader, "PATCH", "", 200},
+		{"其他用户修改", other, "PATCH", "", 403},
+		{"修改不存在的视频", other, "PATCH", "999", 404},
+		{"上传者删除", uploader, "DELETE", "", 200},
+		{"其他用户删除", other, "DELETE", "", 403},
+		{"删除不存在的视频", other, "DELETE", "999", 404},
+		{"有权限时删除不存在的视频", moderator, "DELETE", "999", 404},
+		{"有权限时删除", moderator, "DELETE", "", 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dbtest.Open(t)
+			useLocalStore(t)
+			video := db.VideoInfo{FileName: "a.mp4", ObjectKey: newObjectKey(uploader.UserId, "a.mp4"), UploaderId: uploader.UserId, Status: "ready"}
+			if err := db.GetDB().Create(&video).Error; err != nil {
+				t.Fatal(err)
+			}
+			putObject(t, video.ObjectKey, []byte("x"))
+			id := tt.id
+			if id == "" {
+				id = strconv.FormatUint(video.ID, 10)
+			}
+			req := httptest.NewRequest(tt.method, "/videos/"+id, strings.NewReader(`{"title":"新标题"}`))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			videoRouter(tt.user).ServeHTTP(w, req)
+			if w.Code != tt.code {
+				t.Fatalf("状态码 = %d, want %d, %s", w.Code, tt.code, w.Body.String())
+			}
+		})
+	}
+}
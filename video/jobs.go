@@ -0,0 +1,354 @@
+package video
+
+//后台任务：视频创建时在同一个事务里入队(读取媒体信息、打包HLS/DASH、每种规格一个转码任务)，
+//进程内的工作协程从任务表中取任务执行，失败的任务延后重试
+import (
+	"Project01/config"
+	"Project01/db"
+	"Project01/media"
+	"Project01/storage"
+	"Project01/transcode"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// 任务配置，由InitJobs设置
+var jobsCfg config.JobsConfig
+
+// 转码规格和转码器；transcoder为nil表示不转码
+var (
+	renditionCfgs []config.RenditionConfig
+	transcoder    transcode.Transcoder
+)
+
+// 有新任务时唤醒一个空闲的工作协程，不用等到下一次轮询
+var jobWake = make(chan struct{}, 1)
+
+// 初始化后台任务，t为nil时不创建转码任务
+func InitJobs(cfg config.JobsConfig, transcodeCfg config.TranscodeConfig, t transcode.Transcoder) {
+	jobsCfg = cfg
+	renditionCfgs = transcodeCfg.Renditions
+	transcoder = t
+}
+
+// 新视频的后台任务，和视频记录在同一个事务里创建
+// 视频状态为uploaded，probe任务成功后就可以播放，不用等打包和转码
+func enqueueVideoJobs(tx *gorm.DB, video *db.VideoInfo) error {
+	jobs := []db.Job{{Type: "probe"}}
+	if streamingCfg.Enabled {
+		jobs = append(jobs, db.Job{Type: "package"})
+	}
+	if transcoder != nil {
+		for _, r := range renditionCfgs {
+			jobs = append(jobs, db.Job{Type: "transcode", Rendition: r.Name})
+		}
+	}
+	now := time.Now()
+	for i := range jobs {
+		jobs[i].VideoId = video.ID
+		jobs[i].Status = "queued"
+		jobs[i].RunAfter = now
+	}
+	if err := tx.Create(&jobs).Error; err != nil {
+		return err
+	}
+	video.Status = "uploaded"
+	video.StatusUpdatedTime = &now
+	updates := map[string]interface{}{"status": video.Status, "status_updated_time": now}
+	if streamingCfg.Enabled {
+		video.HLSStatus = "processing"
+		updates["hls_status"] = video.HLSStatus
+	}
+	return tx.Model(video).Updates(updates).Error
+}
+
+// 事务提交之后调用
+func wakeJobWorkers() {
+	select {
+	case jobWake <- struct{}{}:
+	default:
+	}
+}
+
+// 启动工作协程，并定期把超时的任务重新排队、更新卡在处理中的视频状态
+func StartJobWorkers(ctx context.Context) {
+	for i := uint64(0); i < jobsCfg.Workers; i++ {
+		go jobWorker(ctx)
+	}
+	go func() {
+		ticker := time.NewTicker(max(jobsCfg.PollInterval, time.Minute))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				//多留一分钟，让刚好超时的任务自己先结束
+				deadline := time.Now().Add(-jobsCfg.Timeout - time.Minute)
+				if n, err := db.RequeueStaleJobs(deadline, int(jobsCfg.MaxAttempts)); err != nil {
+					fmt.Printf("重新排队超时任务失败：%v\n", err)
+				} else if n > 0 {
+					fmt.Printf("已重新排队%d个超时任务\n", n)
+				}
+				refreshStuckVideoStatuses()
+			}
+		}
+	}()
+}
+
+func jobWorker(ctx context.Context) {
+	for {
+		job, err := db.ClaimJob()
+		if err == nil {
+			runClaimedJob(ctx, job)
+			continue
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			fmt.Printf("获取后台任务失败：%v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-jobWake:
+		case <-time.After(jobsCfg.PollInterval):
+		}
+	}
+}
+
+// 执行一个任务并记录结果，第n次失败后延后n分钟重试；probe任务结束后更新视频的处理状态
+func runClaimedJob(ctx context.Context, job *db.Job) {
+	if job.Type == "probe" {
+		markVideoProcessing(job.VideoId)
+	}
+	jobCtx, cancel := context.WithTimeout(ctx, jobsCfg.Timeout)
+	defer cancel()
+	panicked, runErr := safeRunJob(jobCtx, job)
+	if runErr != nil {
+		fmt.Printf("后台任务%d(%s %s)第%d次执行失败：%v\n", job.ID, job.Type, job.Rendition, job.Attempts, runErr)
+	}
+	maxAttempts := int(jobsCfg.MaxAttempts)
+	//panic一般是文件内容导致的，重试也一样，直接标记为failed
+	if panicked {
+		maxAttempts = job.Attempts
+		if job.Type == "package" {
+			err := db.GetDB().Model(&db.VideoInfo{}).
+				Where("id=? AND hls_status=?", job.VideoId, "processing").
+				Update("hls_status", "failed").Error
+			if err != nil {
+				fmt.Printf("更新视频%d的打包状态失败：%v\n", job.VideoId, err)
+			}
+		}
+	}
+	retryDelay := time.Duration(job.Attempts) * time.Minute
+	if err := db.FinishJob(job, runErr, maxAttempts, retryDelay); err != nil {
+		fmt.Printf("更新后台任务%d失败：%v\n", job.ID, err)
+	}
+	if job.Type == "probe" {
+		refreshVideoStatus(job.VideoId)
+	}
+}
+
+// 执行任务，把panic转成错误，避免一个异常的文件让整个服务退出
+func safeRunJob(ctx context.Context, job *db.Job) (panicked bool, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("任务执行时panic：%v", p)
+			panicked = true
+		}
+	}()
+	return false, runJob(ctx, job)
+}
+
+func runJob(ctx context.Context, job *db.Job) error {
+	var video db.VideoInfo
+	if err := db.GetDB().First(&video, job.VideoId).Error; err != nil {
+		//视频已经删除，任务不用再做
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+	switch job.Type {
+	case "probe":
+		return runProbeJob(ctx, &video)
+	case "package":
+		return runPackageJob(ctx, &video, job)
+	case "transcode":
+		return runTranscodeJob(ctx, &video, job)
+	default:
+		return fmt.Errorf("未知的任务类型：%s", job.Type)
+	}
+}
+
+// 读取媒体信息写入视频记录；不认识的格式不算失败，媒体信息留空
+func runProbeJob(ctx context.Context, video *db.VideoInfo) error {
+	info, err := media.Probe(&objectReader{ctx: ctx, key: video.ObjectKey, size: video.Size}, video.Size)
+	if errors.Is(err, media.ErrUnsupported) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return db.GetDB().Model(video).Updates(map[string]interface{}{
+		"container":   info.Container,
+		"duration":    info.Duration.Seconds(),
+		"width":       info.Width,
+		"height":      info.Height,
+		"video_codec": info.VideoCodec,
+		"audio_codec": info.AudioCodec,
+		"frame_rate":  info.FrameRate,
+		"bitrate":     info.Bitrate,
+	}).Error
+}
+
+// 打包HLS/DASH，最后一次也失败时打包状态改为failed
+func runPackageJob(ctx context.Context, video *db.VideoInfo, job *db.Job) error {
+	status, err := packageHLS(ctx, video.ObjectKey)
+	if err != nil {
+		if job.Attempts >= int(jobsCfg.MaxAttempts) {
+			finishPackaging(video.ID, video.ObjectKey, "failed")
+		}
+		return err
+	}
+	finishPackaging(video.ID, video.ObjectKey, status)
+	return nil
+}
+
+// 转码出来的对象名，放在原始对象的派生目录下，相同内容的视频共享
+func renditionKey(objectKey, name string) string {
+	return derivedPrefix(objectKey) + "renditions/" + name + ".mp4"
+}
+
+func findRenditionConfig(name string) (config.RenditionConfig, bool) {
+	for _, r := range renditionCfgs {
+		if r.Name == name {
+			return r, true
+		}
+	}
+	return config.RenditionConfig{}, false
+}
+
+// 转码成一种规格并登记；相同内容已经转码过时直接登记已有的对象
+// 原视频的高度比规格低时跳过(不放大)
+func runTranscodeJob(ctx context.Context, video *db.VideoInfo, job *db.Job) error {
+	if transcoder == nil {
+		return errors.New("转码没有启用")
+	}
+	r, ok := findRenditionConfig(job.Rendition)
+	if !ok {
+		return fmt.Errorf("规格%s已经不在配置中", job.Rendition)
+	}
+	key := renditionKey(video.ObjectKey, r.Name)
+	info, err := store.Stat(ctx, key)
+	if err == nil {
+		width, height := probeResolution(&objectReader{ctx: ctx, key: key, size: info.Size}, info.Size)
+		return registerRendition(video, r.Name, key, width, height, info.Size)
+	}
+	if !errors.Is(err, storage.ErrNotFound) {
+		return err
+	}
+
+	dir, err := os.MkdirTemp("", "transcode-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "source"+strings.ToLower(filepath.Ext(video.ObjectKey)))
+	size, err := downloadObject(ctx, video.ObjectKey, src)
+	if err != nil {
+		return err
+	}
+	if f, err := os.Open(src); err == nil {
+		_, height := probeResolution(f, size)
+		f.Close()
+		if height > 0 && height < r.Height {
+			return nil
+		}
+	}
+	dst := filepath.Join(dir, r.Name+".mp4")
+	if err := transcoder.Transcode(ctx, src, dst, r); err != nil {
+		return err
+	}
+	out, err := os.Open(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	stat, err := out.Stat()
+	if err != nil {
+		return err
+	}
+	width, height := probeResolution(out, stat.Size())
+	if _, err := out.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := store.Put(ctx, key, out, stat.Size(), "video/mp4"); err != nil {
+		return err
+	}
+	return registerRendition(video, r.Name, key, width, height, stat.Size())
+}
+
+// 把对象下载到本地文件，返回大小
+func downloadObject(ctx context.Context, key, path string) (int64, error) {
+	body, err := store.Get(ctx, key, 0, -1)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+	f, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(f, body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return n, err
+}
+
+// 视频分辨率，不认识的格式或解析失败返回0
+func probeResolution(r io.ReaderAt, size int64) (int, int) {
+	info, err := media.Probe(r, size)
+	if err != nil {
+		return 0, 0
+	}
+	return info.Width, info.Height
+}
+
+// 登记转码结果；锁住视频记录，保证不会给正在删除的视频登记
+// 视频已经删除时，对象没有其他视频引用就删除派生文件
+func registerRendition(video *db.VideoInfo, name, key string, width, height int, size int64) error {
+	err := db.GetDB().Transaction(func(tx *gorm.DB) error {
+		var locked db.VideoInfo
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").First(&locked, video.ID).Error; err != nil {
+			return err
+		}
+		rendition := db.Rendition{
+			VideoId:   video.ID,
+			Name:      name,
+			ObjectKey: key,
+			Width:     width,
+			Height:    height,
+			Size:      size,
+		}
+		//重试的任务可能已经登记过
+		return tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "video_id"}, {Name: "name"}},
+			DoUpdates: clause.AssignmentColumns([]string{"object_key", "width", "height", "size"}),
+		}).Create(&rendition).Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		cleanupDerived(video.ObjectKey)
+		return nil
+	}
+	return err
+}
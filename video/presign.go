@@ -0,0 +1,131 @@
+package video
+
+//预签名URL：客户端拿着URL直接上传分片到存储/直接从存储播放，视频数据不再经过API服务
+//URL只在JWT鉴权和权限校验通过之后才签发，有效期由storage.presign_ttl配置
+import (
+	"Project01/db"
+	"Project01/storage"
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// 当前存储后端的预签名能力，不支持时直接写好501响应
+func presigner(c *gin.Context) (storage.Presigner, bool) {
+	p, ok := store.(storage.Presigner)
+	if !ok {
+		c.JSON(501, gin.H{"error": "当前存储后端不支持预签名URL"})
+		return nil, false
+	}
+	return p, true
+}
+
+// 获取上传一个分片的预签名URL
+// POST /upload/:uploadId/chunk/:index/presign
+// 客户端用PUT把分片的原始字节直接发到返回的URL，全部分片上传后照常调用/complete，
+// 服务端在/complete(和/progress)时列出存储上已有的part来确认哪些分片完成了
+func PresignChunkHandler(c *gin.Context) {
+	session := currentSession(c)
+	if !checkProtocol(c, session, "chunk") {
+		return
+	}
+	index, err := strconv.ParseUint(c.Param("index"), 10, 64)
+	if err != nil || index >= session.TotalChunks {
+		c.JSON(400, gin.H{"error": "分片编号错误"})
+		return
+	}
+	p, ok := presigner(c)
+	if !ok {
+		return
+	}
+	var chunk db.ChunkRecord
+	if err := db.GetDB().Where("upload_id=? AND chunk_index=?", session.UploadId, index).First(&chunk).Error; err != nil {
+		c.JSON(500, gin.H{"error": "查询分片记录失败"})
+		return
+	}
+	url, err := p.PresignPart(c, session.ObjectKey, session.MultipartUploadId, int(index+1), presignTTL)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "生成预签名URL失败"})
+		return
+	}
+	c.JSON(200, gin.H{
+		"url":         url,
+		"method":      "PUT",
+		"chunk_index": index,
+		"part_number": index + 1,
+		"size":        chunk.Size, //上传的数据必须正好是这么多字节
+		"expires_at":  time.Now().Add(presignTTL),
+	})
+}
+
+// 把客户端直传到存储的分片同步到分片记录：列出multipart upload已有的part，
+// 大小和分片记录一致的标记为completed并记下ETag，然后重新计算会话的已上传大小
+// 校验和不一致被拒绝过的part(rejected_etag)不算完成，客户端重新上传后ETag变化才会同步
+// 不支持预签名的存储后端分片都经过服务端，不需要同步；已经结束的会话和tus会话也不需要
+func syncUploadedParts(ctx context.Context, session *db.UploadSession) error {
+	p, ok := store.(storage.Presigner)
+	if !ok || session.MultipartUploadId == "" || session.Status != "uploading" || session.Protocol == "tus" {
+		return nil
+	}
+	parts, err := p.ListParts(ctx, session.ObjectKey, session.MultipartUploadId)
+	if err != nil {
+		return err
+	}
+	return db.GetDB().Transaction(func(tx *gorm.DB) error {
+		for _, part := range parts {
+			//以存储上的ETag为准：同一个分片重传之后ETag会变化
+			err := tx.Model(&db.ChunkRecord{}).
+				Where("upload_id=? AND chunk_index=? AND size=?", session.UploadId, part.PartNumber-1, part.Size).
+				Where("status<>? OR etag<>?", "completed", part.ETag).
+				Where("rejected_etag<>?", part.ETag).
+				Updates(map[string]interface{}{"status": "completed", "etag": part.ETag}).Error
+			if err != nil {
+				return err
+			}
+		}
+		var uploaded uint64
+		if err := tx.Model(&db.ChunkRecord{}).
+			Where("upload_id=? AND status=?", session.UploadId, "completed").
+			Select("COALESCE(SUM(size),0)").Scan(&uploaded).Error; err != nil {
+			return err
+		}
+		if uploaded == session.UploadedSize {
+			return nil
+		}
+		session.UploadedSize = uploaded
+		return tx.Model(session).Update("uploaded_size", uploaded).Error
+	})
+}
+
+// 获取播放视频的预签名URL，浏览器直接从存储读取，Range请求也由存储处理
+// GET /videos/:id/play/url，和/play一样可以用?rendition=<name>选择转码后的规格
+func PlayURLHandler(c *gin.Context) {
+	id, ok := parseVideoId(c)
+	if !ok {
+		return
+	}
+	p, ok := presigner(c)
+	if !ok {
+		return
+	}
+	video, ok := findVideo(c, id)
+	if !ok || !checkPlayable(c, video) {
+		return
+	}
+	key, ok := playObjectKey(c, video)
+	if !ok {
+		return
+	}
+	url, err := p.PresignGet(c, key, presignTTL)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "生成预签名URL失败"})
+		return
+	}
+	c.JSON(200, gin.H{
+		"url":        url,
+		"expires_at": time.Now().Add(presignTTL),
+	})
+}
@@ -0,0 +1,126 @@
+package video
+
+import (
+	"Project01/db"
+	"Project01/internal/dbtest"
+	"Project01/storage"
+	"context"
+	"testing"
+	"time"
+)
+
+// 支持预签名的存储：ListParts返回parts，其他操作交给本地存储
+type presignStore struct {
+	storage.Storage
+	parts []storage.Part
+}
+
+func (s *presignStore) PresignGet(ctx context.Context, key string, expires time.Duration) (string, error) {
+	return "https://storage.test/" + key, nil
+}
+
+func (s *presignStore) PresignPart(ctx context.Context, key, uploadId string, partNumber int, expires time.Duration) (string, error) {
+	return "https://storage.test/" + key, nil
+}
+
+func (s *presignStore) ListParts(ctx context.Context, key, uploadId string) ([]storage.Part, error) {
+	return s.parts, nil
+}
+
+func usePresignStore(t *testing.T) *presignStore {
+	t.Helper()
+	s := &presignStore{Storage: useLocalStore(t)}
+	store = s
+	return s
+}
+
+// 两个4字节分片的会话，分片都是pending
+func createTestSession(t *testing.T) *db.UploadSession {
+	t.Helper()
+	session := &db.UploadSession{
+		UploadId: "upload-1", UserId: 1, FileName: "a.mp4", ObjectKey: "videos/1/a.mp4",
+		MultipartUploadId: "multipart-1", TotalSize: 8, ChunkSize: 4, TotalChunks: 2,
+		Status: "uploading", Protocol: "chunk",
+	}
+	if err := db.GetDB().Create(session).Error; err != nil {
+		t.Fatal(err)
+	}
+	for i := uint64(0); i < session.TotalChunks; i++ {
+		chunk := &db.ChunkRecord{UploadId: session.UploadId, ChunkIndex: i, Size: 4, StartByte: i * 4, EndByte: i*4 + 3}
+		if err := db.GetDB().Create(chunk).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	return session
+}
+
+func chunkStatus(t *testing.T, uploadId string, index uint64) db.ChunkRecord {
+	t.Helper()
+	var chunk db.ChunkRecord
+	if err := db.GetDB().Where("upload_id=? AND chunk_index=?", uploadId, index).First(&chunk).Error; err != nil {
+		t.Fatal(err)
+	}
+	return chunk
+}
+
+// 校验和不一致被拒绝的分片，损坏的part还在multipart upload里，同步时不能再标记为completed
+func TestSyncSkipsRejectedPart(t *testing.T) {
+	dbtest.Open(t)
+	s := usePresignStore(t)
+	session := createTestSession(t)
+	ctx := context.Background()
+
+	s.parts = []storage.Part{{PartNumber: 1, ETag: "good-1", Size: 4}, {PartNumber: 2, ETag: "bad-2", Size: 4}}
+	if err := syncUploadedParts(ctx, session); err != nil {
+		t.Fatal(err)
+	}
+	if chunk := chunkStatus(t, session.UploadId, 1); chunk.Status != "completed" || session.UploadedSize != 8 {
+		t.Fatalf("同步后分片1 = %s，已上传%d字节", chunk.Status, session.UploadedSize)
+	}
+
+	//服务端校验发现分片1损坏
+	if err := resetChunk(session.UploadId, 1, "bad-2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.GetDB().First(session, session.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if session.UploadedSize != 4 {
+		t.Errorf("重置后已上传%d字节", session.UploadedSize)
+	}
+	if err := syncUploadedParts(ctx, session); err != nil {
+		t.Fatal(err)
+	}
+	if chunk := chunkStatus(t, session.UploadId, 1); chunk.Status != "pending" || chunk.ETag != "" {
+		t.Errorf("被拒绝的分片同步后 = %s %q，应该仍然是pending", chunk.Status, chunk.ETag)
+	}
+	if session.UploadedSize != 4 {
+		t.Errorf("同步后已上传%d字节", session.UploadedSize)
+	}
+
+	//客户端重新直传，ETag变化后才算完成
+	s.parts[1].ETag = "good-2"
+	if err := syncUploadedParts(ctx, session); err != nil {
+		t.Fatal(err)
+	}
+	if chunk := chunkStatus(t, session.UploadId, 1); chunk.Status != "completed" || chunk.ETag != "good-2" {
+		t.Errorf("重传后分片1 = %s %q", chunk.Status, chunk.ETag)
+	}
+	if session.UploadedSize != 8 {
+		t.Errorf("重传后已上传%d字节", session.UploadedSize)
+	}
+}
+
+// 大小和分片记录不一致的part不算完成
+func TestSyncIgnoresWrongSize(t *testing.T) {
+	dbtest.Open(t)
+	s := usePresignStore(t)
+	session := createTestSession(t)
+	s.parts = []storage.Part{{PartNumber: 1, ETag: "short", Size: 3}}
+	if err := syncUploadedParts(context.Background(), session); err != nil {
+		t.Fatal(err)
+	}
+	if chunk := chunkStatus(t, session.UploadId, 0); chunk.Status != "pending" {
+		t.Errorf("分片0 = %s", chunk.Status)
+	}
+}
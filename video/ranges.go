@@ -0,0 +1,166 @@
+package video
+
+//HTTP范围请求(RFC 7233)和条件请求(RFC 7232)：播放器拖动进度、下载工具多线程下载、缓存重新验证
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 一次请求最多允许的范围个数，防止用大量很小的范围拖垮服务
+const maxRanges = 16
+
+// 请求的范围和文件没有交集，返回416
+var errRangeNotSatisfiable = errors.New("请求的范围超出文件大小")
+
+// 一个字节范围[start,start+length)
+type byteRange struct {
+	start  int64
+	length int64
+}
+
+// Content-Range响应头
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// 解析Range请求头，支持三种形式，可以用逗号分隔多个：
+//
+//	bytes=<start>-<end>   [start,end]，end超出文件时截到末尾
+//	bytes=<start>-        从start到末尾
+//	bytes=-<suffix>       最后suffix个字节
+//
+// 格式错误或者不是bytes单位时返回nil，按RFC 7233应当忽略Range返回整个文件
+// 格式正确但所有范围都和文件没有交集时返回errRangeNotSatisfiable
+func parseRange(header string, size int64) ([]byteRange, error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return nil, nil
+	}
+	var ranges []byteRange
+	unsatisfiable := false
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		first, last, ok := strings.Cut(part, "-")
+		if !ok {
+			return nil, nil
+		}
+		first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+		var r byteRange
+		if first == "" {
+			//后缀范围：最后suffix个字节
+			suffix, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || suffix < 0 {
+				return nil, nil
+			}
+			if suffix == 0 || size == 0 {
+				unsatisfiable = true
+				continue
+			}
+			suffix = min(suffix, size)
+			r = byteRange{start: size - suffix, length: suffix}
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return nil, nil
+			}
+			end := size - 1
+			if last != "" {
+				end, err = strconv.ParseInt(last, 10, 64)
+				if err != nil || end < start {
+					return nil, nil
+				}
+				end = min(end, size-1)
+			}
+			if start >= size {
+				unsatisfiable = true
+				continue
+			}
+			r = byteRange{start: start, length: end - start + 1}
+		}
+		ranges = append(ranges, r)
+	}
+	if len(ranges) == 0 {
+		if unsatisfiable {
+			return nil, errRangeNotSatisfiable
+		}
+		return nil, nil
+	}
+	//范围太多，或者加起来比文件还大(大量重叠)，直接返回整个文件
+	var total int64
+	for _, r := range ranges {
+		total += r.length
+	}
+	if len(ranges) > maxRanges || total > size {
+		return nil, nil
+	}
+	return ranges, nil
+}
+
+// 强ETag，带双引号。MinIO返回的ETag不带引号，本地存储是修改时间和大小
+func quoteETag(etag string) string {
+	etag = strings.Trim(etag, `"`)
+	if etag == "" {
+		return ""
+	}
+	return `"` + etag + `"`
+}
+
+// If-None-Match/If-Match中的ETag列表是否包含etag，比较时忽略弱标记W/
+func etagListMatch(list, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// HTTP日期只精确到秒
+func modifiedAfter(lastModified time.Time, header string) (bool, bool) {
+	t, err := http.ParseTime(header)
+	if err != nil || lastModified.IsZero() {
+		return false, false
+	}
+	return lastModified.Truncate(time.Second).After(t), true
+}
+
+// 条件GET/HEAD：客户端缓存的版本仍然有效时返回true，应当响应304
+// 有If-None-Match时只看它，否则看If-Modified-Since(RFC 7232 第6节)
+func notModified(r *http.Request, etag string, lastModified time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		return etagListMatch(inm, etag)
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		after, ok := modifiedAfter(lastModified, ims)
+		return ok && !after
+	}
+	return false
+}
+
+// If-Range：客户端手里的版本和当前一致时才按Range返回部分内容，否则返回整个文件
+// If-Range只能用强ETag比较；用日期时必须完全相等
+func rangeStillValid(r *http.Request, etag string, lastModified time.Time) bool {
+	ifRange := r.Header.Get("If-Range")
+	if ifRange == "" {
+		return true
+	}
+	if strings.HasPrefix(ifRange, `"`) {
+		return etag != "" && ifRange == etag
+	}
+	if strings.HasPrefix(ifRange, "W/") {
+		return false
+	}
+	t, err := http.ParseTime(ifRange)
+	return err == nil && !lastModified.IsZero() && lastModified.Truncate(time.Second).Equal(t)
+}
@@ -0,0 +1,187 @@
+package video
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRange(t *testing.T) {
+	const size = 100
+	tests := []struct {
+		name   string
+		header string
+		size   int64
+		want   []byteRange
+		err    error
+	}{
+		{"一个范围", "bytes=0-9", size, []byteRange{{0, 10}}, nil},
+		{"end超出文件截到末尾", "bytes=90-200", size, []byteRange{{90, 10}}, nil},
+		{"到末尾", "bytes=50-", size, []byteRange{{50, 50}}, nil},
+		{"后缀", "bytes=-10", size, []byteRange{{90, 10}}, nil},
+		{"后缀比文件大", "bytes=-500", size, []byteRange{{0, 100}}, nil},
+		{"多个范围", "bytes=0-9, 20-29,-5", size, []byteRange{{0, 10}, {20, 10}, {95, 5}}, nil},
+		{"空白和空项", "bytes= 0 - 9 ,,", size, []byteRange{{0, 10}}, nil},
+		{"部分范围不满足时忽略那一部分", "bytes=0-9,200-300", size, []byteRange{{0, 10}}, nil},
+
+		//格式错误：忽略Range返回整个文件
+		{"不是bytes单位", "items=0-9", size, nil, nil},
+		{"没有横线", "bytes=10", size, nil, nil},
+		{"不是数字", "bytes=a-b", size, nil, nil},
+		{"end小于start", "bytes=9-0", size, nil, nil},
+		{"负数", "bytes=--5", size, nil, nil},
+		{"其中一项格式错误", "bytes=0-9,x-y", size, nil, nil},
+		{"空的范围", "bytes=", size, nil, nil},
+		{"范围太多", "bytes=" + strings.Repeat("0-0,", maxRanges+1), size, nil, nil},
+		{"重叠后比文件还大", "bytes=0-99,0-99", size, nil, nil},
+
+		//没有交集：416
+		{"start在文件末尾", "bytes=100-", size, nil, errRangeNotSatisfiable},
+		{"start超出文件", "bytes=200-300", size, nil, errRangeNotSatisfiable},
+		{"后缀为0", "bytes=-0", size, nil, errRangeNotSatisfiable},
+		{"空文件", "bytes=0-", 0, nil, errRangeNotSatisfiable},
+		{"空文件的后缀", "bytes=-10", 0, nil, errRangeNotSatisfiable},
+		{"所有范围都没有交集", "bytes=100-,200-", size, nil, errRangeNotSatisfiable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseRange(tt.header, tt.size)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("parseRange(%q) err = %v, want %v", tt.header, err, tt.err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseRange(%q) = %v, want %v", tt.header, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContentRange(t *testing.T) {
+	if got := (byteRange{start: 10, length: 5}).contentRange(100); got != "bytes 10-14/100" {
+		t.Errorf("contentRange = %q", got)
+	}
+}
+
+func TestQuoteETag(t *testing.T) {
+	for in, want := range map[string]string{"abc": `"abc"`, `"abc"`: `"abc"`, "": "", `""`: ""} {
+		if got := quoteETag(in); got != want {
+			t.Errorf("quoteETag(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	const etag = `"v1"`
+	lastModified := time.Date(2024, 5, 1, 12, 0, 0, 500_000_000, time.UTC)
+	tests := []struct {
+		name   string
+		header map[string]string
+		want   bool
+	}{
+		{"没有条件", nil, false},
+		{"ETag相同", map[string]string{"If-None-Match": `"v1"`}, true},
+		{"列表中有一个相同", map[string]string{"If-None-Match": `"v0", "v1"`}, true},
+		{"弱ETag也算相同", map[string]string{"If-None-Match": `W/"v1"`}, true},
+		{"星号", map[string]string{"If-None-Match": "*"}, true},
+		{"ETag不同", map[string]string{"If-None-Match": `"v2"`}, false},
+		{"有If-None-Match时不看日期", map[string]string{
+			"If-None-Match":     `"v2"`,
+			"If-Modified-Since": lastModified.Add(time.Hour).Format(http.TimeFormat),
+		}, false},
+		{"没有修改(日期只精确到秒)", map[string]string{"If-Modified-Since": lastModified.Format(http.TimeFormat)}, true},
+		{"之后修改过", map[string]string{"If-Modified-Since": lastModified.Add(-time.Second).Format(http.TimeFormat)}, false},
+		{"日期格式错误", map[string]string{"If-Modified-Since": "yesterday"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+			if got := notModified(req, etag, lastModified); got != tt.want {
+				t.Errorf("notModified = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRangeStillValid(t *testing.T) {
+	const etag = `"v1"`
+	lastModified := time.Date(2024, 5, 1, 12, 0, 0, 500_000_000, time.UTC)
+	tests := []struct {
+		name    string
+		ifRange string
+		etag    string
+		want    bool
+	}{
+		{"没有If-Range", "", etag, true},
+		{"ETag相同", `"v1"`, etag, true},
+		{"ETag不同", `"v2"`, etag, false},
+		{"弱ETag不能用于If-Range", `W/"v1"`, etag, false},
+		{"服务端没有ETag", `"v1"`, "", false},
+		{"日期相同", lastModified.Format(http.TimeFormat), etag, true},
+		{"日期更早", lastModified.Add(-time.Second).Format(http.TimeFormat), etag, false},
+		{"日期更晚也不行，必须相等", lastModified.Add(time.Second).Format(http.TimeFormat), etag, false},
+		{"日期格式错误", "yesterday", etag, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			if tt.ifRange != "" {
+				req.Header.Set("If-Range", tt.ifRange)
+			}
+			if got := rangeStillValid(req, tt.etag, lastModified); got != tt.want {
+				t.Errorf("rangeStillValid = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// 经过serveObject的条件请求：ETag和Last-Modified来自存储
+func TestServeObjectConditional(t *testing.T) {
+	useLocalStore(t)
+	putObject(t, "videos/1/a.mp4", []byte("0123456789"))
+	info, err := store.Stat(context.Background(), "videos/1/a.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := serveRouter("videos/1/a.mp4")
+	etag := quoteETag(info.ETag)
+	date := info.LastModified.UTC().Format(http.TimeFormat)
+
+	tests := []struct {
+		name   string
+		header map[string]string
+		code   int
+		body   string
+	}{
+		{"If-None-Match命中", map[string]string{"If-None-Match": etag}, 304, ""},
+		{"If-None-Match不命中", map[string]string{"If-None-Match": `"old"`}, 200, "0123456789"},
+		{"If-Modified-Since命中", map[string]string{"If-Modified-Since": date}, 304, ""},
+		{"If-Range的ETag一致时返回范围", map[string]string{"Range": "bytes=0-3", "If-Range": etag}, 206, "0123"},
+		{"If-Range的ETag不一致时返回整个文件", map[string]string{"Range": "bytes=0-3", "If-Range": `"old"`}, 200, "0123456789"},
+		{"If-Range的日期一致时返回范围", map[string]string{"Range": "bytes=0-3", "If-Range": date}, 206, "0123"},
+		{"If-Range的日期不一致时返回整个文件", map[string]string{"Range": "bytes=0-3", "If-Range": "Mon, 01 Jan 2001 00:00:00 GMT"}, 200, "0123456789"},
+		{"If-Range不一致时也不返回416", map[string]string{"Range": "bytes=100-", "If-Range": `"old"`}, 200, "0123456789"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := doRequest(r, "GET", tt.header)
+			if w.Code != tt.code {
+				t.Fatalf("状态码 = %d, want %d", w.Code, tt.code)
+			}
+			if got := w.Body.String(); got != tt.body {
+				t.Errorf("响应体 = %q, want %q", got, tt.body)
+			}
+			//304也要带上缓存验证用的响应头
+			if w.Header().Get("ETag") != etag || w.Header().Get("Last-Modified") != date {
+				t.Errorf("ETag = %q, Last-Modified = %q", w.Header().Get("ETag"), w.Header().Get("Last-Modified"))
+			}
+		})
+	}
+}
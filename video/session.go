@@ -0,0 +1,282 @@
+package video
+
+//上传会话的归属校验和过期清理
+import (
+	"Project01/db"
+	"Project01/login"
+	"Project01/storage"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// 上传会话在gin上下文中的键
+const uploadSessionKey = "upload_session"
+
+// 上传会话是否已过期：超过SessionTTL没有任何进度更新
+func sessionExpired(session *db.UploadSession) bool {
+	return time.Since(session.UpdatedTime) > uploadCfg.SessionTTL
+}
+
+// 上传会话校验中间件，挂在所有/upload/:uploadId/*路由上
+// 只有会话的创建者才能操作，否则返回403；会话不存在返回404
+// active为true时(上传分片、完成上传)还要求会话仍在上传中且没有过期
+// 校验通过后把会话放入上下文，handler通过currentSession获取
+func RequireUploadSession(active bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, err := login.CurrentUser(c)
+		if err != nil {
+			c.JSON(401, gin.H{"error": err.Error()})
+			c.Abort()
+			return
+		}
+		var session db.UploadSession
+		if err := db.GetDB().Where("upload_id=?", c.Param("uploadId")).First(&session).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(404, gin.H{"error": "上传会话不存在"})
+			} else {
+				c.JSON(500, gin.H{"error": "查询上传会话失败"})
+			}
+			c.Abort()
+			return
+		}
+		if session.UserId != user.UserId {
+			c.JSON(403, gin.H{"error": "无权操作该上传会话"})
+			c.Abort()
+			return
+		}
+		if active {
+			if session.Status != "uploading" {
+				c.JSON(409, gin.H{"error": "上传会话已结束", "status": session.Status})
+				c.Abort()
+				return
+			}
+			if sessionExpired(&session) {
+				c.JSON(410, gin.H{"error": "上传会话已过期，请重新上传"})
+				c.Abort()
+				return
+			}
+		}
+		c.Set(uploadSessionKey, &session)
+		c.Next()
+	}
+}
+
+// 获取RequireUploadSession放入上下文的上传会话
+func currentSession(c *gin.Context) *db.UploadSession {
+	v, _ := c.Get(uploadSessionKey)
+	session, _ := v.(*db.UploadSession)
+	return session
+}
+
+// 检查会话的上传协议，分片接口和tus接口不能混用(tus要求按偏移量顺序追加)
+func checkProtocol(c *gin.Context, session *db.UploadSession, protocol string) bool {
+	if session.Protocol != protocol {
+		c.JSON(409, gin.H{"error": "上传会话的协议不匹配", "protocol": session.Protocol})
+		return false
+	}
+	return true
+}
+
+// 启动后台清理任务：定期把过期的上传会话标记为failed，终止它的multipart upload并删除分片记录；
+// 同时重试删除视频时没有删掉的对象
+func StartSessionJanitor(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(uploadCfg.JanitorInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if n, err := expireStaleSessions(ctx); err != nil {
+					fmt.Printf("清理过期上传会话失败：%v\n", err)
+				} else if n > 0 {
+					fmt.Printf("已清理%d个过期上传会话\n", n)
+				}
+				if n, err := retryPendingDeletes(ctx); err != nil {
+					fmt.Printf("删除已释放的对象失败：%v\n", err)
+				} else if n > 0 {
+					fmt.Printf("已删除%d个之前没有删掉的对象\n", n)
+				}
+			}
+		}
+	}()
+}
+
+// 每批清理的会话数
+const expireBatchSize = 100
+
+// 清理过期的上传会话，返回清理的个数；分批处理，直到没有过期的会话
+// 处理过的会话状态都已经改掉，不会被下一批重复查到
+func expireStaleSessions(ctx context.Context) (int, error) {
+	deadline := time.Now().Add(-uploadCfg.SessionTTL)
+	count := 0
+	for {
+		n, more, err := expireSessionBatch(ctx, deadline)
+		count += n
+		if err != nil || !more {
+			return count, err
+		}
+		if err := ctx.Err(); err != nil {
+			return count, err
+		}
+	}
+}
+
+// 清理一批过期的会话，more表示这一批是满的，可能还有没处理的
+func expireSessionBatch(ctx context.Context, deadline time.Time) (count int, more bool, err error) {
+	database := db.GetDB()
+	var sessions []db.UploadSession
+	//merging超时说明完成请求在合并过程中中断了(如服务重启)，也一并清理
+	if err := database.Where("status IN ? AND updated_time<?", []string{"uploading", "merging"}, deadline).
+		Limit(expireBatchSize).Find(&sessions).Error; err != nil {
+		return 0, false, err
+	}
+	for _, session := range sessions {
+		//条件更新：只有状态没变且仍然过期的才标记为failed，避免和正在进行的上传冲突
+		result := database.Model(&db.UploadSession{}).
+			Where("upload_id=? AND status=? AND updated_time<?", session.UploadId, session.Status, deadline).
+			Update("status", "failed")
+		if result.Error != nil {
+			return count, false, result.Error
+		}
+		if result.RowsAffected == 0 {
+			continue
+		}
+		//合并中断时multipart upload可能已经完成，合并出的对象没有视频记录引用
+		if session.Status == "merging" {
+			if err := store.Delete(ctx, session.ObjectKey); err != nil {
+				fmt.Printf("清理上传会话%s的对象失败：%v\n", session.UploadId, err)
+			}
+		}
+		if err := removeSessionChunks(ctx, &session); err != nil {
+			fmt.Printf("清理上传会话%s的分片失败：%v\n", session.UploadId, err)
+			continue
+		}
+		count++
+	}
+	return count, len(sessions) == expireBatchSize, nil
+}
+
+// 终止上传会话的multipart upload(存储会丢弃已上传的part)，删除数据库中的分片记录
+// 以前的会话每个分片是单独的对象uploads/<uploadId>/chunk_<n>，也一并删除
+func removeSessionChunks(ctx context.Context, session *db.UploadSession) error {
+	if session.MultipartUploadId != "" {
+		err := store.AbortMultipartUpload(ctx, session.ObjectKey, session.MultipartUploadId)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return err
+		}
+	}
+	objects, err := store.List(ctx, fmt.Sprintf("uploads/%s/", session.UploadId))
+	if err != nil {
+		return err
+	}
+	for _, obj := range objects {
+		if err := store.Delete(ctx, obj.Key); err != nil {
+			return err
+		}
+	}
+	return db.GetDB().Where("upload_id=?", session.UploadId).Delete(&db.ChunkRecord{}).Error
+}
+
+// 当前用户的上传会话列表，按创建时间倒序分页，浏览器重启后据此继续上传
+// GET /upload/sessions?page=1&page_size=20&status=uploading
+func ListUploadSessionsHandler(c *gin.Context) {
+	user, err := login.CurrentUser(c)
+	if err != nil {
+		c.JSON(401, gin.H{"error": err.Error()})
+		return
+	}
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		c.JSON(400, gin.H{"error": "page不合法"})
+		return
+	}
+	pageSize, err := strconv.Atoi(c.DefaultQuery("page_size", strconv.Itoa(defaultPageSize)))
+	if err != nil || pageSize < 1 || pageSize > maxPageSize {
+		c.JSON(400, gin.H{"error": "page_size必须在1~100之间"})
+		return
+	}
+	database := db.GetDB()
+	query := database.Model(&db.UploadSession{}).Where("user_id=?", user.UserId)
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status=?", status)
+	}
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		c.JSON(500, gin.H{"error": "查询上传会话数量失败"})
+		return
+	}
+	var sessions []db.UploadSession
+	if err := query.Order("created_time DESC, id DESC").
+		Offset((page - 1) * pageSize).Limit(pageSize).
+		Find(&sessions).Error; err != nil {
+		c.JSON(500, gin.H{"error": "查询上传会话失败"})
+		return
+	}
+	//一次查出这一页所有会话已完成的分片
+	uploadIds := make([]string, 0, len(sessions))
+	for _, session := range sessions {
+		uploadIds = append(uploadIds, session.UploadId)
+	}
+	var chunks []db.ChunkRecord
+	if len(uploadIds) > 0 {
+		if err := database.Select("upload_id", "chunk_index").
+			Where("upload_id IN ? AND status=?", uploadIds, "completed").
+			Find(&chunks).Error; err != nil {
+			c.JSON(500, gin.H{"error": "查询分片记录失败"})
+			return
+		}
+	}
+	completed := make(map[string][]uint64)
+	for _, chunk := range chunks {
+		completed[chunk.UploadId] = append(completed[chunk.UploadId], chunk.ChunkIndex)
+	}
+	items := make([]gin.H, 0, len(sessions))
+	for i := range sessions {
+		item := uploadProgress(&sessions[i], completed[sessions[i].UploadId])
+		item["expired"] = sessions[i].Status == "uploading" && sessionExpired(&sessions[i])
+		items = append(items, item)
+	}
+	c.JSON(200, gin.H{
+		"sessions":  items,
+		"total":     total,
+		"page":      page,
+		"page_size": pageSize,
+	})
+}
+
+// 取消上传：终止multipart upload，删除已上传的分片，会话标记为cancelled
+// DELETE /upload/:uploadId
+func CancelUploadHandler(c *gin.Context) {
+	session := currentSession(c)
+	if !cancelSession(c, session) {
+		return
+	}
+	c.JSON(200, gin.H{"message": "已取消上传", "upload_id": session.UploadId})
+}
+
+// 取消上传会话，失败时已经写好响应，返回false
+func cancelSession(c *gin.Context, session *db.UploadSession) bool {
+	//条件更新：只有仍在上传中的会话才能取消，避免和正在完成的上传冲突
+	ok, err := transitSession(db.GetDB(), session.UploadId, "uploading", "cancelled")
+	if err != nil {
+		c.JSON(500, gin.H{"error": "取消上传失败"})
+		return false
+	}
+	if !ok {
+		c.JSON(409, gin.H{"error": "上传会话已结束", "status": session.Status})
+		return false
+	}
+	if err := removeSessionChunks(c, session); err != nil {
+		//会话已经是cancelled，不会再被使用，残留的分片不影响功能
+		fmt.Printf("清理上传会话%s的分片失败：%v\n", session.UploadId, err)
+	}
+	return true
+}
@@ -0,0 +1,297 @@
+package video
+
+//视频处理状态：uploaded(等待后台任务) -> processing -> ready/failed，版主可以屏蔽(blocked)和解除屏蔽
+//状态只由读取媒体信息(probe)的任务决定：probe成功后原始文件就可以播放；
+//打包和转码是附加的，失败时只是少了HLS/DASH或某个规格(部分完成)，原始文件仍然可以播放
+import (
+	"Project01/db"
+	"Project01/login"
+	"errors"
+	"fmt"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// 屏蔽原因的长度限制(字符数)，和db.VideoInfo.StatusReason的列定义一致
+const maxStatusReasonLen = 2000
+
+// 根据视频的probe任务推导处理状态，没有probe任务时按失败处理
+func computeVideoStatus(tx *gorm.DB, videoId uint64) (status, reason string, err error) {
+	var probe db.Job
+	err = tx.Select("id", "type", "status", "attempts", "error").
+		Where("video_id=? AND type=?", videoId, "probe").Order("id DESC").First(&probe).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return "failed", "没有读取媒体信息的任务", nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+	switch probe.Status {
+	case "succeeded":
+		return "ready", "", nil
+	case "failed":
+		return "failed", jobDescription(&probe) + "失败：" + probe.Error, nil
+	default:
+		if probe.Attempts > 0 {
+			return "processing", "", nil
+		}
+		return "uploaded", "", nil
+	}
+}
+
+func jobDescription(job *db.Job) string {
+	switch job.Type {
+	case "probe":
+		return "读取媒体信息"
+	case "package":
+		return "打包HLS/DASH"
+	case "transcode":
+		return "转码" + job.Rendition
+	default:
+		return job.Type
+	}
+}
+
+// 把视频改为新的状态并记录时间，状态没有变化时不更新
+func applyVideoStatus(tx *gorm.DB, video *db.VideoInfo, status, reason string) error {
+	if video.Status == status && video.StatusReason == reason {
+		return nil
+	}
+	now := time.Now()
+	updates := map[string]interface{}{
+		"status":              status,
+		"status_reason":       reason,
+		"status_updated_time": now,
+	}
+	switch status {
+	case "processing":
+		if video.ProcessingStartedTime == nil {
+			updates["processing_started_time"] = now
+		}
+		updates["processed_time"] = nil
+	case "ready", "failed":
+		updates["processed_time"] = now
+	}
+	return tx.Model(video).Updates(updates).Error
+}
+
+// probe任务开始执行时，视频从uploaded改为processing
+func markVideoProcessing(videoId uint64) {
+	now := time.Now()
+	err := db.GetDB().Model(&db.VideoInfo{}).
+		Where("id=? AND status=?", videoId, "uploaded").
+		Updates(map[string]interface{}{
+			"status":                  "processing",
+			"status_updated_time":     now,
+			"processing_started_time": now,
+		}).Error
+	if err != nil {
+		fmt.Printf("更新视频%d的处理状态失败：%v\n", videoId, err)
+	}
+}
+
+// probe任务结束后重新推导视频的处理状态；锁住视频记录，和屏蔽、解除屏蔽互不覆盖
+// 被屏蔽的视频不受影响
+func refreshVideoStatus(videoId uint64) {
+	err := db.GetDB().Transaction(func(tx *gorm.DB) error {
+		var video db.VideoInfo
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&video, videoId).Error; err != nil {
+			return err
+		}
+		if video.Status != "uploaded" && video.Status != "processing" {
+			return nil
+		}
+		status, reason, err := computeVideoStatus(tx, videoId)
+		if err != nil {
+			return err
+		}
+		return applyVideoStatus(tx, &video, status, reason)
+	})
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		fmt.Printf("更新视频%d的处理状态失败：%v\n", videoId, err)
+	}
+}
+
+// 超时任务被标记为failed时没有工作协程去更新视频状态，定期检查probe任务已经结束却仍在处理中的视频
+func refreshStuckVideoStatuses() {
+	var ids []uint64
+	err := db.GetDB().Model(&db.VideoInfo{}).
+		Where("status IN ?", []string{"uploaded", "processing"}).
+		Where("NOT EXISTS (SELECT 1 FROM jobs WHERE jobs.video_id=video_infos.id AND jobs.type=? AND jobs.status IN ?)",
+			"probe", []string{"queued", "running"}).
+		Pluck("id", &ids).Error
+	if err != nil {
+		fmt.Printf("查询处理中的视频失败：%v\n", err)
+		return
+	}
+	for _, id := range ids {
+		refreshVideoStatus(id)
+	}
+}
+
+// 视频能不能播放，不能时直接写好响应：被屏蔽返回403，还没有处理完成(或处理失败)返回409
+func checkPlayable(c *gin.Context, video *db.VideoInfo) bool {
+	switch video.Status {
+	case "ready":
+		return true
+	case "blocked":
+		c.JSON(403, gin.H{"error": "视频已被屏蔽", "status": video.Status})
+	case "failed":
+		c.JSON(409, gin.H{"error": "视频处理失败", "status": video.Status, "status_reason": video.StatusReason})
+	default:
+		c.JSON(409, gin.H{"error": "视频还没有处理完成", "status": video.Status})
+	}
+	return false
+}
+
+// 当前用户能否看到不是ready的视频：上传者本人，或者有video:moderate权限
+func canSeeUnready(c *gin.Context, video *db.VideoInfo) bool {
+	if video.Status == "ready" {
+		return true
+	}
+	p, err := login.CurrentUser(c)
+	if err != nil {
+		return false
+	}
+	return p.UserId == video.UploaderId || p.Can("video", "moderate")
+}
+
+// 查询视频，不是ready且当前用户看不到时按不存在处理
+func findVisibleVideo(c *gin.Context, id uint64) (*db.VideoInfo, bool) {
+	video, ok := findVideo(c, id)
+	if !ok {
+		return nil, false
+	}
+	if !canSeeUnready(c, video) {
+		c.JSON(404, gin.H{"error": "视频不存在"})
+		return nil, false
+	}
+	return video, true
+}
+
+// 处理进度，上传者的页面轮询这个接口显示“正在处理 2/3 个规格”
+// partial表示打包或者有规格转码失败，原始文件仍然可以播放
+// GET /videos/:id/status
+func VideoStatusHandler(c *gin.Context) {
+	id, ok := parseVideoId(c)
+	if !ok {
+		return
+	}
+	video, ok := findVideo(c, id)
+	if !ok {
+		return
+	}
+	var jobs []db.Job
+	if err := db.GetDB().Where("video_id=?", video.ID).Order("id").Find(&jobs).Error; err != nil {
+		c.JSON(500, gin.H{"error": "查询后台任务失败"})
+		return
+	}
+	var total, completed, failed int
+	partial := false
+	for _, job := range jobs {
+		if job.Type != "probe" && job.Status == "failed" {
+			partial = true
+		}
+		if job.Type != "transcode" {
+			continue
+		}
+		total++
+		switch job.Status {
+		case "succeeded":
+			completed++
+		case "failed":
+			failed++
+		}
+	}
+	c.JSON(200, gin.H{
+		"video_id":                video.ID,
+		"status":                  video.Status,
+		"status_reason":           video.StatusReason,
+		"status_updated_time":     video.StatusUpdatedTime,
+		"processing_started_time": video.ProcessingStartedTime,
+		"processed_time":          video.ProcessedTime,
+		"hls_status":              video.HLSStatus,
+		"partial":                 partial,
+		"renditions": gin.H{
+			"total":     total,
+			"completed": completed,
+			"failed":    failed,
+		},
+		"jobs": jobs,
+	})
+}
+
+// 屏蔽视频的请求
+type BlockVideoRequest struct {
+	Reason string `json:"reason"`
+}
+
+// 屏蔽视频(需要video:moderate权限)，屏蔽后不能播放，也不出现在列表中
+// POST /videos/:id/block
+func BlockVideoHandler(c *gin.Context) {
+	id, ok := parseVideoId(c)
+	if !ok {
+		return
+	}
+	var req BlockVideoRequest
+	//请求体可以为空
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(400, gin.H{"error": "参数错误"})
+			return
+		}
+	}
+	if utf8.RuneCountInString(req.Reason) > maxStatusReasonLen {
+		c.JSON(400, gin.H{"error": "屏蔽原因不能超过2000个字符"})
+		return
+	}
+	video, ok := findVideo(c, id)
+	if !ok {
+		return
+	}
+	if err := applyVideoStatus(db.GetDB(), video, "blocked", req.Reason); err != nil {
+		c.JSON(500, gin.H{"error": "屏蔽视频失败"})
+		return
+	}
+	c.JSON(200, gin.H{"message": "已屏蔽视频"})
+}
+
+// 解除屏蔽(需要video:moderate权限)，按后台任务的结果恢复处理状态
+// POST /videos/:id/unblock
+func UnblockVideoHandler(c *gin.Context) {
+	id, ok := parseVideoId(c)
+	if !ok {
+		return
+	}
+	var status string
+	err := db.GetDB().Transaction(func(tx *gorm.DB) error {
+		var video db.VideoInfo
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&video, id).Error; err != nil {
+			return err
+		}
+		status = video.Status
+		if video.Status != "blocked" {
+			return nil
+		}
+		var reason string
+		var err error
+		status, reason, err = computeVideoStatus(tx, id)
+		if err != nil {
+			return err
+		}
+		return applyVideoStatus(tx, &video, status, reason)
+	})
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(404, gin.H{"error": "视频不存在"})
+		} else {
+			c.JSON(500, gin.H{"error": "解除屏蔽失败"})
+		}
+		return
+	}
+	c.JSON(200, gin.H{"message": "已解除屏蔽", "status": status})
+}
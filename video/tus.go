@@ -0,0 +1,450 @@
+package video
+
+//tus 1.0 可续传上传协议(https://tus.io/protocols/resumable-upload)，Uppy、tus-js-client等客户端可以直接使用
+//支持的扩展：creation、termination、checksum、expiration
+//tus会话和分片接口共用db.UploadSession和multipart upload：数据按偏移量顺序追加，
+//凑满一个分片就作为multipart upload的part上传；不足一个分片的尾部暂存为对象uploads/<uploadId>/tus_<分片编号>_<长度>_<UUID>，
+//下一次PATCH时和新数据拼在一起。偏移量就是会话的UploadedSize，当前的尾部对象记录在会话的TusPartialKey里
+import (
+	"Project01/config"
+	"Project01/db"
+	"Project01/login"
+	"Project01/storage"
+	"bufio"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	tusVersion            = "1.0.0"
+	tusExtensions         = "creation,termination,checksum,expiration"
+	tusChecksumAlgorithms = "sha1,sha256,md5"
+	tusContentType        = "application/offset+octet-stream"
+)
+
+// 并发的PATCH中已经有一个先提交了，偏移量已经变化
+var errTusOffsetConflict = errors.New("Upload-Offset和服务端不一致")
+
+// tus协议要求的公共响应头，并检查客户端的协议版本(OPTIONS以外的请求都必须带Tus-Resumable)
+func TusMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Tus-Resumable", tusVersion)
+		if c.GetHeader("Tus-Resumable") != tusVersion {
+			c.Header("Tus-Version", tusVersion)
+			c.AbortWithStatusJSON(412, gin.H{"error": "不支持的tus协议版本"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// 查询服务端支持的协议版本和扩展，不需要鉴权
+// OPTIONS /jwt/tus/files
+func TusOptionsHandler(c *gin.Context) {
+	c.Header("Tus-Resumable", tusVersion)
+	c.Header("Tus-Version", tusVersion)
+	c.Header("Tus-Extension", tusExtensions)
+	c.Header("Tus-Checksum-Algorithm", tusChecksumAlgorithms)
+	c.Status(204)
+}
+
+// 创建上传(creation扩展)
+// POST /jwt/tus/files
+// Upload-Length: 文件总大小；Upload-Metadata: filename <base64>[,sha256 <base64编码的十六进制SHA-256>]
+func TusCreateHandler(c *gin.Context) {
+	user, err := login.CurrentUser(c)
+	if err != nil {
+		c.JSON(401, gin.H{"error": err.Error()})
+		return
+	}
+	if c.GetHeader("Upload-Defer-Length") != "" {
+		c.JSON(400, gin.H{"error": "不支持Upload-Defer-Length，请提供Upload-Length"})
+		return
+	}
+	totalSize, err := strconv.ParseUint(c.GetHeader("Upload-Length"), 10, 64)
+	if err != nil || totalSize == 0 {
+		c.JSON(400, gin.H{"error": "Upload-Length不合法"})
+		return
+	}
+	metadata, err := parseTusMetadata(c.GetHeader("Upload-Metadata"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Upload-Metadata格式错误"})
+		return
+	}
+	//Uppy用name，tus-js-client的示例用filename，两个都认
+	filename := metadata["filename"]
+	if filename == "" {
+		filename = metadata["name"]
+	}
+	if filename == "" {
+		c.JSON(400, gin.H{"error": "Upload-Metadata缺少filename"})
+		return
+	}
+	fileSha256, ok := normalizeSHA256(metadata["sha256"])
+	if !ok {
+		c.JSON(400, gin.H{"error": "sha256格式错误，应为64位十六进制"})
+		return
+	}
+	//检查大小上限和扩展名，文件内容在凑满第0个分片时再检查
+	if uerr := checkUploadSize(user, totalSize); uerr != nil {
+		uerr.respond(c)
+		return
+	}
+	if _, uerr := checkExtension(filename); uerr != nil {
+		uerr.respond(c)
+		return
+	}
+	session := db.UploadSession{
+		UserId:     user.UserId,
+		FileName:   filename,
+		TotalSize:  totalSize,
+		FileSha256: fileSha256,
+		Protocol:   "tus",
+	}
+	//每次PATCH都要把尾部和新数据拼起来重写一遍，分片用最小的part大小，尾部满5MB就上传为part
+	if !createUploadSession(c, &session, config.MinChunkSize) {
+		return
+	}
+	c.Header("Location", strings.TrimSuffix(c.Request.URL.Path, "/")+"/"+session.UploadId)
+	c.Header("Upload-Expires", tusExpires(time.Now()))
+	c.Status(201)
+}
+
+// 查询偏移量，客户端据此从断点继续上传
+// HEAD /jwt/tus/files/:uploadId
+func TusHeadHandler(c *gin.Context) {
+	session := currentSession(c)
+	if session.Protocol != "tus" {
+		c.Status(404)
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	switch session.Status {
+	case "uploading":
+		if sessionExpired(session) {
+			c.Status(410)
+			return
+		}
+		c.Header("Upload-Expires", tusExpires(session.UpdatedTime))
+	case "merging":
+	case "completed":
+		c.Header("Video-Id", strconv.FormatUint(session.VideoId, 10))
+	default:
+		//已取消或已失败的上传
+		c.Status(410)
+		return
+	}
+	c.Header("Upload-Offset", strconv.FormatUint(session.UploadedSize, 10))
+	c.Header("Upload-Length", strconv.FormatUint(session.TotalSize, 10))
+	c.Header("Upload-Metadata", tusMetadata(session))
+	c.Status(200)
+}
+
+// 追加数据
+// PATCH /jwt/tus/files/:uploadId
+// Upload-Offset必须等于当前偏移量；带Upload-Checksum时整个请求体校验通过才会生效(checksum扩展)
+// 数据传完之后自动完成上传，响应头Video-Id是创建的视频ID；完成失败时可以调用/upload/:uploadId/complete重试
+func TusPatchHandler(c *gin.Context) {
+	session := currentSession(c)
+	if session.Protocol != "tus" {
+		c.JSON(404, gin.H{"error": "上传会话不存在"})
+		return
+	}
+	if c.ContentType() != tusContentType {
+		c.JSON(415, gin.H{"error": "Content-Type必须是" + tusContentType})
+		return
+	}
+	offset, err := strconv.ParseUint(c.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Upload-Offset不合法"})
+		return
+	}
+	if offset != session.UploadedSize {
+		c.Header("Upload-Offset", strconv.FormatUint(session.UploadedSize, 10))
+		c.JSON(409, gin.H{"error": errTusOffsetConflict.Error(), "offset": session.UploadedSize})
+		return
+	}
+	//需要提前知道长度，才能决定数据是凑成完整的分片还是暂存为尾部
+	length := c.Request.ContentLength
+	if length < 0 {
+		c.JSON(411, gin.H{"error": "缺少Content-Length"})
+		return
+	}
+	if offset+uint64(length) > session.TotalSize {
+		c.JSON(413, gin.H{"error": "数据超出Upload-Length"})
+		return
+	}
+	checksum, err := parseTusChecksum(c.GetHeader("Upload-Checksum"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if length == 0 {
+		c.Header("Upload-Offset", strconv.FormatUint(offset, 10))
+		c.Status(204)
+		return
+	}
+
+	body := io.Reader(c.Request.Body)
+	if checksum != nil {
+		body = io.TeeReader(body, checksum.hash)
+	}
+	result, err := appendTusData(c, session, offset, uint64(length), body)
+	//失败或校验不通过时，新写入的part在重传时会被同一个part编号覆盖，只需要删除新的尾部暂存对象
+	//尾部对象的名字带UUID，并发的PATCH各写各的，删除的不会是别的请求已经提交的尾部
+	discard := func() {
+		if result.partial != "" {
+			_ = store.Delete(context.Background(), result.partial)
+		}
+	}
+	if err != nil {
+		discard()
+		var uerr *uploadError
+		switch {
+		case errors.As(err, &uerr):
+			uerr.respond(c)
+		case errors.Is(err, errTusOffsetConflict):
+			c.JSON(409, gin.H{"error": err.Error()})
+		default:
+			fmt.Printf("上传会话%s追加数据失败：%v\n", session.UploadId, err)
+			c.JSON(500, gin.H{"error": "上传数据失败"})
+		}
+		return
+	}
+	if checksum != nil && !checksum.match() {
+		discard()
+		c.JSON(460, gin.H{"error": "校验和不一致，请重新上传", "code": "checksum_mismatch", "retryable": true})
+		return
+	}
+	if err := commitTusAppend(session, offset, result); err != nil {
+		discard()
+		if errors.Is(err, errTusOffsetConflict) {
+			c.JSON(409, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(500, gin.H{"error": "更新上传进度失败"})
+		}
+		return
+	}
+	//原来的尾部已经拼进新的尾部或者完整的分片里了
+	if session.TusPartialKey != "" {
+		_ = store.Delete(context.Background(), session.TusPartialKey)
+	}
+	c.Header("Upload-Offset", strconv.FormatUint(result.offset, 10))
+	c.Header("Upload-Expires", tusExpires(time.Now()))
+	if result.offset == session.TotalSize {
+		session.UploadedSize = result.offset
+		videoId, ok := completeUpload(c, session)
+		if !ok {
+			return
+		}
+		c.Header("Video-Id", strconv.FormatUint(videoId, 10))
+	}
+	c.Status(204)
+}
+
+// 终止上传(termination扩展)，和取消上传一样
+// DELETE /jwt/tus/files/:uploadId
+func TusTerminateHandler(c *gin.Context) {
+	session := currentSession(c)
+	if session.Protocol != "tus" {
+		c.JSON(404, gin.H{"error": "上传会话不存在"})
+		return
+	}
+	if !cancelSession(c, session) {
+		return
+	}
+	c.Status(204)
+}
+
+// 一次PATCH追加数据的结果，校验通过后才写入数据库
+type tusAppend struct {
+	offset  uint64           //追加之后的偏移量
+	chunks  []db.ChunkRecord //凑满并上传成part的分片
+	partial string           //新的尾部暂存对象，没有则为空
+}
+
+// 把请求体按分片边界切开：凑满的分片上传为part，最后不足一个分片的部分写成尾部暂存对象
+func appendTusData(ctx context.Context, session *db.UploadSession, offset, length uint64, body io.Reader) (*tusAppend, error) {
+	result := &tusAppend{offset: offset}
+	for length > 0 {
+		index := result.offset / session.ChunkSize
+		pos := result.offset % session.ChunkSize //分片内已有的字节数，在尾部暂存对象里
+		chunkLen := min(session.ChunkSize, session.TotalSize-index*session.ChunkSize)
+		n := min(chunkLen-pos, length)
+		src := io.LimitReader(body, int64(n))
+		var partialObj io.ReadCloser
+		if pos > 0 {
+			//只有第一个分片可能有之前的尾部，之后的分片都从边界开始
+			obj, err := store.Get(ctx, session.TusPartialKey, 0, -1)
+			if errors.Is(err, storage.ErrNotFound) {
+				return result, errTusOffsetConflict //并发的PATCH已经提交并删除了这个尾部
+			}
+			if err != nil {
+				return result, err
+			}
+			partialObj = obj
+			src = io.MultiReader(obj, src)
+		}
+		var err error
+		if pos+n == chunkLen {
+			err = result.putChunk(ctx, session, index, src, chunkLen)
+		} else {
+			key := tusPartialKey(session.UploadId, index, pos+n)
+			_, err = store.Put(ctx, key, src, int64(pos+n), "application/octet-stream")
+			if err == nil {
+				result.partial = key
+			}
+		}
+		if partialObj != nil {
+			partialObj.Close()
+		}
+		if err != nil {
+			return result, err
+		}
+		result.offset += n
+		length -= n
+	}
+	return result, nil
+}
+
+// 上传一个凑满的分片，边上传边计算SHA-256；第0个分片先检查文件头
+func (r *tusAppend) putChunk(ctx context.Context, session *db.UploadSession, index uint64, src io.Reader, size uint64) error {
+	hasher := sha256.New()
+	src = io.TeeReader(src, hasher)
+	if index == 0 {
+		br := bufio.NewReaderSize(src, sniffLen)
+		head, _ := br.Peek(sniffLen) //文件比sniffLen还小时返回的是全部数据
+		if _, uerr := checkContent(session.FileName, head); uerr != nil {
+			return uerr
+		}
+		src = br
+	}
+	part, err := store.PutPart(ctx, session.ObjectKey, session.MultipartUploadId, int(index+1), src, int64(size))
+	if err != nil {
+		return err
+	}
+	r.chunks = append(r.chunks, db.ChunkRecord{
+		ChunkIndex: index,
+		ETag:       part.ETag,
+		Size:       size,
+		Checksum:   hex.EncodeToString(hasher.Sum(nil)),
+	})
+	return nil
+}
+
+// 把追加的结果写入数据库：偏移量做条件更新，并发的PATCH只有一个能成功
+// 新的尾部对象和偏移量一起更新，成功的那个请求的尾部才会被下一次PATCH读取
+func commitTusAppend(session *db.UploadSession, offset uint64, result *tusAppend) error {
+	return db.GetDB().Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&db.UploadSession{}).
+			Where("upload_id=? AND status=? AND uploaded_size=?", session.UploadId, "uploading", offset).
+			Updates(map[string]interface{}{"uploaded_size": result.offset, "tus_partial_key": result.partial})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errTusOffsetConflict
+		}
+		for _, chunk := range result.chunks {
+			if err := tx.Model(&db.ChunkRecord{}).
+				Where("upload_id=? AND chunk_index=?", session.UploadId, chunk.ChunkIndex).
+				Updates(map[string]interface{}{
+					"status":   "completed",
+					"etag":     chunk.ETag,
+					"size":     chunk.Size,
+					"checksum": chunk.Checksum,
+				}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// 新的尾部暂存对象的名字，每次都不同；分片编号和长度只是方便排查，读取时以会话的TusPartialKey为准
+func tusPartialKey(uploadId string, index, length uint64) string {
+	return fmt.Sprintf("uploads/%s/tus_%d_%d_%s", uploadId, index, length, uuid.New().String())
+}
+
+// 上传的过期时间(expiration扩展)：最后一次进度更新之后SessionTTL
+func tusExpires(updated time.Time) string {
+	return updated.Add(uploadCfg.SessionTTL).UTC().Format(http.TimeFormat)
+}
+
+// 解析Upload-Metadata：逗号分隔的"键 base64值"，值可以省略
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, errors.New("空的键")
+		}
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, err
+		}
+		metadata[key] = string(decoded)
+	}
+	return metadata, nil
+}
+
+// HEAD响应里原样返回创建时的元数据
+func tusMetadata(session *db.UploadSession) string {
+	metadata := "filename " + base64.StdEncoding.EncodeToString([]byte(session.FileName))
+	if session.FileSha256 != "" {
+		metadata += ",sha256 " + base64.StdEncoding.EncodeToString([]byte(session.FileSha256))
+	}
+	return metadata
+}
+
+// Upload-Checksum: <算法> <base64编码的摘要>，校验的是本次PATCH的整个请求体
+type tusChecksum struct {
+	hash     hash.Hash
+	expected []byte
+}
+
+func parseTusChecksum(header string) (*tusChecksum, error) {
+	if header == "" {
+		return nil, nil
+	}
+	algorithm, value, _ := strings.Cut(header, " ")
+	var h hash.Hash
+	switch algorithm {
+	case "sha1":
+		h = sha1.New()
+	case "sha256":
+		h = sha256.New()
+	case "md5":
+		h = md5.New()
+	default:
+		return nil, errors.New("不支持的校验算法，支持" + tusChecksumAlgorithms)
+	}
+	expected, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(expected) != h.Size() {
+		return nil, errors.New("Upload-Checksum格式错误")
+	}
+	return &tusChecksum{hash: h, expected: expected}, nil
+}
+
+func (t *tusChecksum) match() bool {
+	return string(t.hash.Sum(nil)) == string(t.expected)
+}
@@ -0,0 +1,259 @@
+package video
+
+import (
+	"Project01/db"
+	"Project01/internal/dbtest"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 80字节的MP4：三个分片32+32+16
+var tusData = append(append([]byte{0, 0, 0, 0x18}, []byte("ftypisom\x00\x00\x02\x00isomiso2mp41\x00\x00\x00\x08")...), bytes.Repeat([]byte("0123456789abcdef"), 3)...)
+
+// 还没有上传任何数据的tus会话，分片大小32字节
+func createTusSession(t *testing.T) *db.UploadSession {
+	t.Helper()
+	old := uploadCfg
+	uploadCfg.AllowedContainers = []string{"mp4"}
+	t.Cleanup(func() { uploadCfg = old })
+
+	session := &db.UploadSession{
+		UploadId: "tus-1", UserId: 1, FileName: "a.mp4", ObjectKey: "videos/1/a.mp4",
+		TotalSize: uint64(len(tusData)), ChunkSize: 32, TotalChunks: 3,
+		Status: "uploading", Protocol: "tus",
+	}
+	multipartUploadId, err := store.NewMultipartUpload(context.Background(), session.ObjectKey, "video/mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.MultipartUploadId = multipartUploadId
+	if err := db.GetDB().Create(session).Error; err != nil {
+		t.Fatal(err)
+	}
+	for i := uint64(0); i < session.TotalChunks; i++ {
+		end := min((i+1)*session.ChunkSize, session.TotalSize) - 1
+		chunk := &db.ChunkRecord{UploadId: session.UploadId, ChunkIndex: i, Size: end - i*session.ChunkSize + 1, StartByte: i * session.ChunkSize, EndByte: end}
+		if err := db.GetDB().Create(chunk).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	return session
+}
+
+// 只注册PATCH，会话由withSession从数据库读取
+func tusRouter() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.PATCH("/tus/:uploadId", withSession, TusPatchHandler)
+	return r
+}
+
+func tusPatch(r *gin.Engine, offset uint64, data []byte, checksum string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("PATCH", "/tus/tus-1", bytes.NewReader(data))
+	req.Header.Set("Content-Type", tusContentType)
+	req.Header.Set("Upload-Offset", strconv.FormatUint(offset, 10))
+	if checksum != "" {
+		req.Header.Set("Upload-Checksum", checksum)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func loadSession(t *testing.T, uploadId string) *db.UploadSession {
+	t.Helper()
+	var session db.UploadSession
+	if err := db.GetDB().Where("upload_id=?", uploadId).First(&session).Error; err != nil {
+		t.Fatal(err)
+	}
+	return &session
+}
+
+// 存储中会话的暂存对象
+func tusObjects(t *testing.T, uploadId string) []string {
+	t.Helper()
+	objects, err := store.List(context.Background(), "uploads/"+uploadId+"/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, o := range objects {
+		keys = append(keys, o.Key)
+	}
+	return keys
+}
+
+func readObject(t *testing.T, key string) []byte {
+	t.Helper()
+	body, err := store.Get(context.Background(), key, 0, -1)
+	if err != nil {
+		t.Fatalf("读取%s：%v", key, err)
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func sha1Checksum(data []byte) string {
+	sum := sha1.Sum(data)
+	return "sha1 " + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// 按偏移量追加：不足一个分片的部分暂存为尾部，凑满后上传为part；任何时候只保留一个已提交的尾部
+func TestTusPatchAppend(t *testing.T) {
+	dbtest.Open(t)
+	useLocalStore(t)
+	createTusSession(t)
+	r := tusRouter()
+
+	steps := []struct {
+		name      string
+		from, to  uint64
+		tail      uint64 //提交后尾部的长度
+		completed int    //已完成的分片数
+	}{
+		{"第一个尾部", 0, 10, 10, 0},
+		{"尾部变长", 10, 20, 20, 0},
+		{"凑满第0个分片，多出的成为新的尾部", 20, 40, 8, 1},
+		{"正好凑满第1个分片", 40, 64, 0, 2},
+		{"从分片边界开始的尾部", 64, 70, 6, 2},
+	}
+	for _, step := range steps {
+		w := tusPatch(r, step.from, tusData[step.from:step.to], "")
+		if w.Code != 204 || w.Header().Get("Upload-Offset") != strconv.FormatUint(step.to, 10) {
+			t.Fatalf("%s：状态码 = %d, Upload-Offset = %s, %s", step.name, w.Code, w.Header().Get("Upload-Offset"), w.Body.String())
+		}
+		session := loadSession(t, "tus-1")
+		if session.UploadedSize != step.to {
+			t.Errorf("%s：偏移量 = %d", step.name, session.UploadedSize)
+		}
+		keys := tusObjects(t, "tus-1")
+		if step.tail == 0 {
+			if session.TusPartialKey != "" || len(keys) != 0 {
+				t.Errorf("%s：不应该有尾部，TusPartialKey = %q, 对象 = %v", step.name, session.TusPartialKey, keys)
+			}
+		} else {
+			if len(keys) != 1 || keys[0] != session.TusPartialKey {
+				t.Fatalf("%s：TusPartialKey = %q, 对象 = %v", step.name, session.TusPartialKey, keys)
+			}
+			if got, want := readObject(t, session.TusPartialKey), tusData[step.to-step.tail:step.to]; !bytes.Equal(got, want) {
+				t.Errorf("%s：尾部 = %q, want %q", step.name, got, want)
+			}
+		}
+		var completed int64
+		db.GetDB().Model(&db.ChunkRecord{}).Where("upload_id=? AND status=?", "tus-1", "completed").Count(&completed)
+		if int(completed) != step.completed {
+			t.Errorf("%s：已完成%d个分片", step.name, completed)
+		}
+	}
+	//分片的校验和是整个分片(包括之前的尾部)的SHA-256
+	sum := sha256.Sum256(tusData[:32])
+	if chunk := chunkStatus(t, "tus-1", 0); chunk.Checksum != hex.EncodeToString(sum[:]) {
+		t.Errorf("分片0的校验和 = %s", chunk.Checksum)
+	}
+}
+
+func TestTusPatchRejected(t *testing.T) {
+	dbtest.Open(t)
+	useLocalStore(t)
+	createTusSession(t)
+	r := tusRouter()
+	if w := tusPatch(r, 0, tusData[:10], sha1Checksum(tusData[:10])); w.Code != 204 {
+		t.Fatalf("状态码 = %d, %s", w.Code, w.Body.String())
+	}
+	committed := loadSession(t, "tus-1").TusPartialKey
+
+	tests := []struct {
+		name     string
+		offset   uint64
+		data     []byte
+		checksum string
+		code     int
+	}{
+		{"偏移量落后", 0, tusData[:10], "", 409},
+		{"偏移量超前", 20, tusData[20:30], "", 409},
+		{"超出Upload-Length", 10, make([]byte, len(tusData)), "", 413},
+		{"不支持的校验算法", 10, tusData[10:20], "crc32 AAAAAA==", 400},
+		{"校验和不一致", 10, tusData[10:20], sha1Checksum(tusData[:10]), 460},
+		{"校验和不一致(凑满分片)", 10, tusData[10:40], sha1Checksum(tusData[:30]), 460},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := tusPatch(r, tt.offset, tt.data, tt.checksum)
+			if w.Code != tt.code {
+				t.Fatalf("状态码 = %d, want %d, %s", w.Code, tt.code, w.Body.String())
+			}
+			if tt.code == 409 && w.Header().Get("Upload-Offset") != "10" {
+				t.Errorf("Upload-Offset = %q", w.Header().Get("Upload-Offset"))
+			}
+			//偏移量和已提交的尾部都不变，新写入的尾部被删除
+			session := loadSession(t, "tus-1")
+			if session.UploadedSize != 10 || session.TusPartialKey != committed {
+				t.Errorf("偏移量 = %d, TusPartialKey = %q", session.UploadedSize, session.TusPartialKey)
+			}
+			if keys := tusObjects(t, "tus-1"); len(keys) != 1 || keys[0] != committed {
+				t.Errorf("对象 = %v", keys)
+			}
+			if !bytes.Equal(readObject(t, committed), tusData[:10]) {
+				t.Error("已提交的尾部被改写了")
+			}
+		})
+	}
+	if w := tusPatch(r, 10, tusData[10:40], sha1Checksum(tusData[10:40])); w.Code != 204 {
+		t.Fatalf("校验和一致：状态码 = %d, %s", w.Code, w.Body.String())
+	}
+}
+
+// 同一个偏移量上并发的两个PATCH：后提交的失败，删除自己的尾部时不能删掉先提交的
+func TestTusConcurrentPatch(t *testing.T) {
+	dbtest.Open(t)
+	useLocalStore(t)
+	createTusSession(t)
+	r := tusRouter()
+	if w := tusPatch(r, 0, tusData[:10], ""); w.Code != 204 {
+		t.Fatalf("状态码 = %d", w.Code)
+	}
+	ctx := context.Background()
+	stale := loadSession(t, "tus-1")
+
+	//后提交的请求先写好了尾部
+	loser, err := appendTusData(ctx, stale, 10, 5, bytes.NewReader(tusData[10:15]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := tusPatch(r, 10, tusData[10:15], ""); w.Code != 204 {
+		t.Fatalf("状态码 = %d", w.Code)
+	}
+	winner := loadSession(t, "tus-1").TusPartialKey
+	if winner == loser.partial {
+		t.Fatal("两个请求的尾部对象名相同")
+	}
+	if err := commitTusAppend(stale, 10, loser); !errors.Is(err, errTusOffsetConflict) {
+		t.Fatalf("commitTusAppend = %v", err)
+	}
+	if err := store.Delete(ctx, loser.partial); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(readObject(t, winner), tusData[:15]) {
+		t.Error("先提交的尾部被改写了")
+	}
+
+	//先提交的请求已经删除了原来的尾部，还拿着旧会话的请求按偏移量冲突处理
+	if _, err := appendTusData(ctx, stale, 10, 5, bytes.NewReader(tusData[10:15])); !errors.Is(err, errTusOffsetConflict) {
+		t.Errorf("尾部已被替换：err = %v", err)
+	}
+}
@@ -0,0 +1,186 @@
+package video
+
+//上传校验：大小上限(按角色)、允许的容器格式、根据文件头的魔数识别真实格式
+import (
+	"Project01/login"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 识别容器格式需要读取的文件头长度
+const sniffLen = 512
+
+// 各容器格式对应的MIME类型，存入存储时以识别出的格式为准，不信任客户端的Content-Type
+var containerContentTypes = map[string]string{
+	"mp4":  "video/mp4",
+	"mov":  "video/quicktime",
+	"webm": "video/webm",
+	"mkv":  "video/x-matroska",
+	"avi":  "video/x-msvideo",
+}
+
+// 扩展名对应的容器格式
+var extContainers = map[string]string{
+	".mp4":  "mp4",
+	".m4v":  "mp4",
+	".mov":  "mov",
+	".qt":   "mov",
+	".webm": "webm",
+	".mkv":  "mkv",
+	".avi":  "avi",
+}
+
+// 同一家族的格式结构相同，仅凭文件头不一定能区分，扩展名和识别结果属于同一家族即可
+var containerFamilies = map[string]string{
+	"mp4":  "isobmff",
+	"mov":  "isobmff",
+	"webm": "ebml",
+	"mkv":  "ebml",
+	"avi":  "riff",
+}
+
+// 上传校验失败，以结构化的JSON返回给客户端
+type uploadError struct {
+	Status  int    //413或415
+	Code    string //错误码，方便前端判断
+	Message string
+	Detail  gin.H //附加信息，如大小上限、允许的格式
+}
+
+func (e *uploadError) Error() string {
+	return e.Message
+}
+
+func (e *uploadError) respond(c *gin.Context) {
+	body := gin.H{"error": e.Message, "code": e.Code}
+	for k, v := range e.Detail {
+		body[k] = v
+	}
+	c.JSON(e.Status, body)
+}
+
+// 当前用户允许上传的最大字节数：取用户所有角色中最大的上限，没有单独配置的角色用默认值
+func maxUploadSize(user *login.Principal) uint64 {
+	limit := uploadCfg.MaxSize
+	for _, role := range user.Roles {
+		if size, ok := uploadCfg.RoleMaxSizes[role]; ok && size > limit {
+			limit = size
+		}
+	}
+	return limit
+}
+
+// 检查文件大小
+func checkUploadSize(user *login.Principal, size uint64) *uploadError {
+	limit := maxUploadSize(user)
+	if size > limit {
+		return &uploadError{
+			Status:  413,
+			Code:    "file_too_large",
+			Message: "文件超过大小上限",
+			Detail:  gin.H{"max_size": limit, "size": size},
+		}
+	}
+	return nil
+}
+
+func unsupportedType(message string) *uploadError {
+	return &uploadError{
+		Status:  415,
+		Code:    "unsupported_media_type",
+		Message: message,
+		Detail:  gin.H{"allowed_containers": uploadCfg.AllowedContainers},
+	}
+}
+
+// 根据扩展名检查格式是否允许，返回扩展名对应的容器格式
+func checkExtension(filename string) (string, *uploadError) {
+	container, ok := extContainers[strings.ToLower(filepath.Ext(filename))]
+	if !ok || !containerAllowed(container) {
+		return "", unsupportedType("不支持的文件格式")
+	}
+	return container, nil
+}
+
+func containerAllowed(container string) bool {
+	for _, allowed := range uploadCfg.AllowedContainers {
+		if allowed == container {
+			return true
+		}
+	}
+	return false
+}
+
+// 根据文件头检查真实格式：必须是允许的格式，并且和扩展名一致，返回应当使用的Content-Type
+func checkContent(filename string, head []byte) (string, *uploadError) {
+	extContainer, uerr := checkExtension(filename)
+	if uerr != nil {
+		return "", uerr
+	}
+	sniffed := sniffContainer(head)
+	if sniffed == "" {
+		return "", unsupportedType("无法识别的视频格式")
+	}
+	if !containerAllowed(sniffed) {
+		return "", unsupportedType("不支持的视频格式：" + sniffed)
+	}
+	if containerFamilies[sniffed] != containerFamilies[extContainer] {
+		return "", unsupportedType("文件内容(" + sniffed + ")和扩展名不一致")
+	}
+	return containerContentTypes[sniffed], nil
+}
+
+// 读取文件头用于识别格式，读完后把读取位置恢复到开头
+func readHead(src io.ReadSeeker) ([]byte, error) {
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(src, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return head[:n], nil
+}
+
+// 根据魔数识别容器格式，识别不了返回空字符串
+//
+//	MP4/MOV: ISO-BMFF，第4~8字节是box类型，第一个box一般是ftyp，品牌为"qt  "的是QuickTime
+//	         老的QuickTime文件可能直接以moov/mdat/wide/free等box开头
+//	WebM/MKV: EBML头 1A 45 DF A3，头里的DocType为webm或matroska
+//	AVI:     "RIFF" + 4字节长度 + "AVI "
+func sniffContainer(head []byte) string {
+	switch {
+	case len(head) >= 12 && bytes.Equal(head[4:8], []byte("ftyp")):
+		if bytes.Equal(head[8:12], []byte("qt  ")) {
+			return "mov"
+		}
+		return "mp4"
+	case len(head) >= 8 && isQuickTimeAtom(head[4:8]) && binary.BigEndian.Uint32(head[:4]) >= 8:
+		return "mov"
+	case len(head) >= 4 && bytes.Equal(head[:4], []byte{0x1A, 0x45, 0xDF, 0xA3}):
+		if bytes.Contains(head, []byte("webm")) {
+			return "webm"
+		}
+		if bytes.Contains(head, []byte("matroska")) {
+			return "mkv"
+		}
+		return ""
+	case len(head) >= 12 && bytes.Equal(head[:4], []byte("RIFF")) && bytes.Equal(head[8:12], []byte("AVI ")):
+		return "avi"
+	}
+	return ""
+}
+
+func isQuickTimeAtom(boxType []byte) bool {
+	switch string(boxType) {
+	case "moov", "mdat", "wide", "free", "skip", "pnot":
+		return true
+	}
+	return false
+}
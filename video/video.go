@@ -1,95 +1,66 @@
 package video
 
 import (
+	"Project01/config"
 	"Project01/db"
+	"Project01/login"
+	"Project01/storage"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
-	"github.com/minio/minio-go/v7"
-	"github.com/minio/minio-go/v7/pkg/credentials"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
-// 高层封装的MinIO客户端。
-// 常用API:PutObject上传对象，GetObject下载对象，ComposeObject合并对象，RemoveObject 删除对象
-var minioClient *minio.Client
-
-// 底层的Core客户端。提供接近原始S3协议的接口：NewMultipartUpload,PutObjectPart,CompleteMultipartUpload,AbortMultipartUpload
-var minioCore *minio.Core
-
-// 初始化MinIO,返回MinIO客户端对象的指针和错误类型
-func InitMinio() (*minio.Client, error) {
-	endpoint := "localhost:9000"
-	accessKeyID := "minioadmin"
-	secretAccessKey := "minioadmin"
-	useSSL := false
-	//初始化MinIO客户端
-	client, err := minio.New(endpoint, &minio.Options{
-		Creds:  credentials.NewStaticV4(accessKeyID, secretAccessKey, ""),
-		Secure: useSSL,
-	})
-	if err != nil {
-		return nil, err
-	}
-	minioClient = client //赋值给全局变量
+// 对象存储(MinIO或本地磁盘)，handler只依赖storage.Storage接口
+var store storage.Storage
 
-	//新增：初始化MinIO的Core客户端
-	core, err := minio.NewCore(endpoint, &minio.Options{
-		Creds:  credentials.NewStaticV4(accessKeyID, secretAccessKey, ""),
-		Secure: useSSL,
-	})
-	if err != nil {
-		return nil, err
-	}
-	minioCore = core //赋值给全局变量
+// 上传配置(分片大小、大小上限、允许的格式)，由Init设置
+var uploadCfg config.UploadConfig
 
-	return client, nil
-}
+// 预签名URL的有效期，由Init从存储配置中设置
+var presignTTL time.Duration
 
-// Range格式: Range: bytes=<start>-<end>
-// 截取Range
-func parseRange(rangeHeader string, totalSize int64) (int64, int64, error) {
-	if !strings.HasPrefix(rangeHeader, "bytes=") {
-		return 0, 0, errors.New("无效的Range格式")
-	}
-	trimmed := strings.TrimPrefix(rangeHeader, "bytes=") //<start>-<end>
-	splited := strings.Split(trimmed, "-")               //一个切片,第一个元素是start，第二个元素是end
-	if len(splited) != 2 {
-		return 0, 0, errors.New("Range的格式不完整")
-	}
-	start, err1 := strconv.ParseInt(splited[0], 10, 64) //10进制，int64
-	if err1 != nil {
-		return 0, 0, errors.New("Range的start解析错误")
-	}
-
-	var end int64
-	var err2 error
-	if splited[1] == "" {
-		end = totalSize - 1
-	} else {
-		end, err2 = strconv.ParseInt(splited[1], 10, 64)
-		if err2 != nil {
-			return 0, 0, errors.New("Range的end解析错误")
-		}
-	}
-	return start, end, nil
+// 初始化视频模块
+func Init(s storage.Storage, cfg config.UploadConfig, storageCfg config.StorageConfig, streaming config.StreamingConfig) {
+	store = s
+	uploadCfg = cfg
+	presignTTL = storageCfg.PresignTTL
+	streamingCfg = streaming
 }
 
 func UploadVideoHandler(c *gin.Context) {
+	//获取上传者身份
+	user, err := login.CurrentUser(c)
+	if err != nil {
+		c.JSON(401, gin.H{"error": err.Error()})
+		return
+	}
 	//获取上传的文件
 	file, err := c.FormFile("file") //查找字段名叫“file”的上传内容
 	if err != nil {
 		c.JSON(400, gin.H{"error": "获取上传文件失败"}) //因为是客户端请求格式不对所以是400 Bad Request
 		return
 	}
+	//检查大小上限
+	if uerr := checkUploadSize(user, uint64(file.Size)); uerr != nil {
+		uerr.respond(c)
+		return
+	}
 	//打开文件内容
 	src, err := file.Open()
 	if err != nil {
@@ -97,140 +68,225 @@ func UploadVideoHandler(c *gin.Context) {
 		return
 	}
 	defer src.Close()
-	//上传文件到MinIO
-	uploadInfo, err := minioClient.PutObject(
-		c,             //Context
-		"videos",      //桶(Bucket)的名字
-		file.Filename, //对象名称，用上传的文件名
-		src,           //Reader: 内容来源(流)
-		file.Size,     //文件的size
-		minio.PutObjectOptions{ContentType: file.Header.Get("Content-Type")},
-		//表示从 HTTP 请求的头信息中取出 "Content-Type" 字段(文件的内容类型)的值
-		//把取出来的值(如video/mp4)赋给PutObjectOptions这个结构体的ContentType字段
-	)
+	//根据文件头识别真实格式，格式不允许或和扩展名不一致的直接拒绝
+	head, err := readHead(src)
 	if err != nil {
-		c.JSON(500, gin.H{"error": "上传文件到MinIO过程失败 " + err.Error()})
+		c.JSON(500, gin.H{"error": "读取文件失败 " + err.Error()})
 		return
 	}
-
-	//获取上传者ID
-	userId, exists := c.Get("user_id") //返回interface{}类型和bool类型
-	if !exists {
-		//理论上上传者应该存在，如果不存在说明JWT中间件没有正常工作
-		c.JSON(500, gin.H{"error": "获取上传者用户Id失败,检查JWT中间件"})
+	contentType, uerr := checkContent(file.Filename, head)
+	if uerr != nil {
+		uerr.respond(c)
 		return
 	}
-	//类型断言
-	userIdFloat64, ok := userId.(float64) //Jwt解析数字时默认为为float64类型
-	if !ok {
-		c.JSON(500, gin.H{"error": "上传者id类型转换失败"})
+	//对象名由服务端生成，原始文件名只作为展示信息，不同用户上传同名文件不会互相覆盖
+	fileName := displayFileName(file.Filename)
+	objectKey := newObjectKey(user.UserId, fileName)
+	//上传文件到存储，同时计算SHA-256用于去重
+	hasher := sha256.New()
+	uploadInfo, err := store.Put(
+		c,                         //Context
+		objectKey,                 //对象名称
+		io.TeeReader(src, hasher), //Reader: 内容来源(流)
+		file.Size,                 //文件的size
+		//文件的内容类型(如video/mp4)，以识别出的格式为准，不用客户端请求头里的Content-Type
+		contentType,
+	)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "上传文件到存储过程失败 " + err.Error()})
 		return
 	}
-	//类型转换
-	userIdUint64 := uint64(userIdFloat64)
 
 	//传给数据库的变量
 	videoInfo := db.VideoInfo{
-		FileName:   file.Filename,
+		FileName:   fileName,
+		Title:      fileName,
+		ObjectKey:  objectKey,
 		Size:       file.Size,
-		UploaderId: userIdUint64,
+		UploaderId: user.UserId,
 	}
 
-	//把视频信息写入数据库
-	database := db.GetDB()
-	database.Create(&videoInfo)
+	//把视频信息写入数据库并登记内容，存储中已有相同内容时改为引用已有对象
+	if err := createVideo(&videoInfo, hex.EncodeToString(hasher.Sum(nil)), contentType, nil); err != nil {
+		c.JSON(500, gin.H{"error": "保存视频信息失败"})
+		return
+	}
 
 	//成功响应
 	c.JSON(200, gin.H{
 		"message":     "上传成功",
-		"filename":    file.Filename,
-		"bucket":      "videos",
+		"video_id":    videoInfo.ID,
+		"filename":    fileName,
 		"object_info": uploadInfo,
 	})
 }
 
+// 播放视频
+// GET/HEAD /videos/:id/play 按视频ID查找存储中的对象，?rendition=<name>播放转码后的规格
+// 支持Range(单个范围返回206，多个范围返回multipart/byteranges)、If-Range，
+// 以及用ETag/Last-Modified做缓存验证(If-None-Match/If-Modified-Since，命中返回304)
+// 视频还没有处理完成返回409，被屏蔽返回403
 func PlayVideoHandler(c *gin.Context) {
-	//获取视频文件名
-	filename := c.Param("filename")
-	if filename == "" {
-		c.JSON(400, gin.H{"error": "文件名不能为空"})
+	id, ok := parseVideoId(c)
+	if !ok {
 		return
 	}
-	//从MinIO中获取文件对象
-	obj, err := minioClient.GetObject(c, "videos", filename, minio.GetObjectOptions{})
-	if err != nil {
-		c.JSON(500, gin.H{"error": "无法获取视频文件 " + err.Error()})
+	video, ok := findVideo(c, id)
+	if !ok || !checkPlayable(c, video) {
+		return
+	}
+	filename, ok := playObjectKey(c, video)
+	if !ok {
 		return
 	}
+	serveObject(c, filename)
+}
+
+// 把存储中的对象作为视频返回，处理Range和缓存验证
+func serveObject(c *gin.Context, filename string) {
 	//获取对象元信息
-	metaInfo, err := obj.Stat()
+	metaInfo, err := store.Stat(c, filename)
 	if err != nil {
-		c.JSON(404, gin.H{"error": "视频不存在"})
+		if errors.Is(err, storage.ErrNotFound) {
+			c.JSON(404, gin.H{"error": "视频不存在"})
+		} else {
+			c.JSON(500, gin.H{"error": "无法获取视频文件 " + err.Error()})
+		}
 		return
 	}
 	totalSize := metaInfo.Size
+	contentType := videoContentType(filename)
+	etag := quoteETag(metaInfo.ETag)
 
-	//判断文件类型
-	var contentType string
-	switch {
-	case strings.HasSuffix(filename, ".mp4"):
-		contentType = "video/mp4"
-	case strings.HasSuffix(filename, ".webm"):
-		contentType = "video/webm"
-	case strings.HasSuffix(filename, ".avi"):
-		contentType = "video/x-msvideo"
-	case strings.HasSuffix(filename, ".mov"):
-		contentType = "video/quicktime"
-	case strings.HasSuffix(filename, ".mkv"):
-		contentType = "video/x-matroska"
-	default:
-		contentType = "application/octet-stream" //通用二进制数据
+	//缓存验证用到的响应头，304响应也要带上
+	c.Header("Accept-Ranges", "bytes")
+	c.Header("Content-Disposition", "inline")
+	if etag != "" {
+		c.Header("ETag", etag)
 	}
-	//获取range
-	rangeHeader := c.GetHeader("Range")
-	//没有Range,直接返回整个视频
-	if rangeHeader == "" {
-		c.Header("Content-Type", contentType)
-		c.Header("Content-Length", fmt.Sprintf("%d", totalSize))
-		c.Header("Accept-Ranges", "bytes")
-		c.Header("Content-Disposition", "inline")
-		_, err := io.Copy(c.Writer, obj)
+	if !metaInfo.LastModified.IsZero() {
+		c.Header("Last-Modified", metaInfo.LastModified.UTC().Format(http.TimeFormat))
+	}
+	if notModified(c.Request, etag, metaInfo.LastModified) {
+		c.Status(304)
+		return
+	}
+
+	//获取range，If-Range不满足时忽略Range返回整个视频
+	var ranges []byteRange
+	if rangeHeader := c.GetHeader("Range"); rangeHeader != "" && rangeStillValid(c.Request, etag, metaInfo.LastModified) {
+		ranges, err = parseRange(rangeHeader, totalSize)
 		if err != nil {
-			c.JSON(500, gin.H{"error": "(在没有Range的前提下返回整个视频)视频传输失败" + err.Error()})
+			//让浏览器重新发Range
+			c.Header("Content-Range", fmt.Sprintf("bytes */%d", totalSize))
+			c.Status(416)
 			return
 		}
-		return
 	}
-	//有Range
-	start, end, err := parseRange(rangeHeader, totalSize)
-	if err != nil || start >= totalSize {
-		//让浏览器重新发Range
-		c.Header("Content-Range", fmt.Sprintf("bytes */%d", totalSize))
-		c.Status(416)
+	//HEAD只返回响应头
+	head := c.Request.Method == http.MethodHead
+
+	switch len(ranges) {
+	case 0:
+		//没有Range,直接返回整个视频
+		c.Header("Content-Type", contentType)
+		c.Header("Content-Length", strconv.FormatInt(totalSize, 10))
+		c.Status(200)
+		if head {
+			return
+		}
+		copyRange(c, filename, byteRange{start: 0, length: totalSize}, c.Writer)
+	case 1:
+		//只读取[start,end]这一段
+		r := ranges[0]
+		c.Header("Content-Type", contentType)
+		c.Header("Content-Range", r.contentRange(totalSize))
+		c.Header("Content-Length", strconv.FormatInt(r.length, 10))
+		c.Status(206) //206 服务端返回部分资源
+		if head {
+			return
+		}
+		copyRange(c, filename, r, c.Writer)
+	default:
+		writeMultipartRanges(c, filename, contentType, totalSize, ranges, head)
+	}
+}
+
+// 多个范围：multipart/byteranges，每一段带自己的Content-Type和Content-Range
+func writeMultipartRanges(c *gin.Context, filename, contentType string, totalSize int64, ranges []byteRange, head bool) {
+	boundary := multipart.NewWriter(io.Discard).Boundary()
+	//先用同样的boundary算出整个响应体的长度
+	var counter countingWriter
+	mw := multipart.NewWriter(&counter)
+	mw.SetBoundary(boundary)
+	for _, r := range ranges {
+		mw.CreatePart(rangePartHeader(r, contentType, totalSize))
+		counter += countingWriter(r.length)
+	}
+	mw.Close()
+
+	c.Header("Content-Type", "multipart/byteranges; boundary="+boundary)
+	c.Header("Content-Length", strconv.FormatInt(int64(counter), 10))
+	c.Status(206)
+	if head {
 		return
 	}
-	if end >= totalSize {
-		end = totalSize - 1
+	mw = multipart.NewWriter(c.Writer)
+	mw.SetBoundary(boundary)
+	for _, r := range ranges {
+		part, err := mw.CreatePart(rangePartHeader(r, contentType, totalSize))
+		if err != nil || !copyRange(c, filename, r, part) {
+			return
+		}
 	}
-	length := end - start + 1
-	//定位指针
-	_, err = obj.Seek(start, io.SeekStart)
-	if err != nil {
-		c.JSON(500, gin.H{"error": "Seek失败" + err.Error()})
-		return
+	mw.Close()
+}
+
+func rangePartHeader(r byteRange, contentType string, totalSize int64) textproto.MIMEHeader {
+	return textproto.MIMEHeader{
+		"Content-Type":  {contentType},
+		"Content-Range": {r.contentRange(totalSize)},
 	}
-	//设置响应头
-	c.Status(206) //206 服务端返回部分资源
-	c.Header("Content-Type", contentType)
-	c.Header("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, totalSize))
-	c.Header("Content-Length", fmt.Sprintf("%d", length))
-	c.Header("Accept-Ranges", "bytes")
-	c.Header("Content-Disposition", "inline")
-	//将MinIO中的内容转发到浏览器,拷贝部分内容
-	_, err = io.CopyN(c.Writer, obj, length)
+}
+
+// 只统计写入的字节数
+type countingWriter int64
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
+
+// 将存储中的内容转发到浏览器
+// 响应头已经发出去了，出错时没法再返回错误信息，只能中断连接
+func copyRange(c *gin.Context, filename string, r byteRange, w io.Writer) bool {
+	obj, err := store.Get(c, filename, r.start, r.length)
 	if err != nil {
-		c.JSON(500, gin.H{"error": "视频传输失败 " + err.Error()})
-		return
+		fmt.Printf("读取视频%s失败：%v\n", filename, err)
+		return false
+	}
+	defer obj.Close()
+	if _, err := io.CopyN(w, obj, r.length); err != nil {
+		return false
+	}
+	return true
+}
+
+// 根据扩展名判断视频类型
+func videoContentType(filename string) string {
+	switch {
+	case strings.HasSuffix(filename, ".mp4"):
+		return "video/mp4"
+	case strings.HasSuffix(filename, ".webm"):
+		return "video/webm"
+	case strings.HasSuffix(filename, ".avi"):
+		return "video/x-msvideo"
+	case strings.HasSuffix(filename, ".mov"):
+		return "video/quicktime"
+	case strings.HasSuffix(filename, ".mkv"):
+		return "video/x-matroska"
+	default:
+		return "application/octet-stream" //通用二进制数据
 	}
 }
 
@@ -244,10 +300,21 @@ func InitUploadHandler(c *gin.Context) {
 	/*1.定义请求格式体，前端JSON请求需包含file_name和total_size，
 	从前端请求中获取对应的文件名和大小（后续填到session中），绑定到本地*/
 
+	//从Gin上下文获取JWT中的用户身份
+	user, err := login.CurrentUser(c)
+	if err != nil {
+		c.JSON(401, gin.H{"error": err.Error()})
+		return
+	}
+
 	//定义局部变量[匿名结构体]req
 	var req struct {
 		FileName  string `json:"file_name" binding:"required"`
 		TotalSize uint64 `json:"total_size" binding:"required"`
+		//整个文件的SHA-256(可选)，提供的话存储中已有相同内容时秒传，否则完成上传时会校验
+		FileSha256 string `json:"file_sha256"`
+		//客户端提议的分片大小(可选)，服务端会调整到允许的范围内，以响应中的chunk_size为准
+		ChunkSize uint64 `json:"chunk_size"`
 	}
 	//c.ShouldBind解析前端发来的JSON请求,把前端里面的“file_name"和“total_size”映射到本地的req.FileName和req.TotalSize
 	if err := c.ShouldBind(&req); err != nil {
@@ -255,48 +322,97 @@ func InitUploadHandler(c *gin.Context) {
 		return
 	}
 
-	/*2.初始化上传会话UploadSession，存入数据库中*/
+	fileSha256, ok := normalizeSHA256(req.FileSha256)
+	if !ok {
+		c.JSON(400, gin.H{"error": "file_sha256格式错误，应为64位十六进制"})
+		return
+	}
+	//检查大小上限和扩展名，文件内容在上传第0个分片时再检查
+	if uerr := checkUploadSize(user, req.TotalSize); uerr != nil {
+		uerr.respond(c)
+		return
+	}
+	if _, uerr := checkExtension(req.FileName); uerr != nil {
+		uerr.respond(c)
+		return
+	}
+	//秒传：存储中已经有相同内容的文件，直接创建视频记录
+	if fileSha256 != "" && instantUpload(c, user, req.FileName, fileSha256, req.TotalSize) {
+		return
+	}
 
-	uploadId := uuid.New().String()                            //生成UploadId
-	chunkSize := uint64(5 * 1024 * 1024)                       //5MB分片大小
-	totalChunks := (req.TotalSize + chunkSize - 1) / chunkSize //上取整
-	//从Gin上下文获取JWT放入的用户ID
-	userIdAny, _ := c.Get("user_id")      //拿到的是interface{} ,里面装的是float64
-	userId := uint64(userIdAny.(float64)) //userIdAny.(float64)把他从接口中取出来，uint64()再把float64转成我们需要的uint64
-	//初始化UploadSession
 	session := db.UploadSession{
-		UploadId:     uploadId,
-		UserId:       userId,
-		FileName:     req.FileName,
-		TotalSize:    req.TotalSize,
-		ChunkSize:    chunkSize,
-		TotalChunks:  totalChunks,
-		UploadedSize: 0,
-		Status:       "uploading",
+		UserId:     user.UserId,
+		FileName:   req.FileName,
+		TotalSize:  req.TotalSize,
+		FileSha256: fileSha256,
+		Protocol:   "chunk",
+	}
+	if !createUploadSession(c, &session, req.ChunkSize) {
+		return
+	}
+
+	/*4.初始化成功，返回响应*/
+	c.JSON(200, gin.H{
+		"instant":      false,
+		"upload_id":    session.UploadId,
+		"chunk_size":   session.ChunkSize,
+		"total_chunks": session.TotalChunks,
+		"concurrency":  min(uploadCfg.Concurrency, session.TotalChunks), //建议同时上传的分片数
+	})
+}
+
+// 创建上传会话：协商分片大小，创建multipart upload，保存会话和分片记录
+// session需要事先填好UserId、FileName(原始文件名)、TotalSize、FileSha256和Protocol
+// 失败时已经写好响应，返回false
+func createUploadSession(c *gin.Context, session *db.UploadSession, proposedChunkSize uint64) bool {
+	/*2.初始化上传会话UploadSession，存入数据库中*/
+
+	chunkSize, uerr := negotiateChunkSize(session.TotalSize, proposedChunkSize)
+	if uerr != nil {
+		uerr.respond(c)
+		return false
+	}
+	objectKey := newObjectKey(session.UserId, session.FileName)
+	//会话直接对应存储上的一个multipart upload，分片上传时直接写成它的part，完成时不需要再复制合并
+	multipartUploadId, err := store.NewMultipartUpload(c, objectKey, getContentType(objectKey))
+	if err != nil {
+		c.JSON(500, gin.H{"error": "初始化multipart upload失败"})
+		return false
 	}
+	//初始化UploadSession
+	session.UploadId = uuid.New().String() //生成UploadId
+	session.FileName = displayFileName(session.FileName)
+	session.ObjectKey = objectKey
+	session.MultipartUploadId = multipartUploadId
+	session.ChunkSize = chunkSize
+	session.TotalChunks = (session.TotalSize + chunkSize - 1) / chunkSize //上取整
+	session.UploadedSize = 0
+	session.Status = "uploading"
 	database := db.GetDB() //获得数据库句柄
 	//database.Create(&session)读取结构体字段，生成对应的INSERT语句，执行插入，写入数据库表
 	//(并且把自增主键回填到 session.ID 字段中)
-	if err := database.Create(&session).Error; err != nil {
+	if err := database.Create(session).Error; err != nil {
+		_ = store.AbortMultipartUpload(context.Background(), objectKey, multipartUploadId)
 		c.JSON(500, gin.H{"error": "创建上传会话失败"})
-		return
+		return false
 	}
 
 	/*3.初始化分片记录ChunkRecord*/
 
 	//创建切片存储db.ChunkRecord类型的数据,长度为totalChunks
-	chunkRecords := make([]db.ChunkRecord, totalChunks)
+	chunkRecords := make([]db.ChunkRecord, session.TotalChunks)
 	//遍历切片，每次循环生成一条ChunkRecord
-	for i := uint64(0); i < totalChunks; i++ {
+	for i := uint64(0); i < session.TotalChunks; i++ {
 		start := i * chunkSize
 		end := start + chunkSize - 1 //-1是因为文件的字节是从0开始计数
 		//如果到最后一块了
-		if end >= req.TotalSize {
-			end = req.TotalSize - 1
+		if end >= session.TotalSize {
+			end = session.TotalSize - 1
 		}
 		//初始化每次的分片记录
 		chunkRecords[i] = db.ChunkRecord{
-			UploadId:   uploadId,
+			UploadId:   session.UploadId,
 			ChunkIndex: i,
 			Size:       end - start + 1, //[start,end],长度为end-start+1
 			Status:     "pending",       //默认值，表示这个分片还没有上传
@@ -307,16 +423,35 @@ func InitUploadHandler(c *gin.Context) {
 
 	//批量插入，一条sql插入多条记录
 	if err := database.Create(&chunkRecords).Error; err != nil {
+		_ = removeSessionChunks(context.Background(), session)
+		database.Model(session).Update("status", "failed")
 		c.JSON(500, gin.H{"error": "初始化分片记录失败"})
-		return
+		return false
 	}
+	return true
+}
 
-	/*4.初始化成功，返回响应*/
-	c.JSON(200, gin.H{
-		"upload_id":    uploadId,
-		"chunk_size":   chunkSize,
-		"total_chunks": totalChunks,
-	})
+// 协商分片大小：客户端没有提议时用配置的默认值
+// 每个分片必须在S3允许的[5MB,5GB]之间，分片数不能超过10000，分片太多时自动调大分片
+func negotiateChunkSize(totalSize, proposed uint64) (uint64, *uploadError) {
+	size := proposed
+	if size == 0 {
+		size = uploadCfg.ChunkSize
+	}
+	size = max(size, config.MinChunkSize)
+	size = min(size, config.MaxChunkSize)
+	if (totalSize+size-1)/size > config.MaxParts {
+		size = (totalSize + config.MaxParts - 1) / config.MaxParts
+	}
+	if size > config.MaxChunkSize {
+		return 0, &uploadError{
+			Status:  413,
+			Code:    "file_too_large",
+			Message: "文件超过分片上传支持的最大大小",
+			Detail:  gin.H{"max_size": uint64(config.MaxParts * config.MaxChunkSize), "size": totalSize},
+		}
+	}
+	return size, nil
 }
 
 // 执行分片上传
@@ -325,11 +460,26 @@ func UploadChunkHandler(c *gin.Context) {
 	//1.从URL路径中获取uploadId和块的index【保证和初始化的分片信息对应上】
 	uploadId := c.Param("uploadId")
 	indexStr := c.Param("index") //（HTTP请求里面的东西都是字符串）
+	if !checkProtocol(c, currentSession(c), "chunk") {
+		return
+	}
 	index, err := strconv.Atoi(indexStr)
-	if err != nil {
+	if err != nil || index < 0 || uint64(index) >= currentSession(c).TotalChunks {
 		c.JSON(400, gin.H{"error": "分片编号错误"})
 		return
 	}
+	//初始化时生成的分片记录，里面有这个分片应有的大小
+	var chunkRecord db.ChunkRecord
+	if err := db.GetDB().Where("upload_id=? AND chunk_index=?", uploadId, index).First(&chunkRecord).Error; err != nil {
+		c.JSON(500, gin.H{"error": "查询分片记录失败"})
+		return
+	}
+	//客户端计算的分片SHA-256(可选)
+	expectedChecksum, ok := chunkChecksumFromRequest(c)
+	if !ok {
+		c.JSON(400, gin.H{"error": "分片SHA-256格式错误，应为64位十六进制"})
+		return
+	}
 
 	//2.从请求表单中拿到该分片文件
 	//gin从请求中找字段名为file的文件，返回一个*multipart.FileHeader 对象
@@ -340,88 +490,171 @@ func UploadChunkHandler(c *gin.Context) {
 		return
 	}
 
+	//分片大小必须和初始化时划分的一致[StartByte,EndByte]
+	expectedSize := chunkRecord.EndByte - chunkRecord.StartByte + 1
+	if uint64(file.Size) != expectedSize {
+		c.JSON(400, gin.H{
+			"error":         "分片大小不正确",
+			"code":          "chunk_size_mismatch",
+			"expected_size": expectedSize,
+			"size":          file.Size,
+		})
+		return
+	}
+
 	//打开文件
-	src, _ := file.Open()
+	src, err := file.Open()
+	if err != nil {
+		c.JSON(500, gin.H{"error": "读取分片失败"})
+		return
+	}
 	defer src.Close()
-	//拼出这片 分片 存到MinIO中的路径
-	objectName := fmt.Sprintf("uploads/%s/chunk_%d", uploadId, index)
+	session := currentSession(c)
+	//第0个分片包含文件头，在这里识别真实格式
+	if index == 0 {
+		head, err := readHead(src)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "读取分片失败"})
+			return
+		}
+		if _, uerr := checkContent(session.FileName, head); uerr != nil {
+			uerr.respond(c)
+			return
+		}
+	}
 
 	//3.存储
-	//把用户上传的分片数据流写到MinIO的指定路径,即上传分片到MinIO上
-	_, err = minioClient.PutObject(
-		c,          //Gin的*gin.Context，实现了context.Context 接口
-		"videos",   //MinIO中的桶(Bucket)的名称
-		objectName, //存储对象，此处即分片文件在MinIO中的路径
-		src,        //数据来源，io.Reader,文件内容的流，MinIO从这里读数据
-		file.Size,  //当前分片的数据大小（字节数）【注意：是实际收到的分片大小】
-		//上传时的附加参数
-		minio.PutObjectOptions{
-			//把上传文件的MIME类型（如video/mp4)一并告诉MinIO
-			ContentType: file.Header.Get("Content-Type"),
-		},
+	//分片直接作为会话的multipart upload的第index+1个part上传(part编号从1开始)
+	//边上传边计算SHA-256，不用把分片读两遍
+	hasher := sha256.New()
+	part, err := store.PutPart(
+		c,                         //Gin的*gin.Context，实现了context.Context 接口
+		session.ObjectKey,         //最终的对象名
+		session.MultipartUploadId, //初始化时创建的multipart upload
+		index+1,                   //part编号
+		io.TeeReader(src, hasher), //数据来源，io.Reader,文件内容的流，存储从这里读数据
+		file.Size,                 //当前分片的数据大小（字节数）【注意：是实际收到的分片大小】
 	)
 	if err != nil {
 		c.JSON(500, gin.H{"error": "上传分片失败：" + err.Error()})
 		return
 	}
+	checksum := hex.EncodeToString(hasher.Sum(nil))
+	if expectedChecksum != "" && checksum != expectedChecksum {
+		//存储中同一个part编号的数据已经被覆盖成损坏的数据，之前完成过的分片也要改回pending，
+		//出现在missing_chunks里让客户端重传，否则完成上传时会用旧的ETag而失败
+		if err := resetChunk(uploadId, uint64(index), part.ETag); err != nil {
+			c.JSON(500, gin.H{"error": "更新分片记录失败"})
+			return
+		}
+		respondChecksumMismatch(c, "chunk_checksum_mismatch", expectedChecksum, checksum)
+		return
+	}
 	//4.更新数据库
-	//获得数据库句柄
-	database := db.GetDB()
-	tx := database.Begin() //开启事务
-	defer func() {
-		//recover()捕捉panic（运行时异常）,如果出现panic,事务回滚
-		if r := recover(); r != nil {
-			tx.Rollback()
+	//同一个会话的不同分片可能被并发上传，在事务里对分片记录加行锁(SELECT ... FOR UPDATE)，
+	//同一个分片的并发重传会排队，只有第一次完成的那次累加已上传大小
+	isFirstTimeCompleted := false
+	err = db.GetDB().Transaction(func(tx *gorm.DB) error {
+		var existingChunk db.ChunkRecord
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("upload_id=? AND chunk_index=?", uploadId, index).
+			First(&existingChunk).Error; err != nil {
+			return err
 		}
-	}()
-	//检查分片记录是否存在且已完成
-	var existingChunk db.ChunkRecord
-	//isNewChunk布尔值表示这个分片是否是新分片
-	isNewChunk := tx.Where("upload_id=? AND chunk_index=?", uploadId, index).First(&existingChunk).Error != nil
-	//判断是否是该分片的第一次有效完成
-	isFirstTimeCompleted := isNewChunk || existingChunk.Status != "completed"
-
-	//上传分片成功，更新数据库中的分片记录chunk_records
-	if err := tx.Model(&db.ChunkRecord{}). //Model(&db.ChunkRecord{}):要更新的表是chunk_records
-						Where("upload_id=? AND chunk_index=?", uploadId, index).
-						Updates(map[string]interface{}{
-			"status": "completed",
-			"s3_key": objectName,
-			"size":   file.Size,
+		isFirstTimeCompleted = existingChunk.Status != "completed"
+		//上传分片成功，更新数据库中的分片记录chunk_records
+		if err := tx.Model(&existingChunk).Updates(map[string]interface{}{
+			"status":        "completed",
+			"etag":          part.ETag,
+			"size":          file.Size,
+			"checksum":      checksum,
+			"rejected_etag": "",
 		}).Error; err != nil {
+			return err
+		}
+		//只有在首次有效完成时才累加大小（情况：新分片，补交分片计入进度。重复上传已完成分片只覆盖状态不会计入进度）
+		if !isFirstTimeCompleted {
+			return nil
+		}
+		//gorm.Expr()不用先查后加，并发上传不同分片时由数据库保证累加正确
+		return tx.Model(&db.UploadSession{}).
+			Where("upload_id=?", uploadId).
+			Update("uploaded_size", gorm.Expr("uploaded_size+?", file.Size)).Error
+	})
+	if err != nil {
 		c.JSON(500, gin.H{"error": "更新分片记录失败"})
 		return
 	}
-	//只有在首次有效完成时才累加大小（情况：新分片，补交分片计入进度。重复上传已完成分片只覆盖状态不会计入进度）
-	if isFirstTimeCompleted {
-		//更新数据库中的upload_sessions表中的已上传大小字段（upload_size)
-		//Model(&db.UploadSession{})表示要操作upload_sessions这张表
-		//gorm.Expr("表达式",参数)表示告诉GORM,不要把这个当做值，而是要当做表达式处理，
-		//在这里用来累加已上传的字节数（【是实际收到的分片大小】）。
-		//gorm.Expr()不用先查后加，避免并发条件出错
-		if err := tx.Model(&db.UploadSession{}).
-			Where("upload_id=?", uploadId).
-			Update("uploaded_size", gorm.Expr("uploaded_size+?", file.Size)).Error; err != nil {
-			tx.Rollback()
-			c.JSON(500, gin.H{"error": "更新会话失败"})
-			return
-		}
-	}
-	tx.Commit()
 	//5.响应消息
 	c.JSON(200, gin.H{
 		"message":     "分片上传成功",
 		"chunk_index": index,
 		"is_retry":    !isFirstTimeCompleted,
+		"sha256":      checksum,
+	})
+}
+
+// 分片改回pending，清掉ETag和校验和，记下被拒绝的part的ETag；已经完成的分片同时从已上传大小中减掉
+func resetChunk(uploadId string, index uint64, rejectedETag string) error {
+	return db.GetDB().Transaction(func(tx *gorm.DB) error {
+		var chunk db.ChunkRecord
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("upload_id=? AND chunk_index=?", uploadId, index).
+			First(&chunk).Error; err != nil {
+			return err
+		}
+		//Updates会把新的值写回chunk，先记下原来的状态
+		wasCompleted := chunk.Status == "completed"
+		if err := tx.Model(&chunk).Updates(map[string]interface{}{
+			"status":        "pending",
+			"etag":          "",
+			"checksum":      "",
+			"rejected_etag": rejectedETag,
+		}).Error; err != nil {
+			return err
+		}
+		if !wasCompleted {
+			return nil
+		}
+		return tx.Model(&db.UploadSession{}).
+			Where("upload_id=?", uploadId).
+			Update("uploaded_size", gorm.Expr("uploaded_size-?", chunk.Size)).Error
 	})
 }
 
 // 完成分片上传
 // POST /upload/<uploadId>/complete
-// 查询所有分片，如果有未完成的，返回错误，如果全部完成，更新这个上传会话为完成
-// 还要写MinIO Multipart API合并
+// 会话状态：uploading -> merging -> completed/failed，由条件更新保证同一个会话只会合并一次
+// 完成后重复调用返回同样的结果(同一个video_id)，客户端超时后可以放心重试
 func CompleteUploadHandler(c *gin.Context) {
-	uploadId := c.Param("uploadId")
+	//会话的存在性和归属已经由RequireUploadSession校验过了
+	session := currentSession(c)
+	if session.Status != "uploading" {
+		respondSessionState(c, session)
+		return
+	}
+	if sessionExpired(session) {
+		c.JSON(410, gin.H{"error": "上传会话已过期，请重新上传"})
+		return
+	}
+	//客户端通过预签名URL直传的分片，先从存储上确认
+	if err := syncUploadedParts(c, session); err != nil {
+		c.JSON(500, gin.H{"error": "确认已上传分片失败"})
+		return
+	}
+	videoId, ok := completeUpload(c, session)
+	if !ok {
+		return
+	}
+	c.JSON(200, gin.H{"message": "文件上传完成",
+		"video_id": videoId,
+		"filename": session.FileName})
+}
+
+// 完成上传会话：合并分片、校验文件，创建视频记录，返回视频ID
+// 调用方要保证会话处于uploading状态；失败时已经写好响应，返回false
+func completeUpload(c *gin.Context, session *db.UploadSession) (uint64, bool) {
+	uploadId := session.UploadId
 	database := db.GetDB()
 	var count int64
 	//检查状态是否全部完成
@@ -430,115 +663,194 @@ func CompleteUploadHandler(c *gin.Context) {
 		Where("upload_id=? AND status!=?", uploadId, "completed").
 		Count(&count).Error; err != nil {
 		c.JSON(500, gin.H{"error": "检查分片状态失败"})
-		return
+		return 0, false
 	}
 	//count数量大于0，还有未完成的分片
 	if count > 0 {
 		c.JSON(400, gin.H{"error": "还有分片未完成"})
-		return
+		return 0, false
 	}
 
-	//获取上传会话的信息【合并分片时需要知道文件名，写入video_infos时需要知道总大小，要确认这个会话真实存在】
-	var session db.UploadSession
-	//传入了 db.UploadSession 结构体，GORM 会自动把它映射到对应的表 upload_sessions 去查询
-	if err := database.Where("upload_id=?", uploadId).First(&session).Error; err != nil {
-		c.JSON(404, gin.H{"error": "上传会话不存在"})
-		return
-	}
 	//获取所有分片，按顺序排列
-	// 	SELECT *
-	// FROM chunk_records
-	// WHERE upload_id = '<uploadId>' AND status = 'completed'
-	// ORDER BY chunk_index;
 	var chunks []db.ChunkRecord
-	database.Where("upload_id=? AND status=?", uploadId, "completed").Order("chunk_index").Find(&chunks)
+	if err := database.Where("upload_id=? AND status=?", uploadId, "completed").
+		Order("chunk_index").Find(&chunks).Error; err != nil {
+		c.JSON(500, gin.H{"error": "查询分片记录失败"})
+		return 0, false
+	}
 
-	//合并分片
-	err := mergeChunksToFinalFile(session.FileName, chunks)
+	//uploading -> merging：并发的完成请求只有一个能更新成功，其余的按最新状态返回
+	ok, err := transitSession(database, uploadId, "uploading", "merging")
 	if err != nil {
+		c.JSON(500, gin.H{"error": "更新会话状态失败"})
+		return 0, false
+	}
+	if !ok {
+		respondCurrentSessionState(c, uploadId)
+		return 0, false
+	}
+
+	//完成multipart upload：分片已经是存储上的part，这里只需要按顺序提交，存储端合并
+	if err := completeMultipartUpload(session, chunks); err != nil {
+		//multipart upload还在，退回uploading，客户端可以重试
+		transitSession(database, uploadId, "merging", "uploading")
 		c.JSON(500, gin.H{"error": "合并分片失败 " + err.Error()})
-		return
+		return 0, false
+	}
+	//以下失败时multipart upload已经完成，会话无法继续，删除合并后的对象，会话标记为failed
+	failMerge := func() {
+		_ = store.Delete(context.Background(), session.ObjectKey)
+		transitSession(database, uploadId, "merging", "failed")
+	}
+	//直传的第0个分片没有经过服务端，合并后再按文件头检查一次真实格式
+	if uerr := checkObjectContent(c, session); uerr != nil {
+		failMerge()
+		uerr.respond(c)
+		return 0, false
+	}
+	//校验整个文件的SHA-256：只有客户端提供了才需要读一遍合并后的文件
+	//校验过的SHA-256才会登记到内容表用于秒传，没有提供的不参与去重
+	var fileChecksum string
+	if session.FileSha256 != "" {
+		fileChecksum, err = hashObject(context.Background(), session.ObjectKey)
+		if err != nil {
+			failMerge()
+			c.JSON(500, gin.H{"error": "校验文件失败 " + err.Error()})
+			return 0, false
+		}
+		if fileChecksum != session.FileSha256 {
+			failMerge()
+			respondChecksumMismatch(c, "file_checksum_mismatch", session.FileSha256, fileChecksum)
+			return 0, false
+		}
 	}
-	//创建最终的视频记录
-	userIdAny, _ := c.Get("user_id")
-	userId := uint64(userIdAny.(float64))
+	//创建最终的视频记录，和 merging -> completed 在同一个事务里，视频记录只会创建一次
 	videoInfo := db.VideoInfo{
 		FileName:   session.FileName,
 		Title:      session.FileName,
+		ObjectKey:  session.ObjectKey,
 		Size:       int64(session.TotalSize),
-		UploaderId: userId,
+		UploaderId: session.UserId,
+	}
+	err = createVideo(&videoInfo, fileChecksum, getContentType(session.ObjectKey), func(tx *gorm.DB) error {
+		result := tx.Model(&db.UploadSession{}).
+			Where("upload_id=? AND status=?", uploadId, "merging").
+			Updates(map[string]interface{}{"status": "completed", "video_id": videoInfo.ID})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errors.New("上传会话状态已改变")
+		}
+		return nil
+	})
+	if err != nil {
+		//createVideo失败时已经删除了合并后的对象
+		transitSession(database, uploadId, "merging", "failed")
+		c.JSON(500, gin.H{"error": "保存视频信息失败"})
+		return 0, false
 	}
-	database.Create(&videoInfo)
-	//清理分片文件
-	go cleanupChunks(chunks)
+	return videoInfo.ID, true
+}
 
-	//更新上传会话表，将这个会话的状态改为已完成
-	if err := database.Model(&db.UploadSession{}).
-		Where("upload_id=?", uploadId).
-		Update("status", "completed").Error; err != nil {
-		c.JSON(500, gin.H{"error": "更新会话状态失败"})
+// 条件更新会话状态：只有当前状态是from时才改为to，返回是否更新成功
+func transitSession(tx *gorm.DB, uploadId, from, to string) (bool, error) {
+	result := tx.Model(&db.UploadSession{}).
+		Where("upload_id=? AND status=?", uploadId, from).
+		Update("status", to)
+	return result.RowsAffected > 0, result.Error
+}
+
+// 重新查询会话，按最新状态响应
+func respondCurrentSessionState(c *gin.Context, uploadId string) {
+	var session db.UploadSession
+	if err := db.GetDB().Where("upload_id=?", uploadId).First(&session).Error; err != nil {
+		c.JSON(500, gin.H{"error": "查询上传会话失败"})
 		return
 	}
-	c.JSON(200, gin.H{"message": "文件上传完成",
-		"filename": session.FileName})
+	respondSessionState(c, &session)
 }
 
-// CompleteUploadHandler中用到的函数：合并分片
-func mergeChunksToFinalFile(filename string, chunks []db.ChunkRecord) error {
-	//创建根上下文
-	ctx := context.Background()
-	//获取文件的MIME类型
-	contentType := getContentType(filename)
-	//1.init-初始化Multipart Upload
-	up, err := minioCore.NewMultipartUpload(
-		ctx,
-		"videos", //桶名
-		filename, //最终对象名
-		minio.PutObjectOptions{ContentType: contentType}, //上传选项
-	)
-	if err != nil {
-		return fmt.Errorf("初始化multipart upload 失败：%w", err)
-	}
-	//标记上传是否完成
-	completed := false
-	//Abort
-	defer func() {
-		//如果没有完成，终止Multipart Upload
-		if !completed {
-			_ = minioCore.AbortMultipartUpload(ctx, "videos", filename, up)
-		}
-	}()
+// 会话已经不在uploading状态时完成请求的响应
+// completed：返回和第一次完成时同样的结果；merging：另一个请求正在合并，稍后重试
+func respondSessionState(c *gin.Context, session *db.UploadSession) {
+	switch session.Status {
+	case "completed":
+		c.JSON(200, gin.H{"message": "文件上传完成",
+			"video_id": session.VideoId,
+			"filename": session.FileName})
+	case "merging":
+		c.JSON(202, gin.H{"message": "正在合并分片，请稍后重试", "status": session.Status})
+	default:
+		c.JSON(409, gin.H{"error": "上传会话已结束", "status": session.Status})
+	}
+}
 
-	//2.使用已经在MinIO上存在的分片
-	completeParts := make([]minio.CompletePart, 0, len(chunks))
+// CompleteUploadHandler中用到的函数：按分片顺序提交所有part，完成会话的multipart upload
+func completeMultipartUpload(session *db.UploadSession, chunks []db.ChunkRecord) error {
+	parts := make([]storage.Part, 0, len(chunks))
 	for _, chunk := range chunks {
-		//从已经存在的分片中获取数据流
-		obj, err := minioClient.GetObject(ctx, "videos", chunk.S3Key, minio.GetObjectOptions{})
-		if err != nil {
-			return fmt.Errorf("获取分片%d失败：%w", chunk.ChunkIndex, err)
-		}
-		//使用PutObjectPart把现有分片复制到新的multipart upload中
-		partRes, err := minioCore.PutObjectPart(ctx, "videos", filename, up, int(chunk.ChunkIndex+1), obj, int64(chunk.Size), minio.PutObjectPartOptions{})
-		obj.Close()
-		if err != nil {
-			return fmt.Errorf("上传分片 %d 到myltipart失败：%w", chunk.ChunkIndex, err)
-		}
-		completeParts = append(completeParts, minio.CompletePart{
-			PartNumber: int(chunk.ChunkIndex + 1),
-			ETag:       partRes.ETag,
-		})
+		parts = append(parts, storage.Part{PartNumber: int(chunk.ChunkIndex + 1), ETag: chunk.ETag})
 	}
-
-	//3.Complete
-	_, err = minioCore.CompleteMultipartUpload(ctx, "videos", filename, up, completeParts, minio.PutObjectOptions{})
-	if err != nil {
+	if err := store.CompleteMultipartUpload(context.Background(), session.ObjectKey, session.MultipartUploadId, parts); err != nil {
 		return fmt.Errorf("完成multipart Upload失败:%w", err)
 	}
-	completed = true
 	return nil
 }
 
-// mergeChunksToFinalFile用到的辅助函数，用来判断文件类型
+// 读取合并后对象的文件头，检查真实格式
+func checkObjectContent(ctx context.Context, session *db.UploadSession) *uploadError {
+	obj, err := store.Get(ctx, session.ObjectKey, 0, sniffLen)
+	if err != nil {
+		return unsupportedType("读取文件头失败")
+	}
+	defer obj.Close()
+	head, err := io.ReadAll(obj)
+	if err != nil {
+		return unsupportedType("读取文件头失败")
+	}
+	_, uerr := checkContent(session.FileName, head)
+	return uerr
+}
+
+// 计算存储中对象的SHA-256
+func hashObject(ctx context.Context, key string) (string, error) {
+	obj, err := store.Get(ctx, key, 0, -1)
+	if err != nil {
+		return "", err
+	}
+	defer obj.Close()
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, obj); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// 生成视频在存储中的对象名：videos/<上传者ID>/<UUID><扩展名>
+// 按上传者分目录，保留小写扩展名方便按后缀判断文件类型
+func newObjectKey(uploaderId uint64, filename string) string {
+	ext := strings.ToLower(filepath.Ext(filename))
+	//扩展名只允许字母数字，防止奇怪的字符进入对象名
+	if len(ext) > 10 || strings.TrimLeft(ext[min(1, len(ext)):], "abcdefghijklmnopqrstuvwxyz0123456789") != "" {
+		ext = ""
+	}
+	return fmt.Sprintf("videos/%d/%s%s", uploaderId, uuid.New().String(), ext)
+}
+
+// 清理客户端传来的文件名：去掉路径部分，截断到VideoInfo.FileName的长度限制
+func displayFileName(filename string) string {
+	name := filepath.Base(strings.ReplaceAll(filename, "\\", "/"))
+	if name == "." || name == "/" {
+		name = "untitled"
+	}
+	if runes := []rune(name); len(runes) > maxTitleLen {
+		name = string(runes[:maxTitleLen])
+	}
+	return name
+}
+
+// 根据扩展名判断文件类型，用作multipart upload的Content-Type
 func getContentType(filename string) string {
 	ext := filepath.Ext(filename)         //取文件后缀
 	mimeType := mime.TypeByExtension(ext) //根据后缀检查MIME类型
@@ -548,38 +860,37 @@ func getContentType(filename string) string {
 	return mimeType
 }
 
-// CompleteUploadHandler中用到的函数：异步清理分片文件
-func cleanupChunks(chunks []db.ChunkRecord) {
-	ctx := context.Background()
-	for _, chunk := range chunks {
-		err := minioClient.RemoveObject(ctx, "videos", chunk.S3Key, minio.RemoveObjectOptions{})
-		if err != nil {
-			fmt.Printf("清理分片失败：%s: %v\n", chunk.S3Key, err)
-		}
-	}
-	fmt.Printf("已清理%d个分片文件\n", len(chunks))
-}
-
 // 查询上传进度
 // GET /upload/:uploadId/progress
 func GetUploadProgressHandler(c *gin.Context) {
 	uploadId := c.Param("uploadId") //从请求URL中获取uploadId的值
 	database := db.GetDB()
-	//查询上传会话
-	var session db.UploadSession
-	if err := database.Where("upload_id=?", uploadId).First(&session).Error; err != nil {
-		c.JSON(404, gin.H{"error": "上传会话不存在"})
+	//上传会话(由RequireUploadSession查询并校验归属)
+	session := currentSession(c)
+	//客户端通过预签名URL直传的分片，从存储上确认
+	if err := syncUploadedParts(c, session); err != nil {
+		c.JSON(500, gin.H{"error": "确认已上传分片失败"})
 		return
 	}
 	//查询已完成的分片
-	var completedChunks []db.ChunkRecord
-	database.Where("upload_id=? AND status=?", uploadId, "completed").Find(&completedChunks)
+	var completedChunks []uint64
+	if err := database.Model(&db.ChunkRecord{}).
+		Where("upload_id=? AND status=?", uploadId, "completed").
+		Pluck("chunk_index", &completedChunks).Error; err != nil {
+		c.JSON(500, gin.H{"error": "查询分片记录失败"})
+		return
+	}
+	c.JSON(200, uploadProgress(session, completedChunks))
+}
+
+// 上传会话的进度：已完成的分片、缺失的分片(前端据此重传)和百分比
+func uploadProgress(session *db.UploadSession, completedChunks []uint64) gin.H {
 	//计算缺失分片
 	completedMap := make(map[uint64]bool)
-	for _, chunk := range completedChunks {
-		completedMap[chunk.ChunkIndex] = true
+	for _, index := range completedChunks {
+		completedMap[index] = true
 	}
-	var missingChunks []uint64
+	missingChunks := []uint64{}
 	for i := uint64(0); i < session.TotalChunks; i++ {
 		if !completedMap[i] {
 			missingChunks = append(missingChunks, i)
@@ -587,15 +898,18 @@ func GetUploadProgressHandler(c *gin.Context) {
 	}
 	//计算进度百分比
 	progress := (float64(session.UploadedSize) / float64(session.TotalSize)) * 100
-	//返回JSON
-	c.JSON(200, gin.H{
-		"upload_id":        uploadId,
+	return gin.H{
+		"upload_id":        session.UploadId,
+		"file_name":        session.FileName,
 		"status":           session.Status,
 		"progress":         progress,
 		"uploaded_size":    session.UploadedSize,
 		"total_size":       session.TotalSize,
-		"missing_chunks":   missingChunks,        //缺失的分片编号的切片，前端据此重传
-		"completed_chunks": len(completedChunks), //已完成分片数
+		"chunk_size":       session.ChunkSize,
+		"missing_chunks":   missingChunks,     //缺失的分片编号的切片，前端据此重传
+		"completed_chunks": len(completedMap), //已完成分片数
 		"total_chunks":     session.TotalChunks,
-	})
+		"created_time":     session.CreatedTime,
+		"updated_time":     session.UpdatedTime,
+	}
 }
@@ -0,0 +1,245 @@
+package video
+
+import (
+	"Project01/db"
+	"Project01/storage"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 测试用的本地存储，替换包级的store，测试结束后恢复
+func useLocalStore(t *testing.T) storage.Storage {
+	t.Helper()
+	s, err := storage.NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := store
+	store = s
+	t.Cleanup(func() { store = old })
+	return s
+}
+
+func putObject(t *testing.T, key string, data []byte) storage.ObjectInfo {
+	t.Helper()
+	info, err := store.Put(context.Background(), key, bytes.NewReader(data), int64(len(data)), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+// 只注册serveObject的路由，视频记录的查询和状态检查需要数据库，不在这里测
+func serveRouter(key string) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	handler := func(c *gin.Context) { serveObject(c, key) }
+	r.GET("/play", handler)
+	r.HEAD("/play", handler)
+	return r
+}
+
+// 代替RequireUploadSession：按路径参数从数据库读取会话放入上下文，不检查登录和归属
+func withSession(c *gin.Context) {
+	var session db.UploadSession
+	if err := db.GetDB().Where("upload_id=?", c.Param("uploadId")).First(&session).Error; err != nil {
+		c.AbortWithStatus(404)
+		return
+	}
+	c.Set(uploadSessionKey, &session)
+}
+
+func doRequest(r http.Handler, method string, header map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/play", nil)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestServeObject(t *testing.T) {
+	useLocalStore(t)
+	data := []byte("0123456789abcdefghij")
+	putObject(t, "videos/1/a.mp4", data)
+	r := serveRouter("videos/1/a.mp4")
+
+	tests := []struct {
+		name         string
+		method       string
+		rangeHeader  string
+		code         int
+		body         string
+		contentRange string
+	}{
+		{"整个文件", "GET", "", 200, string(data), ""},
+		{"HEAD没有响应体", "HEAD", "", 200, "", ""},
+		{"一个范围", "GET", "bytes=2-5", 206, "2345", "bytes 2-5/20"},
+		{"后缀范围", "GET", "bytes=-3", 206, "hij", "bytes 17-19/20"},
+		{"到末尾", "GET", "bytes=15-", 206, "fghij", "bytes 15-19/20"},
+		{"HEAD一个范围", "HEAD", "bytes=2-5", 206, "", "bytes 2-5/20"},
+		{"范围超出文件", "GET", "bytes=20-", 416, "", "bytes */20"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := map[string]string{}
+			if tt.rangeHeader != "" {
+				header["Range"] = tt.rangeHeader
+			}
+			w := doRequest(r, tt.method, header)
+			if w.Code != tt.code {
+				t.Fatalf("状态码 = %d, want %d", w.Code, tt.code)
+			}
+			if got := w.Body.String(); got != tt.body {
+				t.Errorf("响应体 = %q, want %q", got, tt.body)
+			}
+			if got := w.Header().Get("Content-Range"); got != tt.contentRange {
+				t.Errorf("Content-Range = %q, want %q", got, tt.contentRange)
+			}
+			if tt.code != 416 && w.Header().Get("Content-Type") != "video/mp4" {
+				t.Errorf("Content-Type = %q", w.Header().Get("Content-Type"))
+			}
+		})
+	}
+}
+
+// 多个范围返回multipart/byteranges，Content-Length要和实际响应体一致
+func TestServeObjectMultipleRanges(t *testing.T) {
+	useLocalStore(t)
+	putObject(t, "videos/1/a.mp4", []byte("0123456789abcdefghij"))
+	r := serveRouter("videos/1/a.mp4")
+
+	w := doRequest(r, "GET", map[string]string{"Range": "bytes=0-1,10-12"})
+	if w.Code != 206 {
+		t.Fatalf("状态码 = %d", w.Code)
+	}
+	if got := w.Header().Get("Content-Length"); got != strconv.Itoa(w.Body.Len()) {
+		t.Errorf("Content-Length = %s，实际响应体%d字节", got, w.Body.Len())
+	}
+	mediaType, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	if err != nil || mediaType != "multipart/byteranges" {
+		t.Fatalf("Content-Type = %q", w.Header().Get("Content-Type"))
+	}
+	mr := multipart.NewReader(w.Body, params["boundary"])
+	want := []struct{ contentRange, body string }{
+		{"bytes 0-1/20", "01"},
+		{"bytes 10-12/20", "abc"},
+	}
+	for _, p := range want {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(part)
+		if part.Header.Get("Content-Range") != p.contentRange || string(body) != p.body {
+			t.Errorf("分段 = %s %q, want %s %q", part.Header.Get("Content-Range"), body, p.contentRange, p.body)
+		}
+	}
+	if _, err := mr.NextPart(); err != io.EOF {
+		t.Errorf("多余的分段：%v", err)
+	}
+}
+
+func TestServeObjectNotFound(t *testing.T) {
+	useLocalStore(t)
+	w := doRequest(serveRouter("videos/1/missing.mp4"), "GET", nil)
+	if w.Code != 404 {
+		t.Errorf("状态码 = %d", w.Code)
+	}
+}
+
+// 分片按编号合并成最终对象，再读回来计算SHA-256
+func TestCompleteMultipartUpload(t *testing.T) {
+	s := useLocalStore(t)
+	ctx := context.Background()
+	session := &db.UploadSession{ObjectKey: "videos/1/b.mp4"}
+	uploadId, err := s.NewMultipartUpload(ctx, session.ObjectKey, "video/mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.MultipartUploadId = uploadId
+	chunks := [][]byte{[]byte("first-"), []byte("second-"), []byte("third")}
+	var records []db.ChunkRecord
+	for i, chunk := range chunks {
+		part, err := s.PutPart(ctx, session.ObjectKey, uploadId, i+1, bytes.NewReader(chunk), int64(len(chunk)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, db.ChunkRecord{ChunkIndex: uint64(i), ETag: part.ETag})
+	}
+	if err := completeMultipartUpload(session, records); err != nil {
+		t.Fatal(err)
+	}
+	whole := bytes.Join(chunks, nil)
+	got, err := hashObject(ctx, session.ObjectKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(whole)
+	if want := hex.EncodeToString(sum[:]); got != want {
+		t.Errorf("hashObject = %s, want %s", got, want)
+	}
+}
+
+// 合并后的对象按文件头检查真实格式
+func TestCheckObjectContent(t *testing.T) {
+	useLocalStore(t)
+	old := uploadCfg
+	uploadCfg.AllowedContainers = []string{"mp4", "webm"}
+	t.Cleanup(func() { uploadCfg = old })
+
+	mp4Head := append([]byte{0, 0, 0, 0x18}, []byte("ftypisom\x00\x00\x02\x00isomiso2")...)
+	putObject(t, "videos/1/a.mp4", append(mp4Head, make([]byte, 1000)...))
+	putObject(t, "videos/1/b.mp4", []byte("plain text, not a video"))
+
+	tests := []struct {
+		key, filename string
+		ok            bool
+	}{
+		{"videos/1/a.mp4", "a.mp4", true},
+		{"videos/1/a.mp4", "a.webm", false}, //和扩展名不一致
+		{"videos/1/a.mp4", "a.mov", false},  //扩展名不允许
+		{"videos/1/b.mp4", "b.mp4", false},  //认不出格式
+	}
+	for _, tt := range tests {
+		uerr := checkObjectContent(context.Background(), &db.UploadSession{ObjectKey: tt.key, FileName: tt.filename})
+		if (uerr == nil) != tt.ok {
+			t.Errorf("checkObjectContent(%s, %s) = %v", tt.key, tt.filename, uerr)
+		}
+	}
+}
+
+// media包通过objectReader按需读取存储中的对象
+func TestObjectReader(t *testing.T) {
+	useLocalStore(t)
+	data := []byte("0123456789")
+	putObject(t, "videos/1/a.mp4", data)
+	r := &objectReader{ctx: context.Background(), key: "videos/1/a.mp4", size: int64(len(data))}
+
+	buf := make([]byte, 4)
+	if n, err := r.ReadAt(buf, 3); n != 4 || err != nil || string(buf) != "3456" {
+		t.Errorf("ReadAt(3) = %d %v %q", n, err, buf)
+	}
+	//读到末尾时返回读到的部分和io.EOF
+	if n, err := r.ReadAt(buf, 8); n != 2 || err != io.EOF || string(buf[:n]) != "89" {
+		t.Errorf("ReadAt(8) = %d %v %q", n, err, buf[:n])
+	}
+	if n, err := r.ReadAt(buf, 10); n != 0 || err != io.EOF {
+		t.Errorf("ReadAt(10) = %d %v", n, err)
+	}
+	if n, err := r.ReadAt(nil, 0); n != 0 || err != nil {
+		t.Errorf("ReadAt(nil) = %d %v", n, err)
+	}
+}